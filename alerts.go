@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Alerts a single user may have
+const maxAlertsPerUser = 20
+
+// errTooManyAlerts is returned when saving an alert of a user who has maxAlertsPerUser alerts
+var errTooManyAlerts = errors.New("too many alerts")
+
+// Cooldown of recurring alerts unless given explicitly
+const defaultAlertCooldown = time.Hour
+
+// holds reports whether the rate satisfies the alert condition
+func (a rateAlert) holds(rate float64) bool {
+	if a.Op == "<" {
+		return rate < a.Threshold
+	}
+	return rate > a.Threshold
+}
+
+// String describes the alert condition and options, e.g., "USD/GEL > 2.75, recurring every 1h0m0s"
+func (a rateAlert) String() string {
+	s := fmt.Sprintf("%s/%s %s %s", a.Currency, a.Counter, a.Op, trimFloat(a.Threshold))
+	if a.Recurring {
+		s += ", recurring, cooldown " + a.Cooldown.String()
+	} else {
+		s += ", once"
+	}
+	return s
+}
+
+// parseRateAlert parses alert arguments: <currency> <counter> <op> <threshold> [recurring] [cooldown <duration>]
+func parseRateAlert(args []string) (rateAlert, error) {
+	var a rateAlert
+	if len(args) < 4 {
+		return a, fmt.Errorf("not enough arguments")
+	}
+	var ok bool
+	if a.Currency, ok = normalizeCurrency(args[0]); !ok {
+		return a, fmt.Errorf("unknown currency %q", args[0])
+	}
+	if a.Counter, ok = normalizeCurrency(args[1]); !ok {
+		return a, fmt.Errorf("unknown currency %q", args[1])
+	}
+	if a.Currency == a.Counter {
+		return a, fmt.Errorf("currencies must differ")
+	}
+	if a.Op = args[2]; a.Op != ">" && a.Op != "<" {
+		return a, fmt.Errorf("condition must be > or <, not %q", args[2])
+	}
+	threshold, err := parseNum(args[3])
+	if err != nil || threshold <= 0 {
+		return a, fmt.Errorf("invalid threshold %q", args[3])
+	}
+	a.Threshold = threshold
+	cooldownSet := false
+	for i := 4; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "recurring":
+			a.Recurring = true
+		case "once":
+			a.Recurring = false
+		case "cooldown":
+			if i+1 >= len(args) {
+				return a, fmt.Errorf("cooldown needs a duration, e.g., 30m or 6h")
+			}
+			i++
+			if a.Cooldown, err = time.ParseDuration(args[i]); err != nil || a.Cooldown < 0 {
+				return a, fmt.Errorf("invalid cooldown %q, expected a duration like 30m or 6h", args[i])
+			}
+			a.Recurring, cooldownSet = true, true
+		default:
+			return a, fmt.Errorf("unexpected %q", args[i])
+		}
+	}
+	if a.Recurring && !cooldownSet {
+		a.Cooldown = defaultAlertCooldown
+	}
+	return a, nil
+}
+
+// pairRate returns the cached rate of currency in counter currency
+func (s *rateSnapshot) pairRate(currency, counter string) (float64, bool) {
+	rateCur, rateCounter := s.cachedRate(currency), s.cachedRate(counter)
+	if rateCur.value == 0 || rateCounter.value == 0 {
+		return 0, false
+	}
+	return rateCur.value / rateCounter.value, true
+}
+
+// evaluateAlerts notifies users whose alert conditions started to hold with the current rates.
+// An alert triggers when its condition turns true, recurring ones not more often than their cooldown;
+// a crossing held back by the cooldown triggers on the first evaluation after it if the condition still holds.
+// One-shot alerts are deleted once the notification is sent.
+// Must be called from the manager goroutine after rates change.
+func (c *tbcRateCache) evaluateAlerts() {
+	if c.db == nil || c.notify == nil {
+		return
+	}
+	alerts, err := getRateAlerts(c.db, 0)
+	if err != nil {
+		slog.Error("Error evaluating rate alerts", "err", err)
+		return
+	}
+	now := time.Now()
+	snap := c.current.Load()
+	for _, a := range alerts {
+		rate, ok := snap.pairRate(a.Currency, a.Counter)
+		if !ok {
+			continue
+		}
+		holds := a.holds(rate)
+		if holds == a.LastState {
+			continue
+		}
+		if holds && !a.LastTriggered.IsZero() && now.Sub(a.LastTriggered) < a.Cooldown {
+			// keep the last state, so the crossing isn't lost once the cooldown is over
+			continue
+		}
+		// the state is recorded before sending, so the alert isn't triggered again while being sent
+		triggeredAt := time.Time{}
+		if holds {
+			triggeredAt = now
+		}
+		if err := updateRateAlertState(c.db, a.ID, holds, triggeredAt); err != nil {
+			slog.Error("Error updating rate alert", "alert", a.ID, "err", err)
+			continue
+		}
+		if holds {
+			text := fmt.Sprintf("Rate alert #%d: %s/%s is %.4f (%s)", a.ID, a.Currency, a.Counter, rate, a)
+			c.alertSends.Add(1)
+			go c.sendAlert(a, text)
+		}
+	}
+}
+
+// sendAlert sends the notification of a triggered alert.
+// A one-shot alert is deleted once sent; if sending fails, the alert is reset to trigger again.
+func (c *tbcRateCache) sendAlert(a rateAlert, text string) {
+	defer c.alertSends.Done()
+	if err := c.notify(a.ChatID, text); err != nil {
+		slog.Error("Error sending rate alert", "alert", a.ID, "chat", a.ChatID, "err", err)
+		if err := resetRateAlertState(c.db, a.ID, a.LastTriggered); err != nil {
+			slog.Error("Error resetting rate alert", "alert", a.ID, "err", err)
+		}
+		return
+	}
+	if !a.Recurring {
+		if _, err := deleteRateAlert(c.db, a.ID, 0); err != nil {
+			slog.Error("Error deleting triggered rate alert", "alert", a.ID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRateAlert(t *testing.T) {
+	tests := []struct {
+		args string
+		want rateAlert
+		err  string
+	}{
+		{"usd gel > 2.75", rateAlert{Currency: CurUSD, Counter: CurGEL, Op: ">", Threshold: 2.75}, ""},
+		{"$ лари < 2,6 once", rateAlert{Currency: CurUSD, Counter: CurGEL, Op: "<", Threshold: 2.6}, ""},
+		{"usd gel > 2.75 recurring", rateAlert{Currency: CurUSD, Counter: CurGEL, Op: ">", Threshold: 2.75,
+			Recurring: true, Cooldown: defaultAlertCooldown}, ""},
+		// a cooldown makes the alert recurring
+		{"eur usd < 1.05 cooldown 30m", rateAlert{Currency: "EUR", Counter: CurUSD, Op: "<", Threshold: 1.05,
+			Recurring: true, Cooldown: 30 * time.Minute}, ""},
+		{"usd gel > 2.75 cooldown 6h once", rateAlert{Currency: CurUSD, Counter: CurGEL, Op: ">", Threshold: 2.75,
+			Cooldown: 6 * time.Hour}, ""},
+		{"usd gel > 2.75 RECURRING cooldown 0s", rateAlert{Currency: CurUSD, Counter: CurGEL, Op: ">", Threshold: 2.75,
+			Recurring: true}, ""},
+		{"usd gel >", rateAlert{}, "not enough arguments"},
+		{"xyz gel > 2.75", rateAlert{}, `unknown currency "xyz"`},
+		{"usd xyz > 2.75", rateAlert{}, `unknown currency "xyz"`},
+		{"usd $ > 2.75", rateAlert{}, "currencies must differ"},
+		{"usd gel >= 2.75", rateAlert{}, "condition must be > or <"},
+		{"usd gel > 0", rateAlert{}, "invalid threshold"},
+		{"usd gel > abc", rateAlert{}, "invalid threshold"},
+		{"usd gel > 2.75 cooldown", rateAlert{}, "cooldown needs a duration"},
+		{"usd gel > 2.75 cooldown 2d", rateAlert{}, `invalid cooldown "2d"`},
+		{"usd gel > 2.75 cooldown -1h", rateAlert{}, `invalid cooldown "-1h"`},
+		{"usd gel > 2.75 daily", rateAlert{}, `unexpected "daily"`},
+	}
+	for _, tt := range tests {
+		got, err := parseRateAlert(strings.Fields(tt.args))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseRateAlert(%s): err = %v, want %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseRateAlert(%s) = %+v, %v; want %+v", tt.args, got, err, tt.want)
+		}
+	}
+}
+
+func TestEvaluateAlerts(t *testing.T) {
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	t.Cleanup(func() { db.Close() })
+	var mu sync.Mutex
+	var sent []int64 // chats notified
+	failing := map[int64]bool{}
+	c := &tbcRateCache{db: db, notify: func(chatID int64, text string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing[chatID] {
+			return errors.New("chat is unavailable")
+		}
+		sent = append(sent, chatID)
+		return nil
+	}}
+	// evaluate sets the USD rate, evaluates the alerts and returns the chats notified
+	evaluate := func(usd float64) []int64 {
+		t.Helper()
+		c.current.Store(&rateSnapshot{base: CurGEL, rates: map[string]tbcRateCached{CurUSD: {value: usd}}})
+		c.evaluateAlerts()
+		c.alertSends.Wait()
+		mu.Lock()
+		defer mu.Unlock()
+		got := sent
+		sent = nil
+		return got
+	}
+	// each alert notifies its own chat, so the chat tells which alerts triggered
+	const (
+		onceChat      = 101
+		recurringChat = 102
+		failingChat   = 103
+	)
+	ids := map[int64]int64{}
+	for _, a := range []rateAlert{
+		{UserID: 1, ChatID: onceChat, Currency: CurUSD, Counter: CurGEL, Op: ">", Threshold: 2.75},
+		{UserID: 1, ChatID: recurringChat, Currency: CurUSD, Counter: CurGEL, Op: ">", Threshold: 2.75, Recurring: true, Cooldown: time.Hour},
+		{UserID: 2, ChatID: failingChat, Currency: CurUSD, Counter: CurGEL, Op: "<", Threshold: 2.6},
+	} {
+		id, err := saveRateAlert(db, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[a.ChatID] = id
+	}
+	alertIDs := func() []int64 {
+		t.Helper()
+		alerts, err := getRateAlerts(db, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int64
+		for _, a := range alerts {
+			got = append(got, a.ID)
+		}
+		return got
+	}
+
+	if got := evaluate(2.70); got != nil {
+		t.Errorf("notified %v while no condition holds", got)
+	}
+	if got := evaluate(2.80); !slices.Equal(slices.Sorted(slices.Values(got)), []int64{onceChat, recurringChat}) {
+		t.Errorf("crossing 2.75 notified %v, want %v", got, []int64{onceChat, recurringChat})
+	}
+	if got := alertIDs(); !slices.Equal(got, []int64{ids[recurringChat], ids[failingChat]}) {
+		t.Errorf("alerts after triggering = %v, want the one-shot alert deleted", got)
+	}
+	if got := evaluate(2.85); got != nil {
+		t.Errorf("notified %v while the condition keeps holding", got)
+	}
+
+	// crossing again within the cooldown is held back until the cooldown is over
+	evaluate(2.70)
+	if got := evaluate(2.80); got != nil {
+		t.Errorf("notified %v within the cooldown", got)
+	}
+	if got := evaluate(2.80); got != nil {
+		t.Errorf("notified %v within the cooldown", got)
+	}
+	if _, err := db.Exec("UPDATE rate_alerts SET last_triggered_at = ? WHERE id = ?",
+		time.Now().Add(-2*time.Hour).UTC(), ids[recurringChat]); err != nil {
+		t.Fatal(err)
+	}
+	if got := evaluate(2.80); !slices.Equal(got, []int64{recurringChat}) {
+		t.Errorf("after the cooldown notified %v, want %v", got, []int64{recurringChat})
+	}
+
+	// a one-shot alert that couldn't be sent is kept and triggers again
+	failing[failingChat] = true
+	if got := evaluate(2.50); got != nil {
+		t.Errorf("notified %v, want no successful notifications", got)
+	}
+	if got := alertIDs(); !slices.Contains(got, ids[failingChat]) {
+		t.Errorf("alerts after a failed notification = %v, want %d kept", got, ids[failingChat])
+	}
+	failing[failingChat] = false
+	if got := evaluate(2.50); !slices.Equal(got, []int64{failingChat}) {
+		t.Errorf("notified %v, want the failed alert %v", got, []int64{failingChat})
+	}
+	if got := alertIDs(); !slices.Equal(got, []int64{ids[recurringChat]}) {
+		t.Errorf("alerts after sending = %v, want %v", got, []int64{ids[recurringChat]})
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Requests per minute allowed with a new API key unless given otherwise
+	defaultAPIRateLimit = 60
+	// Offers returned by the API unless a limit is given, and the most it returns
+	defaultAPIOffersLimit = 50
+	maxAPIOffersLimit     = 200
+)
+
+var metricAPIRequests = newCounterVec("exchangebot_api_requests_total", "HTTP API requests, by endpoint and status.", "endpoint", "status")
+
+// newAPIKey generates a random API key; only its hash is stored
+func newAPIKey() (key, hash string, err error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key = "xb_" + hex.EncodeToString(b)
+	return key, hashAPIKey(key), nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// apiError is an error shown to API clients with the HTTP status
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...any) error {
+	return &apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// apiRateLimiter limits requests per API key with a token bucket refilled at the rate limit of the key
+type apiRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[int64]*apiBucket
+}
+
+type apiBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow takes a token of the key; if there is none, returns false and when the next one is available
+func (l *apiRateLimiter) allow(key apiKey, now time.Time) (bool, time.Duration) {
+	perMinute := float64(max(key.RateLimit, 1))
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key.ID]
+	if !ok {
+		b = &apiBucket{tokens: perMinute, last: now}
+		l.buckets[key.ID] = b
+	}
+	b.tokens = min(perMinute, b.tokens+now.Sub(b.last).Minutes()*perMinute)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perMinute * float64(time.Minute))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// apiServer serves the read-only JSON API for partners
+type apiServer struct {
+	db          *sql.DB
+	rates       *tbcRateCache
+	corsOrigins []string // origins allowed to call the API from browsers, * for any
+	limiter     apiRateLimiter
+}
+
+func newAPIServer(db *sql.DB, rates *tbcRateCache, corsOrigins []string) *apiServer {
+	return &apiServer{db: db, rates: rates, corsOrigins: corsOrigins, limiter: apiRateLimiter{buckets: make(map[int64]*apiBucket)}}
+}
+
+// handler returns the HTTP handler of the API
+func (s *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	s.route(mux, "GET /api/v1/offers", "offers", s.handleOffers)
+	s.route(mux, "GET /api/v1/rates", "rates", s.handleRates)
+	s.route(mux, "GET /api/v1/users/{id}/reputation", "reputation", s.handleReputation)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.allowOrigin(w, r) && r.Method == http.MethodOptions {
+			// preflight of a request with the key header
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, X-API-Key")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowOrigin sets CORS headers if the request comes from an allowed origin
+func (s *apiServer) allowOrigin(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+	switch {
+	case slices.Contains(s.corsOrigins, "*"):
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case slices.Contains(s.corsOrigins, origin):
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	default:
+		return false
+	}
+	return true
+}
+
+// route registers the endpoint, which requires an API key within its rate limit and responds with JSON
+func (s *apiServer) route(mux *http.ServeMux, pattern, endpoint string, handle func(r *http.Request, key apiKey) (any, error)) {
+	mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		var result any
+		key, err := s.authorize(w, r)
+		if err == nil {
+			result, err = handle(r, key)
+		}
+		status := http.StatusOK
+		if err != nil {
+			var apiErr *apiError
+			if !errors.As(err, &apiErr) {
+				slog.Error("API request failed", "endpoint", endpoint, "err", err)
+				apiErr = &apiError{http.StatusInternalServerError, "internal error"}
+			}
+			status, result = apiErr.status, map[string]string{"error": apiErr.message}
+		}
+		metricAPIRequests.inc(endpoint, strconv.Itoa(status))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			slog.Debug("Error writing API response", "endpoint", endpoint, "err", err)
+		}
+	})
+}
+
+// authorize finds the key of the request, given as a bearer token or in X-API-Key, and takes a request of its rate limit
+func (s *apiServer) authorize(w http.ResponseWriter, r *http.Request) (apiKey, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.Header.Get("X-API-Key")
+	}
+	if token == "" {
+		return apiKey{}, &apiError{http.StatusUnauthorized, "missing API key"}
+	}
+	key, found, err := findAPIKey(s.db, hashAPIKey(strings.TrimSpace(token)))
+	if err != nil {
+		return key, err
+	}
+	if !found {
+		return key, &apiError{http.StatusUnauthorized, "invalid API key"}
+	}
+	if ok, retryAfter := s.limiter.allow(key, time.Now()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return key, &apiError{http.StatusTooManyRequests, fmt.Sprintf("rate limit of %d requests per minute exceeded", key.RateLimit)}
+	}
+	return key, nil
+}
+
+// apiMoney is an amount in a currency; the amount is a decimal string to keep it exact
+type apiMoney struct {
+	Currency string `json:"currency"`
+	Amount   string `json:"amount,omitempty"`
+}
+
+type apiOffer struct {
+	UserID     int      `json:"user_id"`
+	Username   string   `json:"username"`
+	Reputation int64    `json:"reputation"`
+	Have       apiMoney `json:"have"`
+	Want       apiMoney `json:"want"`
+	Methods    []string `json:"methods,omitempty"`
+	Location   string   `json:"location,omitempty"`
+	PostedAt   string   `json:"posted_at"`
+}
+
+func newAPIMoney(amount Amount, code string) apiMoney {
+	m := apiMoney{Currency: code}
+	if amount != 0 {
+		m.Amount = formatAmount(amount, code)
+	}
+	return m
+}
+
+// handleOffers lists offers open in the chat of the key, optionally filtered by the currencies
+// and by the range of the amount offered: ?have=USD&want=GEL&min_amount=100&max_amount=500&limit=50
+func (s *apiServer) handleOffers(r *http.Request, key apiKey) (any, error) {
+	query := r.URL.Query()
+	var conds []string
+	var args []any
+	currencies := map[string]string{}
+	for _, param := range []string{"have", "want"} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		code, ok := normalizeCurrency(value)
+		if !ok {
+			return nil, badRequest("unknown currency %q in %s", value, param)
+		}
+		currencies[param] = code
+		conds = append(conds, "o."+param+"_currency = ?")
+		args = append(args, code)
+	}
+	for param, op := range map[string]string{"min_amount": ">=", "max_amount": "<="} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		code, ok := currencies["have"]
+		if !ok {
+			return nil, badRequest("%s requires have, the currency of the amount", param)
+		}
+		decimal, err := parseDecimal(value)
+		if err != nil {
+			return nil, badRequest("invalid %s: %v", param, err)
+		}
+		amount, err := amountFromDecimal(decimal, code)
+		if err != nil {
+			return nil, badRequest("invalid %s: %v", param, err)
+		}
+		conds = append(conds, "o.have_amount_minor "+op+" ?")
+		args = append(args, amount)
+	}
+	limit := defaultAPIOffersLimit
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxAPIOffersLimit {
+			return nil, badRequest("limit must be 1-%d", maxAPIOffersLimit)
+		}
+		limit = n
+	}
+
+	offers, err := getFilteredOffers(s.db, key.ChatID, limit, strings.Join(conds, " AND "), args...)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]apiOffer, 0, len(offers))
+	for _, o := range offers {
+		result = append(result, apiOffer{
+			UserID:     o.UserID,
+			Username:   o.Username,
+			Reputation: o.Reputation,
+			Have:       newAPIMoney(o.HaveAmount, o.HaveCurrency),
+			Want:       newAPIMoney(o.WantAmount, o.WantCurrency),
+			Methods:    o.Methods,
+			Location:   o.Location,
+			PostedAt:   o.PostedAt,
+		})
+	}
+	return map[string]any{"offers": result}, nil
+}
+
+type apiRate struct {
+	Rate      float64   `json:"rate"` // in the base currency per unit
+	Source    string    `json:"source"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Stale     bool      `json:"stale"` // older than rateStaleThreshold
+}
+
+type apiCommercialRate struct {
+	Buy       float64   `json:"buy"`  // the bank buys the currency at
+	Sell      float64   `json:"sell"` // the bank sells the currency at
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// handleRates returns the cached rates of all currencies
+func (s *apiServer) handleRates(r *http.Request, key apiKey) (any, error) {
+	if s.rates == nil {
+		return nil, &apiError{http.StatusServiceUnavailable, "rates are not available"}
+	}
+	base, updatedAt, snapshot := s.rates.snapshot()
+	now := time.Now()
+	rates := make(map[string]apiRate, len(snapshot))
+	for code, rate := range snapshot {
+		rates[code] = apiRate{Rate: rate.value, Source: rate.Source, UpdatedAt: rate.LastUpdated, Stale: now.Sub(rate.LastUpdated) > rateStaleThreshold}
+	}
+	commercial := make(map[string]apiCommercialRate)
+	for code, rate := range s.rates.commercialSnapshot() {
+		commercial[code] = apiCommercialRate{Buy: rate.Buy, Sell: rate.Sell, UpdatedAt: rate.LastUpdated}
+	}
+	return map[string]any{"base": base, "updated_at": updatedAt, "rates": rates, "commercial": commercial}, nil
+}
+
+// handleReputation returns the reputation of the user
+func (s *apiServer) handleReputation(r *http.Request, key apiKey) (any, error) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return nil, badRequest("invalid user ID %q", r.PathValue("id"))
+	}
+	reputation, err := getUserReputation(s.db, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &apiError{http.StatusNotFound, "unknown user"}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{"user_id": userID, "reputation": reputation}, nil
+}
+
+// startAPIServer serves the API on the address until stop is called
+func startAPIServer(addr string, corsOrigins []string, db *sql.DB, rates *tbcRateCache) (stop func(), err error) {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           newAPIServer(db, rates, corsOrigins).handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error starting API listener: %w", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("API listener failed", "err", err)
+		}
+	}()
+	slog.Info("Serving API", "url", fmt.Sprintf("http://%s/api/v1/", ln.Addr()))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("Error stopping API listener", "err", err)
+		}
+		<-served
+	}, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Longest period /chart accepts, in days
+const maxChartDays = 365
+
+// rateSeries holds daily rates of a currency in GEL per unit, NaN for days without data
+type rateSeries struct {
+	Code     string
+	Dates    []string // YYYY-MM-DD, oldest first
+	Official []float64
+	P2P      []float64 // median rate implied by offers posted that day
+}
+
+// buildRateSeries collects official rates from the stored history and P2P rates from offers visible in the chat
+// for the last days, today included.
+// Offers in other currencies are converted to GEL by the official rate of their day.
+func buildRateSeries(db *sql.DB, chatID int64, code string, days int) (rateSeries, error) {
+	s := rateSeries{Code: code}
+	today := time.Now()
+	for i := days - 1; i >= 0; i-- {
+		s.Dates = append(s.Dates, today.AddDate(0, 0, -i).Format(time.DateOnly))
+	}
+	since := s.Dates[0]
+
+	officialByCode := map[string]map[string]float64{}
+	official := func(cur string) (map[string]float64, error) {
+		if r, ok := officialByCode[cur]; ok {
+			return r, nil
+		}
+		r, err := getDailyRates(db, cur, since, officialRateSources)
+		officialByCode[cur] = r
+		return r, err
+	}
+	rates, err := official(code)
+	if err != nil {
+		return s, err
+	}
+
+	exchanges, err := getOfferExchanges(db, chatID, code, since)
+	if err != nil {
+		return s, err
+	}
+	implied := map[string][]float64{}
+	for _, e := range exchanges {
+		counterRate := 1.0
+		if e.Counter != CurGEL {
+			counterRates, err := official(e.Counter)
+			if err != nil {
+				return s, err
+			}
+			if counterRate = counterRates[e.Date]; counterRate == 0 {
+				continue
+			}
+		}
+		implied[e.Date] = append(implied[e.Date], e.CounterAmount/e.Amount*counterRate)
+	}
+
+	for _, date := range s.Dates {
+		if v, ok := rates[date]; ok {
+			s.Official = append(s.Official, v)
+		} else {
+			s.Official = append(s.Official, math.NaN())
+		}
+		s.P2P = append(s.P2P, median(implied[date]))
+	}
+	return s, nil
+}
+
+// median returns the median of the values, NaN if there are none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// seriesRange returns the minimum and the maximum of the values of all series ignoring NaN;
+// ok is false if there are no values at all
+func seriesRange(series ...[]float64) (lo, hi float64, ok bool) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for _, values := range series {
+		for _, v := range values {
+			if math.IsNaN(v) {
+				continue
+			}
+			lo, hi = min(lo, v), max(hi, v)
+			ok = true
+		}
+	}
+	return lo, hi, ok
+}
+
+// lastValue returns the latest value of the series ignoring NaN
+func lastValue(values []float64) (float64, bool) {
+	for i := len(values) - 1; i >= 0; i-- {
+		if !math.IsNaN(values[i]) {
+			return values[i], true
+		}
+	}
+	return 0, false
+}
+
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline renders values scaled to [lo, hi] as block characters; NaN is rendered as a space
+func sparkline(values []float64, lo, hi float64) string {
+	var sb strings.Builder
+	for _, v := range values {
+		if math.IsNaN(v) {
+			sb.WriteRune(' ')
+			continue
+		}
+		idx := 0
+		if hi > lo {
+			idx = int((v - lo) / (hi - lo) * float64(len(sparkBlocks)-1))
+		}
+		sb.WriteRune(sparkBlocks[max(0, min(idx, len(sparkBlocks)-1))])
+	}
+	return sb.String()
+}
+
+// formatRateSeries describes the series as text with sparklines on a common scale
+func formatRateSeries(s rateSeries) string {
+	lo, hi, ok := seriesRange(s.Official, s.P2P)
+	if !ok {
+		return fmt.Sprintf("No %s rate history for the last %d days", s.Code, len(s.Dates))
+	}
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%s in GEL, %s to %s, scale %.4f to %.4f\n", s.Code, s.Dates[0], s.Dates[len(s.Dates)-1], lo, hi))
+	for _, line := range []struct {
+		name   string
+		values []float64
+	}{{"NBG", s.Official}, {"P2P", s.P2P}} {
+		sb.WriteString(line.name + ": ")
+		if last, ok := lastValue(line.values); ok {
+			sb.WriteString(sparkline(line.values, lo, hi) + fmt.Sprintf(" last %.4f\n", last))
+		} else {
+			sb.WriteString("no data\n")
+		}
+	}
+	return sb.String()
+}
+
+// Colors of the PNG chart; the legend is in the caption as the stdlib has no fonts
+var (
+	chartBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	chartGrid       = color.RGBA{0xdd, 0xdd, 0xdd, 0xff}
+	chartOfficial   = color.RGBA{0x1f, 0x77, 0xb4, 0xff} // blue
+	chartP2P        = color.RGBA{0xd6, 0x27, 0x28, 0xff} // red
+)
+
+// renderRateChart draws the series as a PNG line chart with horizontal grid lines
+// at every tenth of the range and vertical ones at every week
+func renderRateChart(s rateSeries) ([]byte, error) {
+	lo, hi, ok := seriesRange(s.Official, s.P2P)
+	if !ok {
+		return nil, fmt.Errorf("no %s rate history for the last %d days", s.Code, len(s.Dates))
+	}
+	if hi == lo {
+		lo, hi = lo*0.99, hi*1.01
+	}
+	const width, height, margin = 800, 400, 20
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			img.Set(x, y, chartBackground)
+		}
+	}
+
+	plotW, plotH := width-2*margin, height-2*margin
+	xOf := func(i int) int {
+		if len(s.Dates) == 1 {
+			return margin + plotW/2
+		}
+		return margin + i*plotW/(len(s.Dates)-1)
+	}
+	yOf := func(v float64) int {
+		return margin + int((hi-v)/(hi-lo)*float64(plotH))
+	}
+	for k := 0; k <= 10; k++ {
+		drawLine(img, margin, margin+k*plotH/10, width-margin, margin+k*plotH/10, chartGrid)
+	}
+	for i := len(s.Dates) - 1; i >= 0; i -= 7 {
+		drawLine(img, xOf(i), margin, xOf(i), height-margin, chartGrid)
+	}
+
+	for _, line := range []struct {
+		values []float64
+		c      color.Color
+	}{{s.Official, chartOfficial}, {s.P2P, chartP2P}} {
+		prev := -1
+		for i, v := range line.values {
+			if math.IsNaN(v) {
+				continue
+			}
+			// connect across missing days, the rate didn't necessarily change
+			if prev >= 0 {
+				drawLine(img, xOf(prev), yOf(line.values[prev]), xOf(i), yOf(v), line.c)
+			}
+			drawDot(img, xOf(i), yOf(v), line.c)
+			prev = i
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawLine draws a line using Bresenham's algorithm
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	e := dx + dy
+	for {
+		img.Set(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y0 += sy
+		}
+	}
+}
+
+// drawDot draws a 3x3 square marking a data point
+func drawDot(img *image.RGBA, x, y int, c color.Color) {
+	for dy := -1; dy <= 1; dy++ {
+		for dx := -1; dx <= 1; dx++ {
+			img.Set(x+dx, y+dy, c)
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
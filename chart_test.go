@@ -0,0 +1,133 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		values []float64
+		want   float64
+	}{
+		{[]float64{2.7}, 2.7},
+		{[]float64{2.9, 2.7, 2.8}, 2.8},
+		{[]float64{2.9, 2.7, 2.8, 2.6}, 2.75},
+		{[]float64{3, 3}, 3},
+	}
+	for _, tt := range tests {
+		if got := median(tt.values); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("median(%v) = %v, want %v", tt.values, got, tt.want)
+		}
+	}
+	if got := median(nil); !math.IsNaN(got) {
+		t.Errorf("median of nothing = %v, want NaN", got)
+	}
+	values := []float64{3, 1, 2}
+	median(values)
+	if values[0] != 3 || values[1] != 1 {
+		t.Errorf("median sorted its argument: %v", values)
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		values []float64
+		lo, hi float64
+		want   string
+	}{
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8}, 1, 8, "▁▂▃▄▅▆▇█"},
+		{[]float64{1, nan, 8}, 1, 8, "▁ █"},
+		{[]float64{2.7, 2.7}, 2.7, 2.7, "▁▁"}, // a flat series
+		{[]float64{0, 10}, 1, 8, "▁█"},        // values out of the scale are clamped
+		{nil, 1, 8, ""},
+	}
+	for _, tt := range tests {
+		if got := sparkline(tt.values, tt.lo, tt.hi); got != tt.want {
+			t.Errorf("sparkline(%v, %v, %v) = %q, want %q", tt.values, tt.lo, tt.hi, got, tt.want)
+		}
+	}
+}
+
+func TestBuildRateSeries(t *testing.T) {
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	t.Cleanup(func() { db.Close() })
+	now := time.Now()
+	today := now.Format(time.DateOnly)
+	yesterday := now.AddDate(0, 0, -1).Format(time.DateOnly)
+	for date, rates := range map[string]map[string]float64{
+		yesterday: {CurUSD: 2.70, "EUR": 3.00},
+		today:     {CurUSD: 2.72, "EUR": 3.10},
+	} {
+		if err := saveRatesOnDate(db, date, rateSourceNBG, rates); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rates of other sources, e.g., commercial ones, aren't official
+	if err := saveRatesOnDate(db, today, ProviderTBCCommercial, map[string]float64{CurUSD: 2.9}); err != nil {
+		t.Fatal(err)
+	}
+
+	// offers are dated by the local day they were posted on, as rates are;
+	// the first minutes of the day are the previous day in UTC east of Greenwich
+	y, m, d := now.Date()
+	startOfToday := time.Date(y, m, d, 0, 30, 0, 0, time.Local)
+	offers := []struct {
+		have, want       Amount
+		haveCur, wantCur string
+		posted           time.Time
+	}{
+		{10000, 27500, CurUSD, CurGEL, startOfToday},
+		{10000, 27700, CurUSD, CurGEL, startOfToday.Add(time.Hour)},
+		{27000, 10000, CurGEL, CurUSD, startOfToday.AddDate(0, 0, -1)},
+		// 100 EUR for 110 USD is 2.7273 GEL per USD by the official EUR rate of yesterday
+		{11000, 10000, CurUSD, "EUR", startOfToday.AddDate(0, 0, -1)},
+		{10000, 27000, CurUSD, CurGEL, startOfToday.AddDate(0, 0, -5)}, // before the period
+		{10000, 0, CurUSD, CurGEL, startOfToday},                       // no counter amount, no rate
+	}
+	for i, o := range offers {
+		replyID, err := saveReplyMessageID(db, MessageIndex{ChannelID: testChatID, MessageID: i + 1}, 100+i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := saveOffer(db, NewOffer{UserID: i + 1, Username: "seller", HaveAmount: o.have, HaveCurrency: o.haveCur,
+			WantAmount: o.want, WantCurrency: o.wantCur, ChannelID: testChatID, MessageID: i + 1, ReplyID: replyID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("UPDATE offers SET posted_at = ? WHERE id = ?", o.posted.UTC().Format(time.DateTime), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := buildRateSeries(db, testChatID, CurUSD, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Dates) != 3 || s.Dates[1] != yesterday || s.Dates[2] != today {
+		t.Fatalf("dates = %v, want the last 3 days to %s", s.Dates, today)
+	}
+	want := []struct {
+		official, p2p float64
+	}{
+		{math.NaN(), math.NaN()},
+		{2.70, (2.70 + 3.00/1.1) / 2},
+		{2.72, 2.76},
+	}
+	for i, w := range want {
+		if !sameValue(s.Official[i], w.official) || !sameValue(s.P2P[i], w.p2p) {
+			t.Errorf("%s: official %v, P2P %v; want %v, %v", s.Dates[i], s.Official[i], s.P2P[i], w.official, w.p2p)
+		}
+	}
+}
+
+// sameValue compares rates, NaN being equal to NaN
+func sameValue(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) < 1e-9
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Prefix of environment variables overriding paths, secrets and settings
+const envPrefix = "EXCHANGEBOT_"
+
+// configPaths holds file locations given with flags or environment variables; empty ones use the defaults
+var configPaths struct {
+	Secrets, Settings, Places, Currencies, DB string
+}
+
+// cliOptions are the parsed command line
+type cliOptions struct {
+	checkConfig bool
+	init        bool
+	settings    map[string]string // settings given with flags, by settingField key
+}
+
+// settingField is a setting which can be overridden with a flag or an environment variable
+type settingField struct {
+	key   string // JSON key in the settings file, nested ones joined with a dot, e.g., webhook.url
+	index []int  // of the field in Settings
+}
+
+// flagName returns the flag of the setting, e.g., webhook-listen-addr
+func (f settingField) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(f.key)
+}
+
+// envName returns the environment variable of the setting, e.g., EXCHANGEBOT_WEBHOOK_LISTEN_ADDR
+func (f settingField) envName() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(f.key, ".", "_"))
+}
+
+// settingFields lists every setting of the settings file
+func settingFields() []settingField {
+	var fields []settingField
+	var walk func(t reflect.Type, prefix string, index []int)
+	walk = func(t reflect.Type, prefix string, index []int) {
+		for i := range t.NumField() {
+			f := t.Field(i)
+			key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if key == "" || key == "-" {
+				continue
+			}
+			fieldIndex := append(index[:len(index):len(index)], i)
+			if f.Type.Kind() == reflect.Struct {
+				walk(f.Type, prefix+key+".", fieldIndex)
+				continue
+			}
+			fields = append(fields, settingField{key: prefix + key, index: fieldIndex})
+		}
+	}
+	walk(reflect.TypeOf(Settings{}), "", nil)
+	return fields
+}
+
+// setSettingValue parses the text into the setting; lists are comma-separated
+func setSettingValue(v reflect.Value, text string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(text)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(text), 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		list := reflect.MakeSlice(v.Type(), 0, 0)
+		for _, part := range strings.Split(text, ",") {
+			if part = strings.TrimSpace(part); part == "" {
+				continue
+			}
+			item := reflect.New(v.Type().Elem()).Elem()
+			if err := setSettingValue(item, part); err != nil {
+				return err
+			}
+			list = reflect.Append(list, item)
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// applySettingOverrides sets settings from environment variables and then from flags, so flags take precedence
+func applySettingOverrides(settings *Settings, flags map[string]string, getenv func(string) string) error {
+	target := reflect.ValueOf(settings).Elem()
+	for _, f := range settingFields() {
+		for _, source := range []struct{ name, value string }{{f.envName(), getenv(f.envName())}, {"--" + f.flagName(), flags[f.key]}} {
+			if source.value == "" {
+				continue
+			}
+			if err := setSettingValue(target.FieldByIndex(f.index), source.value); err != nil {
+				return fmt.Errorf("invalid %s %q: %v", source.name, source.value, err)
+			}
+		}
+	}
+	return nil
+}
+
+// applySecretOverrides sets secrets from environment variables; secrets have no flags
+// since command lines are visible to other users of the system
+func applySecretOverrides(secrets *Secrets, getenv func(string) string) {
+	for env, field := range map[string]*string{
+		envPrefix + "TELEGRAM_BOT_TOKEN":      &secrets.TelegramBotToken,
+		envPrefix + "TBC_API_KEY":             &secrets.TBCApiKey,
+		envPrefix + "TELEGRAM_WEBHOOK_SECRET": &secrets.TelegramWebhookSecret,
+	} {
+		if v := getenv(env); v != "" {
+			*field = v
+		}
+	}
+}
+
+// parseCommandLine parses flags, storing paths in configPaths; paths not given with flags
+// are taken from the environment
+func parseCommandLine(args []string) (*cliOptions, error) {
+	opts := &cliOptions{settings: make(map[string]string)}
+	fs := flag.NewFlagSet(botName, flag.ContinueOnError)
+	fs.BoolVar(&opts.checkConfig, "check-config", false, "validate the configuration and the database, then exit")
+	fs.BoolVar(&opts.init, "init", false, "interactively create the secrets and settings files, then exit")
+	paths := []struct {
+		name, usage string
+		value       *string
+	}{
+		{"secrets", "secrets file", &configPaths.Secrets},
+		{"settings", "settings file", &configPaths.Settings},
+		{"places", "places file, default places.json next to the settings file", &configPaths.Places},
+		{"currencies", "currencies file, default currencies.json next to the settings file", &configPaths.Currencies},
+		{"db", "SQLite database", &configPaths.DB},
+	}
+	for _, p := range paths {
+		env := envPrefix + strings.ToUpper(p.name)
+		fs.StringVar(p.value, p.name, "", fmt.Sprintf("path of the %s, also %s", p.usage, env))
+	}
+	for _, f := range settingFields() {
+		key := f.key
+		fs.Func(f.flagName(), fmt.Sprintf("setting %s, also %s", key, f.envName()), func(value string) error {
+			opts.settings[key] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	for _, p := range paths {
+		if *p.value == "" {
+			*p.value = os.Getenv(envPrefix + strings.ToUpper(p.name))
+		}
+	}
+	return opts, nil
+}
+
+// checkConfig validates the configuration and the database without changing them,
+// printing the outcome of every check; returns the exit code
+func checkConfig(out io.Writer, opts *cliOptions) int {
+	failed := false
+	check := func(what string, err error) {
+		if err != nil {
+			failed = true
+			fmt.Fprintf(out, "FAILED %s: %v\n", what, err)
+		} else {
+			fmt.Fprintf(out, "OK     %s\n", what)
+		}
+	}
+	skip := func(what, reason string) {
+		fmt.Fprintf(out, "SKIP   %s: %s\n", what, reason)
+	}
+	for _, path := range []string{getDefaultSecretsPath(), getSettingsPath()} {
+		info, err := os.Stat(path)
+		switch {
+		case os.IsNotExist(err):
+			skip("file "+path, "not found, using environment variables and flags")
+		case err == nil && info.IsDir():
+			check("file "+path, errors.New("is a directory"))
+		default:
+			check("file "+path, err)
+		}
+	}
+	secrets, err := loadSecrets()
+	check("secrets", err)
+	settings, err := loadSettings(opts.settings)
+	check("settings", err)
+	if settings != nil {
+		check("logging", setupLogging(settings, newServiceDigest()))
+	} else {
+		skip("logging", "no valid settings")
+	}
+	check("places "+getPlacesPath(), loadPlaces(getPlacesPath()))
+	currenciesErr := loadCurrencyConfig(getCurrenciesPath(), nil)
+	check("currencies "+getCurrenciesPath(), currenciesErr)
+	if settings != nil && secrets != nil {
+		_, err = newRateProviders(settings, secrets, nil)
+		check("rate providers", err)
+	} else {
+		skip("rate providers", "no valid secrets and settings")
+	}
+	notes, err := checkDB(getDBPath())
+	check("database "+getDBPath(), err)
+	for _, note := range notes {
+		fmt.Fprintf(out, "       %s\n", note)
+	}
+	if err != nil || currenciesErr != nil {
+		skip("currencies of stored offers", "no valid database and currencies")
+	} else if checked, err := checkDBCurrencyScales(getDBPath(), currentCurrencies()); checked || err != nil {
+		check("currencies of stored offers", err)
+	} else {
+		skip("currencies of stored offers", "nothing stored yet")
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// verifyBotToken checks the token with getMe and returns the username of the bot
+func verifyBotToken(token string) (string, error) {
+	api, err := tgbotapi.NewBotAPI(token)
+	if err != nil {
+		return "", err
+	}
+	return api.Self.UserName, nil
+}
+
+// errInputEnded is returned by the wizard when the input ends before all questions are answered
+var errInputEnded = errors.New("input ended")
+
+// initWizard asks for the configuration on in and writes the secrets and settings files
+type initWizard struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints the question and returns the trimmed answer, def if it is empty
+func (w *initWizard) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(w.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(w.out, "%s: ", question)
+	}
+	line, err := w.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", errInputEnded
+	}
+	if line = strings.TrimSpace(line); line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// askUntil asks the question until parse accepts the answer
+func (w *initWizard) askUntil(question, def string, parse func(string) error) (string, error) {
+	for {
+		answer, err := w.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		if err := parse(answer); err != nil {
+			fmt.Fprintf(w.out, "  %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// confirmOverwrite asks whether to replace the file if it exists
+func (w *initWizard) confirmOverwrite(path string) (bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return true, nil
+	}
+	answer, err := w.ask(fmt.Sprintf("%s exists, overwrite? (y/n)", path), "n")
+	return strings.HasPrefix(strings.ToLower(answer), "y"), err
+}
+
+// runInitWizard interactively creates the secrets and settings files, verifying the bot token with verifyToken
+func runInitWizard(in io.Reader, out io.Writer, verifyToken func(token string) (string, error)) error {
+	w := &initWizard{in: bufio.NewReader(in), out: out}
+	secretsPath, settingsPath := getDefaultSecretsPath(), getSettingsPath()
+
+	writeSecrets, err := w.confirmOverwrite(secretsPath)
+	if err != nil {
+		return err
+	}
+	if writeSecrets {
+		secrets := map[string]string{}
+		_, err := w.askUntil("Telegram bot token, from @BotFather", "", func(token string) error {
+			if token == "" {
+				return errors.New("the token is required")
+			}
+			username, err := verifyToken(token)
+			if err != nil {
+				return fmt.Errorf("the token is not valid: %v", err)
+			}
+			fmt.Fprintf(out, "  The token belongs to @%s\n", username)
+			secrets["telegram_bot_token"] = token
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		apiKey, err := w.ask("TBC Bank API key, Enter to skip TBC rates", "")
+		if err != nil {
+			return err
+		}
+		if apiKey != "" {
+			secrets["tbcBankApiKey"] = apiKey
+		}
+		if err := writeConfigFile(secretsPath, secrets); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Secrets written to %s\n", secretsPath)
+	}
+
+	writeSettings, err := w.confirmOverwrite(settingsPath)
+	if err != nil || !writeSettings {
+		return err
+	}
+	settings := map[string]any{}
+	_, err = w.askUntil("Service channel ID, a negative number like -1001234567890", "", func(answer string) error {
+		id, err := strconv.ParseInt(answer, 10, 64)
+		if err != nil || id == 0 {
+			return errors.New("expected a chat ID number; forward a message from the channel to @userinfobot to get it")
+		}
+		settings["telegram_service_channel_id"] = id
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.askUntil("Bot admin user IDs, comma-separated, Enter to skip", "", func(answer string) error {
+		var ids []int
+		if err := setSettingValue(reflect.ValueOf(&ids).Elem(), answer); err != nil {
+			return errors.New("expected user ID numbers separated with commas")
+		}
+		if len(ids) > 0 {
+			settings["admin_user_ids"] = ids
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	mode, err := w.askUntil("Update mode, "+UpdateModePolling+" or "+UpdateModeWebhook, UpdateModePolling, func(answer string) error {
+		if answer != UpdateModePolling && answer != UpdateModeWebhook {
+			return fmt.Errorf("expected %s or %s", UpdateModePolling, UpdateModeWebhook)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	settings["update_mode"] = mode
+	if mode == UpdateModeWebhook {
+		var ws WebhookSettings
+		if _, err = w.askUntil("Public HTTPS URL of the webhook", "", func(answer string) error {
+			ws = WebhookSettings{URL: answer}
+			return ws.validate()
+		}); err != nil {
+			return err
+		}
+		if ws.ListenAddr, err = w.ask("Address to listen on", ws.ListenAddr); err != nil {
+			return err
+		}
+		settings["webhook"] = map[string]string{"url": ws.URL, "listen_addr": ws.ListenAddr}
+	}
+	if err := writeConfigFile(settingsPath, settings); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Settings written to %s\nCheck them with --check-config\n", settingsPath)
+	return nil
+}
+
+// writeConfigFile writes the value as JSON readable only by the owner, as the file may hold secrets
+func writeConfigFile(path string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("error creating directory of %s: %w", path, err)
+	}
+	// the file is written in full with its permissions before replacing an existing one,
+	// which may be readable by others
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) // fails once renamed
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return nil
+}
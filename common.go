@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 	_ "github.com/mattn/go-sqlite3" // SQLite driver
@@ -16,11 +17,62 @@ import (
 type Secrets struct {
 	TelegramBotToken string `json:"telegram_bot_token"`
 	TBCApiKey        string `json:"tbcBankApiKey"`
+	// Secret token Telegram sends with webhook requests; generated on every start if empty
+	TelegramWebhookSecret string `json:"telegram_webhook_secret"`
 }
 
 // Settings holds the configuration settings for the bot
 type Settings struct {
 	TelegramServiceChannelID int64 `json:"telegram_service_channel_id"`
+	AdminUserIDs             []int `json:"admin_user_ids"` // Telegram users allowed to run admin commands
+	// Rate providers in the order of preference, see defaultRateProviders
+	RateProviders []string `json:"rate_providers"`
+	// JSON file for the static rate provider, relative to the settings directory
+	StaticRatesFile string `json:"static_rates_file"`
+	// Base URL of the TBC exchange rates API, e.g., to use a proxy or the fake-rates-server
+	TBCRatesBaseURL string `json:"tbc_rates_base_url"`
+	// NBG historical rates endpoint, the date is appended to it
+	NBGRatesURL string `json:"nbg_rates_url"`
+	// How updates are received: UpdateModePolling (default) or UpdateModeWebhook
+	UpdateMode string `json:"update_mode"`
+	// Webhook listener, used in the webhook update mode
+	Webhook WebhookSettings `json:"webhook"`
+	// Number of updates processed concurrently, default defaultUpdateWorkers; updates of a chat are processed in order
+	UpdateWorkers int `json:"update_workers"`
+	// Address of the Prometheus metrics listener, e.g., 127.0.0.1:9090; metrics are not served if empty
+	MetricsListenAddr string `json:"metrics_listen_addr"`
+	// Address of the HTTP API listener, e.g., 127.0.0.1:8081; the API is not served if empty
+	APIListenAddr string `json:"api_listen_addr"`
+	// Origins of web pages allowed to call the API, * for any
+	APICORSOrigins []string `json:"api_cors_origins"`
+	// Minimum level of console logs: debug, info (default), warn or error
+	LogLevel string `json:"log_level"`
+	// Console log format: text (default) or json
+	LogFormat string `json:"log_format"`
+	// How often warnings and errors are sent to the service channel, default defaultDigestInterval
+	ServiceDigestSeconds int `json:"service_digest_seconds"`
+}
+
+// Provider endpoints used unless configured otherwise
+const (
+	defaultTBCRatesBaseURL = "https://test-api.tbcbank.ge/v1/exchange-rates"
+	defaultNBGRatesURL     = "https://nbg.gov.ge/gw/api/ct/monetarypolicy/currencies/en/json/?date="
+)
+
+// tbcRatesBaseURL returns the configured TBC exchange rates API base URL without the trailing slash
+func (s *Settings) tbcRatesBaseURL() string {
+	if s.TBCRatesBaseURL == "" {
+		return defaultTBCRatesBaseURL
+	}
+	return strings.TrimSuffix(s.TBCRatesBaseURL, "/")
+}
+
+// nbgRatesURL returns the configured NBG historical rates endpoint
+func (s *Settings) nbgRatesURL() string {
+	if s.NBGRatesURL == "" {
+		return defaultNBGRatesURL
+	}
+	return s.NBGRatesURL
 }
 
 const (
@@ -62,6 +114,9 @@ func getLocalAppDataDir() string {
 func getDefaultSecretsPath() string {
 	var secretDataDir string
 
+	if configPaths.Secrets != "" {
+		return configPaths.Secrets
+	}
 	// Check environment variable
 	if envPath := os.Getenv("SECRETS_PATH"); envPath != "" {
 		return envPath
@@ -80,6 +135,10 @@ func getDefaultSecretsPath() string {
 func getSettingsPath() string {
 	var dataDir string
 
+	if configPaths.Settings != "" {
+		return configPaths.Settings
+	}
+
 	// Default paths based on OS
 	if runtime.GOOS == "windows" {
 		localAppData := os.Getenv("LOCALAPPDATA")
@@ -100,35 +159,99 @@ func getSettingsPath() string {
 	return filepath.Join(dataDir, "settings.json")
 }
 
-func loadSecrets() *Secrets {
+// getPlacesPath returns the path of the optional place dictionary, next to settings.json
+func getPlacesPath() string {
+	if configPaths.Places != "" {
+		return configPaths.Places
+	}
+	return filepath.Join(filepath.Dir(getSettingsPath()), "places.json")
+}
+
+// getCurrenciesPath returns the path of the optional currency registry, next to settings.json
+func getCurrenciesPath() string {
+	if configPaths.Currencies != "" {
+		return configPaths.Currencies
+	}
+	return filepath.Join(filepath.Dir(getSettingsPath()), "currencies.json")
+}
+
+// getStaticRatesPath returns the path of the static rates file, by default rates.json next to settings.json
+func getStaticRatesPath(settings *Settings) string {
+	name := settings.StaticRatesFile
+	if name == "" {
+		name = "rates.json"
+	}
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(getSettingsPath()), name)
+}
+
+// loadSecrets loads the secrets file, overridden by environment variables;
+// the file is optional if the environment has the required secrets
+func loadSecrets() (*Secrets, error) {
 	var secrets Secrets
 
-	if err := json.Unmarshal(loadFile(getDefaultSecretsPath(), "secrets"), &secrets); err != nil {
-		panic(fmt.Errorf("error parsing secrets file: %v", err))
+	path := getDefaultSecretsPath()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		rawdata, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading secrets file: %v", err)
+		}
+		if err := json.Unmarshal(rawdata, &secrets); err != nil {
+			return nil, fmt.Errorf("error parsing secrets file: %v", err)
+		}
 	}
+	applySecretOverrides(&secrets, os.Getenv)
 
 	if secrets.TelegramBotToken == "" {
-		panic(fmt.Errorf("missing required secrets"))
+		return nil, fmt.Errorf("missing required secrets: telegram_bot_token in %s or %sTELEGRAM_BOT_TOKEN", path, envPrefix)
 	}
 
-	return &secrets
+	return &secrets, nil
 }
 
-func loadSettings() *Settings {
+// loadSettings loads the settings file, overridden by environment variables and then by flags;
+// the file is optional if the required settings are given otherwise
+func loadSettings(flags map[string]string) (*Settings, error) {
 	var settings Settings
 
-	if err := json.Unmarshal(loadFile(getSettingsPath(), "settings"), &settings); err != nil {
-		panic(fmt.Errorf("error parsing settings file: %v", err))
+	path := getSettingsPath()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		rawdata, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading settings file: %v", err)
+		}
+		if err := json.Unmarshal(rawdata, &settings); err != nil {
+			return nil, fmt.Errorf("error parsing settings file: %v", err)
+		}
+	}
+	if err := applySettingOverrides(&settings, flags, os.Getenv); err != nil {
+		return nil, err
 	}
 
 	if settings.TelegramServiceChannelID == 0 {
-		panic(fmt.Errorf("missing required settings"))
+		return nil, fmt.Errorf("missing required settings: telegram_service_channel_id in %s, %sTELEGRAM_SERVICE_CHANNEL_ID or --telegram-service-channel-id", path, envPrefix)
+	}
+	switch settings.UpdateMode {
+	case "":
+		settings.UpdateMode = UpdateModePolling
+	case UpdateModePolling:
+	case UpdateModeWebhook:
+		if err := settings.Webhook.validate(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown update_mode %q, expected %s or %s", settings.UpdateMode, UpdateModePolling, UpdateModeWebhook)
 	}
 
-	return &settings
+	return &settings, nil
 }
 
 func getDBPath() string {
+	if configPaths.DB != "" {
+		return configPaths.DB
+	}
 	dataDir := filepath.Join(getLocalAppDataDir(), botName)
 
 	// Ensure directory exists
@@ -139,7 +262,7 @@ func getDBPath() string {
 	return filepath.Join(dataDir, dbFileName)
 }
 
-func sendToTelegram(bot *tgbotapi.BotAPI, channelID int64, message string) error {
+func sendToTelegram(bot telegramClient, channelID int64, message string) error {
 	// Use plain text mode
 	msg := tgbotapi.NewMessage(channelID, message)
 
@@ -152,7 +275,7 @@ func sendToTelegram(bot *tgbotapi.BotAPI, channelID int64, message string) error
 
 func printInstructions() {
 	fmt.Println("Missing required configuration.")
-	fmt.Println("\nPlease create the following configuration files:")
+	fmt.Printf("\nRun %s --init to create the configuration files interactively, or create them yourself:\n", filepath.Base(os.Args[0]))
 
 	// Secrets file
 	fmt.Println("\n1. Secrets file (for the bot token):")
@@ -160,7 +283,8 @@ func printInstructions() {
 	fmt.Println("   Format:")
 	fmt.Println(`   {
 		 "telegram_bot_token": "YOUR_TELEGRAM_BOT_TOKEN",
-		 "tbcBankApiKey": "YOUR_TBC_API_KEY"
+		 "tbcBankApiKey": "YOUR_TBC_API_KEY",
+		 "telegram_webhook_secret": "OPTIONAL, for the webhook mode"
 	 }`)
 	fmt.Println("   To obtain, create a Telegram bot by talking to @BotFather and get the token")
 
@@ -169,23 +293,50 @@ func printInstructions() {
 	fmt.Printf("   Path: %s\n", getSettingsPath())
 	fmt.Println("   Format:")
 	fmt.Println(`   {
-     "telegram_service_channel_id": YOUR_CHANNEL_ID_NUMBER
+     "telegram_service_channel_id": YOUR_CHANNEL_ID_NUMBER,
+     "admin_user_ids": [OPTIONAL_ADMIN_USER_ID, ...],
+     "rate_providers": ["manual", "tbc-nbg", "tbc-commercial", "static"],
+     "static_rates_file": "rates.json",
+     "tbc_rates_base_url": "OPTIONAL, default ` + defaultTBCRatesBaseURL + `",
+     "nbg_rates_url": "OPTIONAL, default ` + defaultNBGRatesURL + `",
+     "update_mode": "polling or webhook",
+     "update_workers": 8,
+     "metrics_listen_addr": "OPTIONAL, e.g., 127.0.0.1:9090 to serve Prometheus metrics at /metrics",
+     "api_listen_addr": "OPTIONAL, e.g., 127.0.0.1:8081 to serve the partner API at /api/v1/",
+     "api_cors_origins": ["https://partner.example.com"],
+     "log_level": "debug, info, warn or error",
+     "log_format": "text or json",
+     "service_digest_seconds": 60,
+     "webhook": {
+       "url": "https://example.com/tg/exchangebot",
+       "listen_addr": "OPTIONAL, default 127.0.0.1:8080",
+       "path": "OPTIONAL, default is the path of url",
+       "cert_file": "OPTIONAL, to serve HTTPS without a reverse proxy",
+       "key_file": "OPTIONAL",
+       "self_signed": false,
+       "max_connections": 40
+     }
    }`)
 	fmt.Println("   To get it, add your bot to the target channel as an administrator,")
 	fmt.Println("   and forward a message from the channel to @userinfobot.")
 	fmt.Println("   Use the 'Id' number from the 'Forwarded from chat' value (including the negative sign)")
-}
 
-func getConfig() (*Secrets, *Settings) {
-	defer func() {
-		if r := recover(); r != nil {
-			log.Printf("Initialization failed: %v", r)
-			printInstructions()
-			os.Exit(1)
-		}
-	}()
-	secrets := loadSecrets()
-	settings := loadSettings()
+	fmt.Println("\nEvery setting can also be given with an environment variable or a flag, which takes precedence,")
+	fmt.Printf("e.g., %sUPDATE_MODE=webhook or --update-mode=webhook; secrets with %sTELEGRAM_BOT_TOKEN etc.\n", envPrefix, envPrefix)
+	fmt.Println("Paths of the files are set with --secrets, --settings, --places, --currencies and --db; see --help.")
+}
 
+// getConfig loads secrets and settings; if they are missing or invalid, prints instructions and exits
+func getConfig(opts *cliOptions) (*Secrets, *Settings) {
+	secrets, err := loadSecrets()
+	var settings *Settings
+	if err == nil {
+		settings, err = loadSettings(opts.settings)
+	}
+	if err != nil {
+		log.Printf("Initialization failed: %v", err)
+		printInstructions()
+		os.Exit(1)
+	}
 	return secrets, settings
 }
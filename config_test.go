@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSettingOverrides(t *testing.T) {
+	settings := Settings{UpdateMode: UpdateModePolling, UpdateWorkers: 4, LogLevel: "info"}
+	env := map[string]string{
+		"EXCHANGEBOT_UPDATE_WORKERS":      "16",
+		"EXCHANGEBOT_LOG_LEVEL":           "debug",
+		"EXCHANGEBOT_WEBHOOK_LISTEN_ADDR": "127.0.0.1:9000",
+		"EXCHANGEBOT_ADMIN_USER_IDS":      "1, 2",
+	}
+	flags := map[string]string{"log_level": "warn", "webhook.url": "https://example.com/hook"}
+	if err := applySettingOverrides(&settings, flags, func(name string) string { return env[name] }); err != nil {
+		t.Fatal(err)
+	}
+	if settings.UpdateMode != UpdateModePolling || settings.UpdateWorkers != 16 || settings.LogLevel != "warn" {
+		t.Errorf("file < environment < flags precedence is not kept: %+v", settings)
+	}
+	if settings.Webhook.ListenAddr != "127.0.0.1:9000" || settings.Webhook.URL != "https://example.com/hook" {
+		t.Errorf("nested settings are not overridden: %+v", settings.Webhook)
+	}
+	if !slices.Equal(settings.AdminUserIDs, []int{1, 2}) {
+		t.Errorf("AdminUserIDs = %v", settings.AdminUserIDs)
+	}
+
+	err := applySettingOverrides(&settings, map[string]string{"update_workers": "many"}, func(string) string { return "" })
+	if err == nil || !strings.Contains(err.Error(), "--update-workers") {
+		t.Errorf("invalid flag value error = %v", err)
+	}
+}
+
+func TestInitWizard(t *testing.T) {
+	dir := t.TempDir()
+	configPaths.Secrets = filepath.Join(dir, "sec", "bot.json")
+	configPaths.Settings = filepath.Join(dir, "settings.json")
+	t.Cleanup(func() { configPaths.Secrets, configPaths.Settings = "", "" })
+
+	verify := func(token string) (string, error) {
+		if token != "123:good" {
+			return "", errors.New("Unauthorized")
+		}
+		return "test_bot", nil
+	}
+	answers := strings.Join([]string{"123:bad", "123:good", "", "channel", "-1001", "5,6", "hooks", UpdateModeWebhook,
+		"https://example.com/tg", ""}, "\n") + "\n"
+	var out strings.Builder
+	if err := runInitWizard(strings.NewReader(answers), &out, verify); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	if !strings.Contains(out.String(), "not valid: Unauthorized") || !strings.Contains(out.String(), "@test_bot") {
+		t.Errorf("token verification is not reported:\n%s", out.String())
+	}
+
+	for _, path := range []string{configPaths.Secrets, configPaths.Settings} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("%s permissions = %v, want 0600", path, info.Mode().Perm())
+		}
+	}
+	var secrets Secrets
+	data, _ := os.ReadFile(configPaths.Secrets)
+	if err := json.Unmarshal(data, &secrets); err != nil || secrets.TelegramBotToken != "123:good" || secrets.TBCApiKey != "" {
+		t.Errorf("secrets = %+v, %v", secrets, err)
+	}
+	settings, err := loadSettings(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.TelegramServiceChannelID != -1001 || !slices.Equal(settings.AdminUserIDs, []int{5, 6}) ||
+		settings.UpdateMode != UpdateModeWebhook || settings.Webhook.URL != "https://example.com/tg" {
+		t.Errorf("settings = %+v", settings)
+	}
+
+	// existing files are kept unless confirmed
+	if err := runInitWizard(strings.NewReader("n\nn\n"), &out, verify); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(configPaths.Secrets); string(after) != string(data) {
+		t.Errorf("secrets file is overwritten without confirmation")
+	}
+}
+
+func TestCheckDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.sqlite3")
+	if notes, err := checkDB(path); err != nil || len(notes) != 1 {
+		t.Errorf("checkDB of a missing database = %v, %v", notes, err)
+	}
+	initDB(path).Close()
+	if notes, err := checkDB(path); err != nil || len(notes) != 0 {
+		t.Errorf("checkDB of an initialized database = %v, %v", notes, err)
+	}
+}
+
+func TestCheckConfigReportsInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	configPaths.Secrets = filepath.Join(dir, "missing.json")
+	configPaths.Settings = filepath.Join(dir, "settings.json")
+	configPaths.DB = filepath.Join(dir, dbFileName)
+	t.Cleanup(func() { configPaths.Secrets, configPaths.Settings, configPaths.DB = "", "", "" })
+	t.Setenv(envPrefix+"TELEGRAM_BOT_TOKEN", "")
+	if err := os.WriteFile(configPaths.Settings, []byte(`{"telegram_service_channel_id": -1001,`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if code := checkConfig(&out, &cliOptions{}); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	for _, want := range []string{
+		"SKIP   file " + configPaths.Secrets + ": not found",
+		"OK     file " + configPaths.Settings,
+		"FAILED secrets: missing required secrets",
+		"FAILED settings: error parsing settings file",
+		"SKIP   rate providers",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestCheckConfigCurrenciesOfStoredOffers(t *testing.T) {
+	prev := currentCurrencies()
+	dir := t.TempDir()
+	configPaths.Secrets = filepath.Join(dir, "missing.json")
+	configPaths.Settings = filepath.Join(dir, "settings.json")
+	configPaths.DB = filepath.Join(dir, dbFileName)
+	configPaths.Currencies = filepath.Join(dir, "currencies.json")
+	t.Cleanup(func() {
+		configPaths.Secrets, configPaths.Settings, configPaths.DB, configPaths.Currencies = "", "", "", ""
+		currencies.Store(prev)
+	})
+	db := initDB(configPaths.DB)
+	replyID, err := saveReplyMessageID(db, MessageIndex{ChannelID: testChatID, MessageID: 1}, 2)
+	if err == nil {
+		_, err = saveOffer(db, NewOffer{UserID: 1, Username: "seller", HaveAmount: 10000, HaveCurrency: CurUSD,
+			WantAmount: 27000, WantCurrency: CurGEL, ChannelID: testChatID, MessageID: 1, ReplyID: replyID})
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	checkConfig(&out, &cliOptions{})
+	if want := "OK     currencies of stored offers"; !strings.Contains(out.String(), want) {
+		t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+	}
+
+	// the bot refuses to start with this file, so the check must fail as well
+	if err := os.WriteFile(configPaths.Currencies, []byte(`{"currencies": [{"code": "USD", "minor_units": 0}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if code := checkConfig(&out, &cliOptions{}); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	for _, want := range []string{
+		"OK     currencies " + configPaths.Currencies,
+		"FAILED currencies of stored offers: minor units of USD can't change from 2 to 0",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestWriteConfigFileReplacesReadableFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bot.json")
+	if err := os.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a link keeps the old file to check that the secret never got into it
+	old := filepath.Join(dir, "old.json")
+	if err := os.Link(path, old); err != nil {
+		t.Skipf("hard links are not supported: %v", err)
+	}
+	if err := writeConfigFile(path, Secrets{TelegramBotToken: "123:secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(old); string(data) != "{}\n" {
+		t.Errorf("the readable file was written: %q", data)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("permissions = %v, want 0600", info.Mode().Perm())
+	}
+	if data, _ := os.ReadFile(path); !strings.Contains(string(data), "123:secret") {
+		t.Errorf("written file = %q", data)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("files left in the directory: %v", entries)
+	}
+}
@@ -2,36 +2,37 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"database/sql"
 	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"regexp"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Normalized currency codes we're supporting now
+// Normalized codes of the currencies the bot refers to directly; the rest is in currencySpecs
 const (
-	CurRUR = "RUR"
+	CurRUB = "RUB"
 	CurUSD = "USD"
 	CurGEL = "GEL"
 )
 
 // Single source of truth: currency specifications
+// Offer amounts are stored in minor units, so MinorUnits of a currency with stored offers can't change, see checkCurrencyScales
 type currencySpec struct {
-	Code    string   // normalized code, e.g., RUR
-	Symbol  string   // display symbol, e.g., ₽
-	Aliases []string // lowercase aliases including symbols and words
-}
-
-var currencySpecs = []currencySpec{
-	{Code: CurRUR, Symbol: "₽", Aliases: []string{"р", "₽", "r", "rub", "rur"}},
-	{Code: CurUSD, Symbol: "$", Aliases: []string{"$", "usd", "долл"}},
-	{Code: CurGEL, Symbol: "₾", Aliases: []string{"л", "₾", "ლ", "лар", "лари", "gel"}},
+	Code           string   `json:"code"`                      // normalized ISO 4217 code, e.g., RUB
+	Symbol         string   `json:"symbol"`                    // display symbol, e.g., ₽
+	MinorUnits     int      `json:"minor_units"`               // digits after the decimal point, e.g., 2 for cents
+	Aliases        []string `json:"aliases"`                   // lowercase aliases including symbols and words
+	DefaultCounter string   `json:"default_counter,omitempty"` // other side currency when only this one is given
 }
 
 // Regexp rules mapping to representation index
@@ -40,15 +41,13 @@ type currencyRegexpRule struct {
 	index int
 }
 
-var currencyRegexpRules []currencyRegexpRule
-
 type regexSpec struct {
-	Pattern string
-	Code    string // normalized currency code
+	Pattern string `json:"pattern"`
+	Code    string `json:"code"` // normalized currency code
 }
 
 var rawRegexSpecs = []regexSpec{
-	{Pattern: `^р.*`, Code: CurRUR},
+	{Pattern: `^р.*`, Code: CurRUB},
 	{Pattern: `^л.*`, Code: CurGEL},
 	{Pattern: `^д.*`, Code: CurUSD},
 }
@@ -56,14 +55,27 @@ var rawRegexSpecs = []regexSpec{
 // Shared HTTP client for TBC API calls; per-request timeouts via context
 var tbcHTTPClient *http.Client
 
-// Derived at init
-var (
-	currencyCodes           []string
-	currencyRepresentations []string
-	currencyIndexByCode     map[string]int
+// currencyRegistry holds lookup tables derived from the currency specs.
+// It is immutable once built; reloading the config swaps the whole registry.
+type currencyRegistry struct {
+	codes           []string
+	representations []string
+	defaultCounters []string // by index, empty if not configured
+	minorUnits      []int
+	defaultEnabled  []string // currencies enabled in chats without their own choice
+	indexByCode     map[string]int
 	// Alias maps a lowercase alias to the index into currency arrays
-	currencyAliasToIndex map[string]int
-)
+	aliasToIndex map[string]int
+	regexpRules  []currencyRegexpRule
+	regexSpecs   []regexSpec
+}
+
+var currencies atomic.Pointer[currencyRegistry]
+
+// currentCurrencies returns the registry in effect
+func currentCurrencies() *currencyRegistry {
+	return currencies.Load()
+}
 
 func init() {
 	tbcHTTPClient = &http.Client{
@@ -79,57 +91,149 @@ func init() {
 			IdleConnTimeout:       5 * time.Minute,
 		},
 	}
-	initCurrencyMappings()
+	if err := initCurrencyMappings(currencySpecs, rawRegexSpecs, defaultEnabledCurrencies); err != nil {
+		log.Panicf("invalid built-in currencies: %v", err)
+	}
+}
+
+// initCurrencyMappings validates the specs and atomically replaces the registry in effect.
+// On error, the current registry is kept.
+func initCurrencyMappings(specs []currencySpec, regexSpecs []regexSpec, defaultEnabled []string) error {
+	reg, err := buildCurrencyRegistry(specs, regexSpecs, defaultEnabled)
+	if err != nil {
+		return err
+	}
+	currencies.Store(reg)
+	return nil
 }
 
-func initCurrencyMappings() {
-	// Build code arrays and maps
-	currencyCodes = make([]string, 0, len(currencySpecs))
-	currencyRepresentations = make([]string, 0, len(currencySpecs))
-	currencyIndexByCode = make(map[string]int, len(currencySpecs))
-	currencyAliasToIndex = make(map[string]int)
-	for i, s := range currencySpecs {
-		currencyCodes = append(currencyCodes, s.Code)
-		currencyRepresentations = append(currencyRepresentations, s.Symbol)
-		currencyIndexByCode[strings.ToUpper(s.Code)] = i
+// buildCurrencyRegistry builds code arrays and maps, checking for duplicate codes and alias collisions
+func buildCurrencyRegistry(specs []currencySpec, regexSpecs []regexSpec, defaultEnabled []string) (*currencyRegistry, error) {
+	if len(specs) == 0 {
+		return nil, errors.New("no currencies defined")
+	}
+	reg := &currencyRegistry{
+		codes:           make([]string, 0, len(specs)),
+		representations: make([]string, 0, len(specs)),
+		defaultCounters: make([]string, 0, len(specs)),
+		minorUnits:      make([]int, 0, len(specs)),
+		indexByCode:     make(map[string]int, len(specs)),
+		aliasToIndex:    make(map[string]int),
+		regexSpecs:      regexSpecs,
+	}
+	for i, s := range specs {
+		code := strings.ToUpper(strings.TrimSpace(s.Code))
+		if code == "" {
+			return nil, fmt.Errorf("currency #%d has no code", i+1)
+		}
+		if _, dup := reg.indexByCode[code]; dup {
+			return nil, fmt.Errorf("duplicate currency code %s", code)
+		}
+		symbol := s.Symbol
+		if symbol == "" {
+			symbol = code
+		}
+		reg.codes = append(reg.codes, code)
+		reg.representations = append(reg.representations, symbol)
+		reg.defaultCounters = append(reg.defaultCounters, strings.ToUpper(strings.TrimSpace(s.DefaultCounter)))
+		if s.MinorUnits < 0 || s.MinorUnits > 4 {
+			return nil, fmt.Errorf("invalid minor units %d for %s", s.MinorUnits, code)
+		}
+		reg.minorUnits = append(reg.minorUnits, s.MinorUnits)
+		reg.indexByCode[code] = i
 		for _, a := range s.Aliases {
-			currencyAliasToIndex[strings.ToLower(a)] = i
+			a = strings.ToLower(strings.TrimSpace(a))
+			if a == "" {
+				continue
+			}
+			if other, dup := reg.aliasToIndex[a]; dup && other != i {
+				return nil, fmt.Errorf("alias %q is used by both %s and %s", a, reg.codes[other], code)
+			}
+			reg.aliasToIndex[a] = i
+		}
+	}
+	// Aliases must not shadow codes of other currencies
+	for alias, idx := range reg.aliasToIndex {
+		if other, ok := reg.indexByCode[strings.ToUpper(alias)]; ok && other != idx {
+			return nil, fmt.Errorf("alias %q of %s is the code of %s", alias, reg.codes[idx], reg.codes[other])
+		}
+	}
+	for i, counter := range reg.defaultCounters {
+		if counter == "" {
+			continue
+		}
+		if _, ok := reg.indexByCode[counter]; !ok || counter == reg.codes[i] {
+			return nil, fmt.Errorf("invalid default counter currency %s for %s", counter, reg.codes[i])
 		}
 	}
 
+	for _, code := range defaultEnabled {
+		code = strings.ToUpper(code)
+		if _, ok := reg.indexByCode[code]; !ok {
+			return nil, fmt.Errorf("unknown default enabled currency %s", code)
+		}
+		reg.defaultEnabled = append(reg.defaultEnabled, code)
+	}
+	if len(reg.defaultEnabled) < 2 {
+		return nil, errors.New("at least two currencies must be enabled by default")
+	}
+
 	// Compile regex rules referencing codes
-	currencyRegexpRules = make([]currencyRegexpRule, 0, len(rawRegexSpecs))
-	for _, rr := range rawRegexSpecs {
-		idx, ok := currencyIndexByCode[strings.ToUpper(rr.Code)]
+	reg.regexpRules = make([]currencyRegexpRule, 0, len(regexSpecs))
+	for _, rr := range regexSpecs {
+		idx, ok := reg.indexByCode[strings.ToUpper(rr.Code)]
 		if !ok {
-			continue // skip unknown code
+			return nil, fmt.Errorf("regex %q refers to unknown currency %s", rr.Pattern, rr.Code)
+		}
+		re, err := regexp.Compile(rr.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex for %s: %v", rr.Code, err)
 		}
-		currencyRegexpRules = append(currencyRegexpRules, currencyRegexpRule{
-			re:    regexp.MustCompile(rr.Pattern),
+		reg.regexpRules = append(reg.regexpRules, currencyRegexpRule{
+			re:    re,
 			index: idx,
 		})
 	}
+	return reg, nil
+}
+
+// isKnownCurrency checks whether the normalized code is in the registry
+func isKnownCurrency(code string) bool {
+	_, ok := currentCurrencies().indexByCode[strings.ToUpper(code)]
+	return ok
+}
 
-	// Shared HTTP client for TBC API calls; per-request timeouts via context
+// currencyMinorUnits returns the number of digits after the decimal point for the currency, 2 if unknown
+func currencyMinorUnits(code string) int {
+	return currentCurrencies().minorUnitsOf(code)
+}
+
+// minorUnitsOf returns the number of digits after the decimal point for the currency in the registry, 2 if unknown
+func (reg *currencyRegistry) minorUnitsOf(code string) int {
+	if idx, ok := reg.indexByCode[strings.ToUpper(code)]; ok {
+		return reg.minorUnits[idx]
+	}
+	return 2
 }
 
 // normalizeCurrency tries to turn an input token into a normalized currency code and its representation
-// Returns normalized (like RUR) and display representation
+// Returns normalized (like RUB) and display representation
 func normalizeCurrency(token string) (normalized string, ok bool) {
+	reg := currentCurrencies()
 	t := strings.ToLower(strings.TrimSpace(token))
 
-	if idx, found := currencyAliasToIndex[t]; found {
-		return currencyCodes[idx], true
+	if idx, found := reg.aliasToIndex[t]; found {
+		return reg.codes[idx], true
 	}
-	for _, rule := range currencyRegexpRules {
+	for _, rule := range reg.regexpRules {
 		if rule.re.MatchString(t) {
-			return currencyCodes[rule.index], true
+			return reg.codes[rule.index], true
 		}
 	}
 
-	// Also allow direct normalized codes (case-insensitive) like USD, RUR, GEL
+	// Also allow direct normalized codes (case-insensitive) like USD, RUB, GEL
 	upper := strings.ToUpper(t)
-	if _, ok := currencyIndexByCode[upper]; ok {
+	if _, ok := reg.indexByCode[upper]; ok {
 		return upper, true
 	}
 
@@ -138,73 +242,55 @@ func normalizeCurrency(token string) (normalized string, ok bool) {
 
 // formatCodeWithRep returns "CODE (REP)" if a distinct representation exists, otherwise just CODE
 func formatCodeWithRep(code string) string {
-	idx, ok := currencyIndexByCode[strings.ToUpper(code)]
+	reg := currentCurrencies()
+	idx, ok := reg.indexByCode[strings.ToUpper(code)]
 	if !ok {
 		return code
 	}
-	return fmt.Sprintf("%s (%s)", currencyRepresentations[idx], code)
+	return fmt.Sprintf("%s (%s)", reg.representations[idx], code)
 }
 
-// optionsForError returns possible options the user can use
-func optionsForError() string {
+// optionsForError returns possible options the user can use, limited to the given codes (all if nil)
+func optionsForError(codes []string) string {
+	reg := currentCurrencies()
+	var indexes []int
+	if codes == nil {
+		for idx := range reg.codes {
+			indexes = append(indexes, idx)
+		}
+	} else {
+		for _, code := range codes {
+			if idx, ok := reg.indexByCode[code]; ok {
+				indexes = append(indexes, idx)
+			}
+		}
+	}
 	// Compose list of aliases and regex hints
 	// unique alias keys grouped by normalized code
 	keysByIndex := map[int][]string{}
-	for alias, idx := range currencyAliasToIndex {
+	for alias, idx := range reg.aliasToIndex {
 		keysByIndex[idx] = append(keysByIndex[idx], alias)
 	}
 	// Order by representation order
 	var parts []string
-	for idx, rep := range currencyRepresentations {
+	for _, idx := range indexes {
 		aliases := keysByIndex[idx]
 		sort.Strings(aliases)
 		if len(aliases) > 0 {
-			parts = append(parts, fmt.Sprintf("%s: %s", rep, strings.Join(aliases, ", ")))
+			parts = append(parts, fmt.Sprintf("%s: %s", reg.codes[idx], strings.Join(aliases, ", ")))
 		} else {
-			parts = append(parts, rep)
+			parts = append(parts, reg.codes[idx])
 		}
 	}
-	return "Supported currencies and aliases: " + strings.Join(parts, " | ") + "; regex: р.* => RUR"
-}
-
-// TBC Bank API structures
-type tbcCommercialRate struct {
-	Currency string  `json:"currency"`
-	Buy      float64 `json:"buy"`
-	Sell     float64 `json:"sell"`
-}
-
-type tbcCommercialRatesResponse struct {
-	Base                string              `json:"base"`
-	CommercialRatesList []tbcCommercialRate `json:"commercialRatesList"`
-}
-
-type tbcNbgRate struct {
-	Currency string  `json:"currency"`
-	Value    float64 `json:"value"`
-}
-
-// getTBCCurrencyRatesCtx fetches exchange rates from TBC Bank API
-func getTBCCurrencyRatesCtx(ctx context.Context, apiKey string) ([]tbcNbgRate, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", "https://test-api.tbcbank.ge/v1/exchange-rates/nbg/", nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("apikey", apiKey)
-	resp, err := tbcHTTPClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("TBC rates request failed with status %s: %s",
-			resp.Status, resp.Body)
+	var regexHints []string
+	for _, rr := range reg.regexSpecs {
+		regexHints = append(regexHints, fmt.Sprintf("%s => %s", strings.TrimPrefix(rr.Pattern, "^"), strings.ToUpper(rr.Code)))
 	}
-	var out []tbcNbgRate
-	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
-		return nil, err
+	text := "Supported currencies and aliases: " + strings.Join(parts, " | ")
+	if len(regexHints) > 0 {
+		text += "; regex: " + strings.Join(regexHints, ", ")
 	}
-	return out, nil
+	return text
 }
 
 // --- Conversion and caching ---
@@ -218,305 +304,430 @@ type tbcCommercialRateCached struct {
 type tbcRateCached struct {
 	value       float64
 	LastUpdated time.Time
+	Source      string // name of the provider the rate came from
 }
 
-type tbcRateCache struct {
-	apiKey      string
-	rates       map[string]tbcRateCached // keyed by currency code, e.g., USD, RUR
-	lastUpdated time.Time
-	reqCh       chan interface{}
-	base        string // base currency reported by API; e.g., GEL
+// Rates older than this are used only with a warning
+const rateStaleThreshold = 12 * time.Hour
+
+// Rates older than this are refreshed in the background when used
+const rateRefreshThreshold = time.Hour
+
+// Timeout of a fetch from all providers
+const rateFetchTimeout = 60 * time.Second
+
+// errRatesStopped is returned by requests to the stopped rate cache
+var errRatesStopped = errors.New("rate cache is stopped")
+
+// rateSnapshot is an immutable state of the cache; updates replace the whole snapshot,
+// so readers use it without locking. Its maps must not be modified.
+type rateSnapshot struct {
+	base        string                             // base currency of the rates; always GEL
+	lastUpdated time.Time                          // time of the last successful fetch
+	rates       map[string]tbcRateCached           // keyed by currency code, e.g., USD, RUB
+	commercial  map[string]tbcCommercialRateCached // bank buy/sell rates, keyed the same way
 }
 
-// initCurrencyRates creates and starts the rate cache manager
-func initCurrencyRates(apiKey string) *tbcRateCache {
-	if strings.TrimSpace(apiKey) == "" {
-		log.Println("Missing TBC API key. Please create a developer account and obtain an API key: https://developers.tbcbank.ge/docs/create-developer-account")
+// tbcRateCache serves rates from the current snapshot.
+// Fetches run in separate goroutines; the manager goroutine coalesces fetch requests,
+// so there is at most one fetch of all rates in flight, and applies their results.
+type tbcRateCache struct {
+	db        *sql.DB                               // rates history and alerts storage, may be nil
+	notify    func(chatID int64, text string) error // sends triggered alerts, may be nil
+	providers []RateProvider                        // in the order of preference
+	health    *rateHealth                           // circuit breakers of provider endpoints
+	current   atomic.Pointer[rateSnapshot]
+	reqCh     chan interface{}
+	ctx       context.Context // canceled by stop, cancels fetches in flight
+	cancel    context.CancelFunc
+	stopped   chan struct{} // closed when the manager goroutine exits
+
+	alertSends sync.WaitGroup // triggered alerts being sent
+
+	// owned by the manager goroutine
+	fetching    bool            // a fetch of all rates is in flight
+	waiters     []chan error    // wait for the fetch in flight
+	nextWaiters []chan error    // wait for a fetch started after their request
+	singles     map[string]bool // currencies with a single rate fetch in flight
+}
+
+// initCurrencyRates creates and starts the rate cache manager.
+// The cache starts with the last rates stored in the database, so conversions work before the first fetch.
+// notify is used to send triggered rate alerts, report receives provider health changes.
+func initCurrencyRates(providers []RateProvider, db *sql.DB, notify func(chatID int64, text string) error, report func(string)) *tbcRateCache {
+	if len(providers) == 0 {
+		slog.Warn("No rate providers available, rates are disabled")
 		return nil
 	}
-	c := &tbcRateCache{apiKey: apiKey,
-		rates: make(map[string]tbcRateCached),
-		reqCh: make(chan interface{}, 32),
+	names := make([]string, len(providers))
+	for i, p := range providers {
+		names[i] = p.Name()
+	}
+	slog.Info("Rate providers", "providers", strings.Join(names, ", "))
+	c := &tbcRateCache{providers: providers,
+		health:  newRateHealth(report),
+		db:      db,
+		notify:  notify,
+		reqCh:   make(chan interface{}, 32),
+		stopped: make(chan struct{}),
+		singles: make(map[string]bool),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	snap := &rateSnapshot{
+		base:       CurGEL,
+		rates:      make(map[string]tbcRateCached),
+		commercial: make(map[string]tbcCommercialRateCached),
+	}
+	if db != nil {
+		rates, commercial, err := loadLatestRates(db)
+		if err != nil {
+			slog.Error("Error loading stored rates", "err", err)
+		} else if len(rates) > 0 {
+			snap.rates, snap.commercial = rates, commercial
+			slog.Info("Loaded stored rates", "count", len(rates))
+		}
 	}
+	c.current.Store(snap)
 	go c.run()
 	return c
 }
 
-// request/response messages for the manager loop
-type computeCounterReq struct {
-	knownCurrency string
-	knownAmount   float64
-	otherCurrency string
-	respCh        chan computeResp
-}
-
-type computeResp struct {
-	currency string
-	amount   float64
-	err      error
-}
+// messages for the manager loop
 
+// refreshReq asks for a fetch of all rates; respCh receives its result once applied.
+// A fresh request waits for a fetch started after it, otherwise the fetch in flight is joined.
 type refreshReq struct {
-	timeout time.Duration
-	respCh  chan error
+	fresh  bool
+	respCh chan error // may be nil for background refreshes
 }
 
-// apply messages (produced by background fetchers)
-type applySingle struct {
+// singleReq asks for a background fetch of a single rate
+type singleReq struct {
 	code string
-	rate tbcRateCached
 }
 
-// snapshot request/response for safe read access
-type snapshotReq struct {
-	respCh chan snapshotResp
+// applyAll carries the result of a fetch of all rates; commercial is nil if not available
+type applyAll struct {
+	rates      map[string]tbcRateCached
+	commercial map[string]tbcCommercialRateCached
+	err        error
 }
 
-type snapshotResp struct {
-	base        string
-	cacheUpdate time.Time
-	rates       map[string]tbcRateCached
+// applySingle carries a fetched single rate
+type applySingle struct {
+	code string
+	rate tbcRateCached
+	err  error
 }
 
-// run is the manager goroutine processing requests and updates
+// run is the manager goroutine applying fetched rates and coalescing fetch requests.
+// It never waits on the network, so it doesn't delay requests.
 func (c *tbcRateCache) run() {
-	// Initial refresh best-effort with 60s timeout
-	_ = c._refresh(60 * time.Second)
+	defer close(c.stopped)
+	c.startFetch()
 	ticker := time.NewTicker(4 * time.Hour)
 	defer ticker.Stop()
 	for {
 		select {
+		case <-c.ctx.Done():
+			for _, respCh := range append(c.waiters, c.nextWaiters...) {
+				respCh <- errRatesStopped
+			}
+			return
 		case msg := <-c.reqCh:
 			switch m := msg.(type) {
-			case computeCounterReq:
-				destCurrency := m.otherCurrency
-				if destCurrency == "" {
-					destCurrency = defaultCounterCurrency(m.knownCurrency)
-				}
-				resultAmt, err := c._computeCounterAmountInternal(m.knownCurrency, destCurrency, m.knownAmount)
-				m.respCh <- computeResp{currency: destCurrency, amount: resultAmt, err: err}
 			case refreshReq:
-				m.respCh <- c._refresh(m.timeout)
-			case applySingle:
-				r := m.rate
-				if r.LastUpdated.IsZero() {
-					r.LastUpdated = time.Now()
+				switch {
+				case !c.fetching:
+					c.nextWaiters = appendWaiter(c.nextWaiters, m.respCh)
+					c.startFetch()
+				case m.fresh:
+					c.nextWaiters = appendWaiter(c.nextWaiters, m.respCh)
+				default:
+					c.waiters = appendWaiter(c.waiters, m.respCh)
+				}
+			case singleReq:
+				// a fetch of all rates in flight brings this one as well
+				if !c.fetching && !c.singles[m.code] {
+					c.singles[m.code] = true
+					c.startSingleFetch(m.code)
 				}
-				c.rates[m.code] = r
-				c.lastUpdated = time.Now()
-			case snapshotReq:
-				// produce a deep copy of the rates map for safe use outside
-				copyMap := make(map[string]tbcRateCached, len(c.rates))
-				for k, v := range c.rates {
-					copyMap[k] = v
+			case applyAll:
+				c.applyAll(m)
+			case applySingle:
+				delete(c.singles, m.code)
+				if m.err != nil {
+					slog.Warn("Single rate request failed", "currency", m.code, "err", m.err)
+					continue
 				}
-				m.respCh <- snapshotResp{base: c.base, cacheUpdate: c.lastUpdated, rates: copyMap}
+				c.update(map[string]tbcRateCached{m.code: m.rate}, nil)
 			}
 		case <-ticker.C:
-			c.refreshIfStaleAsync()
+			if !c.fetching && c.isStale(2*time.Hour) {
+				c.startFetch()
+			}
 		}
 	}
 }
 
-// snapshot returns a safe copy of current base, cache timestamp, and rates
-func (c *tbcRateCache) snapshot() (string, time.Time, map[string]tbcRateCached) {
-	respCh := make(chan snapshotResp, 1)
-	c.reqCh <- snapshotReq{respCh: respCh}
-	resp := <-respCh
-	return resp.base, resp.cacheUpdate, resp.rates
-}
-
-// _refresh updates the entire rates map from the full list endpoint
-// since it accesses the map, it must be called from the manager goroutine only.
-func (c *tbcRateCache) _refresh(timeout time.Duration) error {
-	var ctx context.Context
-	var cancel context.CancelFunc
-	if timeout <= 0 {
-		ctx = context.Background()
-		cancel = func() {}
-	} else {
-		ctx, cancel = context.WithTimeout(context.Background(), timeout)
-	}
-	defer cancel()
-	out, err := getTBCCurrencyRatesCtx(ctx, c.apiKey)
-	if err != nil {
-		return err
+// stop stops the manager goroutine, canceling fetches in flight.
+// Rates are written to the database by the manager, so none are pending once it returns.
+func (c *tbcRateCache) stop() {
+	if c == nil {
+		return
 	}
-	// Rebuild map
-	now := time.Now()
-	newMap := make(map[string]tbcRateCached, len(out))
-	for _, r := range out {
-		code := strings.ToUpper(strings.TrimSpace(r.Currency))
-		if code == "" {
-			continue
-		}
-		newMap[code] = tbcRateCached{value: r.Value, LastUpdated: now}
-	}
-	// if c.base != "" && !strings.EqualFold(c.base, out.Base) {
-	// 	panic(fmt.Errorf("TBC base currency changed from %s to %s", c.base, out.Base))
-	// }
-	// c.base = strings.ToUpper(out.Base)
-	c.base = "GEL" // NBG rates are always GEL-based
-	c.rates = newMap
-	c.lastUpdated = now
-	return nil
+	c.cancel()
+	<-c.stopped
+	c.alertSends.Wait()
 }
 
-// refreshIfStaleAsync kicks off a background full refresh if any per-currency rate is older than the threshold.
-// Does not access the existing cache map, replaces the entire map when done.
-func (c *tbcRateCache) refreshIfStaleAsync() {
-	updateThreshold := 2 * time.Hour
-	// Determine if any per-currency rate is older than 2h; if not, align cache timestamp to oldest and skip
-	if !c.lastUpdated.IsZero() && time.Since(c.lastUpdated) > updateThreshold {
-		return
+// send passes the message to the manager goroutine; false if the cache is stopped
+func (c *tbcRateCache) send(msg interface{}) bool {
+	select {
+	case c.reqCh <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
 	}
-	if len(c.rates) > 0 {
-		oldest := time.Now()
-		anyOld := false
-		for _, v := range c.rates {
-			if v.LastUpdated.IsZero() {
-				anyOld = true
-				break
-			}
-			if v.LastUpdated.Before(oldest) {
-				oldest = v.LastUpdated
-			}
-		}
-		if !anyOld {
-			if time.Since(oldest) < updateThreshold {
-				// Keep cache timestamp aligned to the oldest per-currency update
-				c.lastUpdated = oldest
-				return
-			}
-		}
+}
+
+// appendWaiter adds respCh to waiters unless it is nil
+func appendWaiter(waiters []chan error, respCh chan error) []chan error {
+	if respCh == nil {
+		return waiters
 	}
-	// fetch in background and apply when done
-	apiKey := c.apiKey
+	return append(waiters, respCh)
+}
+
+// startFetch starts a fetch of all rates for the requests made so far.
+// Must be called from the manager goroutine when no fetch is in flight.
+func (c *tbcRateCache) startFetch() {
+	c.fetching = true
+	c.waiters, c.nextWaiters = c.nextWaiters, nil
+	providers, health := c.providers, c.health
 	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		ctx, cancel := context.WithTimeout(c.ctx, rateFetchTimeout)
 		defer cancel()
-		out, err := getTBCCurrencyRatesCtx(ctx, apiKey)
-		if err != nil {
-			return
-		}
-		// if !strings.EqualFold(c.base, out.Base) {
-		// 	log.Printf("TBC base currency changed from %s to %s", c.base, out.Base)
-		// 	c.base = strings.ToUpper(out.Base)
-		// }
-		m := make(map[string]tbcRateCached, len(out))
-		now := time.Now()
-		for _, r := range out {
-			curr := strings.ToUpper(r.Currency)
-			if _, ok := currencyIndexByCode[curr]; !ok {
-				continue // skip unknown currency
+		rates, err := fetchAllRates(ctx, providers, health)
+		var commercial map[string]tbcCommercialRateCached
+		if err == nil {
+			// Commercial rates are informational, the previous ones are kept if they are not available
+			if commercial, err = fetchCommercialRates(ctx, providers, health); err != nil {
+				slog.Warn("Commercial rates request failed", "err", err)
 			}
-			m[curr] = tbcRateCached{value: r.Value, LastUpdated: now}
+			err = nil
 		}
-		c.lastUpdated = now
-		c.rates = m
-
+		c.send(applyAll{rates: rates, commercial: commercial, err: err})
 	}()
 }
 
-// startSingleRateUpdate starts a fetch for a single currency and applies it when finished.
-func (c *tbcRateCache) startSingleRateUpdate(code string) {
-	cur := strings.ToUpper(strings.TrimSpace(code))
-	// Skip base currency: its rate to base is 1 by definition
-	if cur == "" || strings.EqualFold(cur, c.base) {
-		return
-	}
-	apiKey := c.apiKey
-	ch := c.reqCh
-	url := fmt.Sprintf("https://test-api.tbcbank.ge/v1/exchange-rates/nbg?currency=%s", cur)
+// startSingleFetch starts a fetch of a single rate.
+// Must be called from the manager goroutine.
+func (c *tbcRateCache) startSingleFetch(code string) {
+	providers, health := c.providers, c.health
 	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		ctx, cancel := context.WithTimeout(c.ctx, rateFetchTimeout)
 		defer cancel()
-		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-		if err != nil {
-			return
-		}
-		req.Header.Set("apikey", apiKey)
-		resp, err := tbcHTTPClient.Do(req)
-		if err != nil {
-			log.Printf("Single rate request for %s failed: %v", cur, err)
-			return
+		rate, err := fetchSingleRate(ctx, providers, health, code)
+		c.send(applySingle{code: code, rate: rate, err: err})
+	}()
+}
+
+// applyAll applies the fetch of all rates, answers its waiters and starts the next fetch if requested.
+// Must be called from the manager goroutine.
+func (c *tbcRateCache) applyAll(m applyAll) {
+	if m.err != nil {
+		slog.Error("Rates refresh failed", "err", m.err)
+	} else {
+		c.update(m.rates, m.commercial)
+	}
+	for _, respCh := range c.waiters {
+		respCh <- m.err
+	}
+	c.fetching, c.waiters = false, nil
+	if len(c.nextWaiters) > 0 {
+		c.startFetch()
+	}
+}
+
+// update stores a new snapshot with the fetched rates, keeping the last known rates
+// of currencies not fetched, then stores the history and evaluates alerts.
+// Must be called from the manager goroutine.
+func (c *tbcRateCache) update(fetched map[string]tbcRateCached, commercial map[string]tbcCommercialRateCached) {
+	old := c.current.Load()
+	snap := &rateSnapshot{
+		base:        old.base,
+		lastUpdated: time.Now(),
+		rates:       make(map[string]tbcRateCached, max(len(old.rates), len(fetched))),
+		commercial:  old.commercial,
+	}
+	for code, r := range old.rates {
+		snap.rates[code] = r
+	}
+	for code, r := range fetched {
+		if !isKnownCurrency(code) {
+			continue
 		}
-		defer resp.Body.Close()
-		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-			log.Printf("Single rate request for %s status %s: %s", cur, resp.Status, resp.Body)
-			return
+		if r.LastUpdated.IsZero() {
+			r.LastUpdated = time.Now()
 		}
-		var out []tbcNbgRate
-		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-			log.Printf("Error decoding single rate response %s: %v", resp.Body, err)
-			return
+		snap.rates[code] = r
+	}
+	if commercial != nil {
+		snap.commercial = commercial
+	}
+	c.current.Store(snap)
+	c.saveHistory(fetched, commercial)
+	c.evaluateAlerts()
+}
+
+// isStale checks whether there are no rates or any of them is older than the threshold
+func (c *tbcRateCache) isStale(threshold time.Duration) bool {
+	snap := c.current.Load()
+	if len(snap.rates) == 0 {
+		return true
+	}
+	for _, r := range snap.rates {
+		if time.Since(r.LastUpdated) > threshold {
+			return true
 		}
-		for _, r := range out {
-			if strings.EqualFold(r.Currency, cur) {
-				ch <- applySingle{code: cur, rate: tbcRateCached{value: r.Value, LastUpdated: time.Now()}}
-				break
-			}
+	}
+	return false
+}
+
+// manualProvider returns the provider for /rates set, nil if it is not in the chain
+func (c *tbcRateCache) manualProvider() *manualRateProvider {
+	for _, p := range c.providers {
+		if m, ok := p.(*manualRateProvider); ok {
+			return m
 		}
-	}()
+	}
+	return nil
+}
+
+// snapshot returns the current base, cache timestamp, and rates; the map must not be modified
+func (c *tbcRateCache) snapshot() (string, time.Time, map[string]tbcRateCached) {
+	snap := c.current.Load()
+	return snap.base, snap.lastUpdated, snap.rates
+}
+
+// commercialSnapshot returns the current bank buy/sell rates; the map must not be modified
+func (c *tbcRateCache) commercialSnapshot() map[string]tbcCommercialRateCached {
+	return c.current.Load().commercial
+}
+
+// refresh fetches all rates, waiting up to the timeout (no limit if not positive) until they are applied.
+// Concurrent calls share a fetch: a fresh refresh waits for a fetch started after the call,
+// otherwise the fetch in flight is joined.
+func (c *tbcRateCache) refresh(timeout time.Duration, fresh bool) error {
+	respCh := make(chan error, 1)
+	if !c.send(refreshReq{fresh: fresh, respCh: respCh}) {
+		return errRatesStopped
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case err := <-respCh:
+		return err
+	case <-c.stopped:
+		return errRatesStopped
+	case <-expired:
+		return fmt.Errorf("rates refresh is taking longer than %s", timeout)
+	}
+}
+
+// saveHistory stores fetched rates in the database, logging errors
+func (c *tbcRateCache) saveHistory(rates map[string]tbcRateCached, commercial map[string]tbcCommercialRateCached) {
+	if c.db == nil {
+		return
+	}
+	if err := saveRateHistory(c.db, rates, commercial); err != nil {
+		slog.Error("Error saving rates history", "err", err)
+	}
 }
 
-// convertAmountsByRate computes conversion using cached list via buy/sell logic.
-// Returns converted amount and true if computation was possible.
-func (c *tbcRateCache) convertAmountsByRate(from, to string, amount float64) (float64, error) {
+// convertAmountsByRate computes conversion using cached list via buy/sell logic, rounding half to even.
+// Returns converted amount and the time of the oldest rate used, which may be stale
+// when providers are unavailable and the cache holds the last known rates.
+func (s *rateSnapshot) convertAmountsByRate(from, to string, amount Amount) (Amount, time.Time, error) {
 	if from == to {
-		return amount, nil
+		return amount, time.Now(), nil
 	}
 
 	// foreign A -> foreign B via base
-	rateFrom := c.cachedRate(from)
-	rateTo := c.cachedRate(to)
+	rateFrom := s.cachedRate(from)
+	rateTo := s.cachedRate(to)
 	if rateFrom.value == 0 || rateTo.value == 0 {
-		return 0, fmt.Errorf("no cached rate for %s or %s", from, to)
+		return 0, time.Time{}, fmt.Errorf("no cached rate for %s or %s", from, to)
 	}
-	gel := amount * rateFrom.value
-	return gel / rateTo.value, nil
+	asOf := rateFrom.LastUpdated
+	if rateTo.LastUpdated.Before(asOf) {
+		asOf = rateTo.LastUpdated
+	}
+	converted, err := convertAmount(amount, from, to, rateFrom.value, rateTo.value, RoundHalfEven)
+	return converted, asOf, err
 }
 
-func (c *tbcRateCache) cachedRate(from string) tbcRateCached {
-	if from == c.base {
+func (s *rateSnapshot) cachedRate(from string) tbcRateCached {
+	if from == s.base {
 		return tbcRateCached{value: 1.0, LastUpdated: time.Now()}
 	}
-	rateFrom, ok := c.rates[from]
+	rateFrom, ok := s.rates[from]
 	if !ok {
 		return tbcRateCached{}
 	}
 	return rateFrom
 }
 
-// tryConvertEndpoint tries the convert endpoint with 2s timeout; returns value or error
-func (c *tbcRateCache) tryConvertEndpoint(from, to string, amount float64) (float64, error) {
-	url := fmt.Sprintf("https://test-api.tbcbank.ge/v1/exchange-rates/nbg/convert?From=%s&To=%s&Amount=%s",
-		from, to, trimFloat(amount))
+// tryConvertEndpoint asks providers able to convert on their side, in order, with 2s timeout; returns value or error.
+// The result is rounded half to even to the minor unit of the target currency.
+func (c *tbcRateCache) tryConvertEndpoint(from, to string, amount Amount) (Amount, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return 0, err
-	}
-	req.Header.Set("apikey", c.apiKey)
-	resp, err := tbcHTTPClient.Do(req)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return 0, fmt.Errorf("convert endpoint status %s: %s", resp.Status, resp.Body)
+	var errs []error
+	for _, p := range c.providers {
+		conv, ok := p.(rateConverter)
+		if !ok {
+			continue
+		}
+		var v float64
+		err := c.health.call(p.Name(), endpointConvert, func() (err error) {
+			v, err = conv.Convert(ctx, from, to, amount.Float(from))
+			return err
+		})
+		if err == nil {
+			return amountFromFloat(v, to, RoundHalfEven)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
 	}
-	var out struct {
-		From   string  `json:"from"`
-		To     string  `json:"to"`
-		Amount float64 `json:"amount"`
-		Value  float64 `json:"value"`
+	return 0, fmt.Errorf("no provider could convert %s to %s: %w", from, to, errors.Join(errs...))
+}
+
+// bankConvert computes how much of `to` the bank pays for `amount` of `from`:
+// the bank buys `from` at its buy rate and sells `to` at its sell rate; GEL is 1 both ways.
+// The result is rounded down, as the bank doesn't pay out fractions of the minor unit.
+func bankConvert(commercial map[string]tbcCommercialRateCached, from, to string, amount Amount) (Amount, bool) {
+	rateFrom, rateTo := 1.0, 1.0
+	if from != CurGEL {
+		r, ok := commercial[from]
+		if !ok {
+			return 0, false
+		}
+		rateFrom = r.Buy
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
-		return 0, err
+	if to != CurGEL {
+		r, ok := commercial[to]
+		if !ok {
+			return 0, false
+		}
+		rateTo = r.Sell
 	}
-	return out.Value, nil
+	converted, err := convertAmount(amount, from, to, rateFrom, rateTo, RoundDown)
+	return converted, err == nil
 }
 
 // trimFloat formats float without scientific notation to avoid issues in URL
@@ -530,48 +741,89 @@ func trimFloat(f float64) string {
 
 // defaultCounterCurrency picks the other side currency when only one side is provided
 func defaultCounterCurrency(code string) string {
+	return defaultCounterCurrencyIn(code, nil)
+}
+
+// defaultCounterCurrencyIn picks the other side currency among the enabled ones (any if nil):
+// the configured counter currency if it is enabled, otherwise the first other enabled currency
+func defaultCounterCurrencyIn(code string, enabled []string) string {
+	reg := currentCurrencies()
 	up := strings.ToUpper(code)
-	switch up {
-	case CurUSD:
-		return CurRUR
-	case CurGEL:
-		return CurRUR
-	// case CurRUR:
-	// 	return CurUSD
-	default:
-		return CurUSD
-	}
-}
-
-// public method: compute via manager channel to avoid concurrent map access
-func (c *tbcRateCache) computeCounterAmount(from, to string, fromAmount float64) (string, float64, error) {
-	respCh := make(chan computeResp, 1)
-	c.reqCh <- computeCounterReq{knownCurrency: from, knownAmount: fromAmount, otherCurrency: to, respCh: respCh}
-	resp := <-respCh
-	return resp.currency, resp.amount, resp.err
-}
-
-// internal compute executed in the manager goroutine
-// it calls functions which access the map, so it must be called from the manager goroutine only.
-func (c *tbcRateCache) _computeCounterAmountInternal(from, to string, knownAmount float64) (float64, error) {
-	updates := make([]string, 2)
+	if enabled == nil {
+		enabled = reg.codes
+	}
+	if idx, ok := reg.indexByCode[up]; ok && reg.defaultCounters[idx] != "" {
+		if slices.Contains(enabled, reg.defaultCounters[idx]) {
+			return reg.defaultCounters[idx]
+		}
+	}
+	for _, c := range enabled {
+		if c != up {
+			return c
+		}
+	}
+	return up
+}
+
+// counterCurrency picks the other side currency for the chat: its default counter currency
+// if it is enabled and differs from the code, otherwise the one picked by currency
+func (cfg ChatConfig) counterCurrency(code string, enabled []string) string {
+	if cfg.DefaultCounter != "" && cfg.DefaultCounter != strings.ToUpper(code) && slices.Contains(enabled, cfg.DefaultCounter) {
+		return cfg.DefaultCounter
+	}
+	return defaultCounterCurrencyIn(code, enabled)
+}
+
+// computeCounterAmount converts the amount to the other currency, the default counter one if empty.
+// It runs in the caller's goroutine using the current snapshot, so concurrent calls don't wait for each other.
+// Stale rates are refreshed in the background; only missing rates are waited for, up to 10s.
+// asOf is the time of the oldest rate used, see rateWarning.
+func (c *tbcRateCache) computeCounterAmount(from, to string, fromAmount Amount) (currency string, amount Amount, asOf time.Time, err error) {
+	if to == "" {
+		to = defaultCounterCurrency(from)
+	}
+	snap := c.current.Load()
+	var missing, stale []string
 	for _, cur := range []string{from, to} {
-		rate, ok := c.rates[cur]
-		if !ok || rate.LastUpdated.IsZero() || time.Since(rate.LastUpdated) > time.Hour {
-			updates = append(updates, cur)
+		if cur == snap.base {
+			continue
+		}
+		rate, ok := snap.rates[cur]
+		if !ok {
+			missing = append(missing, cur)
+		} else if rate.LastUpdated.IsZero() || time.Since(rate.LastUpdated) > rateRefreshThreshold {
+			stale = append(stale, cur)
 		}
 	}
-	if len(updates) == 1 {
-		c.startSingleRateUpdate(updates[0])
-	} else if len(updates) > 1 {
-		_ = c._refresh(10 * time.Second)
+	switch {
+	case len(missing) > 0:
+		if err := c.refresh(10*time.Second, false); err != nil {
+			slog.Warn("Rates refresh for a conversion failed", "from", from, "to", to, "err", err)
+		}
+		snap = c.current.Load()
+	case len(stale) == 1:
+		c.send(singleReq{code: stale[0]})
+	case len(stale) > 1:
+		c.send(refreshReq{})
 	}
 
-	if v, e := c.tryConvertEndpoint(from, to, knownAmount); e == nil {
-		return v, nil
+	// Cached rates come first as they respect the provider order; providers converting on their side
+	// are the fallback when some rate is missing.
+	v, asOf, err := snap.convertAmountsByRate(from, to, fromAmount)
+	if err == nil {
+		return to, v, asOf, nil
 	}
-	if v, e := c.convertAmountsByRate(from, to, knownAmount); e == nil {
-		return v, nil
+	v, convErr := c.tryConvertEndpoint(from, to, fromAmount)
+	if convErr == nil {
+		return to, v, time.Now(), nil
+	}
+	return to, 0, time.Time{}, fmt.Errorf("conversion failed: %w", errors.Join(err, convErr))
+}
+
+// rateWarning returns a warning for amounts computed with rates as of the given time, empty if they are fresh
+func rateWarning(asOf time.Time) string {
+	if asOf.IsZero() || time.Since(asOf) < rateStaleThreshold {
+		return ""
 	}
-	return 0, errors.New("conversion failed and no cached rate available")
+	return fmt.Sprintf("⚠ computed with last known rates from %s, they may be stale", asOf.Local().Format("2006-01-02 15:04"))
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// currencyConfig is the format of currencies.json
+type currencyConfig struct {
+	// Entries override fields of the built-in currency with the same code; new codes are added.
+	// Fields missing in an entry keep built-in values.
+	Currencies     []json.RawMessage `json:"currencies"`
+	Regexps        []regexSpec       `json:"regexps"`         // replace built-in rules if present
+	DefaultEnabled []string          `json:"default_enabled"` // replace built-in list if present
+}
+
+// mergeCurrencySpecs applies currencies.json entries over the built-in specs
+func mergeCurrencySpecs(builtin []currencySpec, overrides []json.RawMessage) ([]currencySpec, error) {
+	specs := slices.Clone(builtin)
+	for _, raw := range overrides {
+		var key struct {
+			Code string `json:"code"`
+		}
+		if err := json.Unmarshal(raw, &key); err != nil {
+			return nil, err
+		}
+		idx := slices.IndexFunc(specs, func(s currencySpec) bool { return strings.EqualFold(s.Code, key.Code) })
+		if idx < 0 {
+			specs = append(specs, currencySpec{MinorUnits: 2})
+			idx = len(specs) - 1
+		}
+		// Unmarshal reuses slice backing arrays, which are shared with the built-in specs
+		specs[idx].Aliases = slices.Clone(specs[idx].Aliases)
+		if err := json.Unmarshal(raw, &specs[idx]); err != nil {
+			return nil, fmt.Errorf("currency %s: %v", key.Code, err)
+		}
+	}
+	return specs, nil
+}
+
+// loadCurrencyConfig replaces the currency registry with built-in currencies updated from the file.
+// A missing file means built-in currencies only; an invalid one keeps the current registry.
+// If db is given, minor units of currencies with stored offers must not change.
+func loadCurrencyConfig(filePath string, db *sql.DB) error {
+	reg, entries, err := readCurrencyConfig(filePath)
+	if err != nil {
+		return err
+	}
+	if db != nil {
+		if err := checkCurrencyScales(db, reg); err != nil {
+			return fmt.Errorf("error in currencies file %s: %v", filePath, err)
+		}
+	}
+	currencies.Store(reg)
+	if entries > 0 {
+		slog.Info("Applied currency entries", "count", entries, "file", filePath)
+	}
+	return nil
+}
+
+// readCurrencyConfig builds the registry from built-in currencies updated from the file,
+// returning the number of entries in the file
+func readCurrencyConfig(filePath string) (*currencyRegistry, int, error) {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		reg, err := buildCurrencyRegistry(currencySpecs, rawRegexSpecs, defaultEnabledCurrencies)
+		return reg, 0, err
+	}
+	rawdata, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading currencies file: %v", err)
+	}
+	var config currencyConfig
+	if err := json.Unmarshal(rawdata, &config); err != nil {
+		return nil, 0, fmt.Errorf("error parsing currencies file: %v", err)
+	}
+	specs, err := mergeCurrencySpecs(currencySpecs, config.Currencies)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error parsing currencies file: %v", err)
+	}
+	if config.Regexps == nil {
+		config.Regexps = rawRegexSpecs
+	}
+	if config.DefaultEnabled == nil {
+		config.DefaultEnabled = defaultEnabledCurrencies
+	}
+	reg, err := buildCurrencyRegistry(specs, config.Regexps, config.DefaultEnabled)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error in currencies file %s: %v", filePath, err)
+	}
+	return reg, len(config.Currencies), nil
+}
+
+// watchCurrencyConfig polls the modification time of the currencies file and reloads it on change,
+// checking minor units against the offers stored in db
+func watchCurrencyConfig(ctx context.Context, filePath string, db *sql.DB, interval time.Duration) {
+	modTime := func() time.Time {
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	last := modTime()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := modTime()
+		if current.Equal(last) {
+			continue
+		}
+		last = current
+		if err := loadCurrencyConfig(filePath, db); err != nil {
+			slog.Error("Currencies file changed, but was not applied", "file", filePath, "err", err)
+		} else {
+			slog.Info("Currencies file changed, reloaded", "file", filePath)
+		}
+	}
+}
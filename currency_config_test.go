@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadCurrencyConfigKeepsStoredScales(t *testing.T) {
+	prev := currentCurrencies()
+	t.Cleanup(func() { currencies.Store(prev) })
+	dir := t.TempDir()
+	db := initDB(filepath.Join(dir, dbFileName))
+	t.Cleanup(func() { db.Close() })
+	replyID, err := saveReplyMessageID(db, MessageIndex{ChannelID: testChatID, MessageID: 1}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := saveOffer(db, NewOffer{UserID: 1, Username: "seller", HaveAmount: 10000, HaveCurrency: CurUSD,
+		WantAmount: 27000, WantCurrency: CurGEL, ChannelID: testChatID, MessageID: 1, ReplyID: replyID}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "currencies.json")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`{"currencies": [{"code": "USD", "minor_units": 0}]}`)
+	err = loadCurrencyConfig(path, db)
+	if err == nil || !strings.Contains(err.Error(), "USD") {
+		t.Errorf("changing minor units of USD with a stored offer: err = %v", err)
+	}
+	if currencyMinorUnits(CurUSD) != 2 {
+		t.Errorf("minor units of USD = %d after a rejected reload, want 2", currencyMinorUnits(CurUSD))
+	}
+	// without a database to check, e.g., in --check-config, the file itself is valid
+	if err := loadCurrencyConfig(path, nil); err != nil {
+		t.Errorf("loading without a database: %v", err)
+	}
+	currencies.Store(prev)
+
+	write(`{"currencies": [{"code": "JPY", "minor_units": 2}]}`)
+	if err := loadCurrencyConfig(path, db); err != nil {
+		t.Errorf("changing minor units of a currency without offers: %v", err)
+	}
+	if currencyMinorUnits("JPY") != 2 {
+		t.Errorf("minor units of JPY = %d, want 2", currencyMinorUnits("JPY"))
+	}
+}
+
+func TestBuildCurrencyRegistryErrors(t *testing.T) {
+	usd := currencySpec{Code: CurUSD, MinorUnits: 2, Aliases: []string{"$"}}
+	gel := currencySpec{Code: CurGEL, MinorUnits: 2, Aliases: []string{"₾"}}
+	enabled := []string{CurUSD, CurGEL}
+	tests := []struct {
+		specs   []currencySpec
+		regexps []regexSpec
+		enabled []string
+		err     string
+	}{
+		{[]currencySpec{usd, gel, {Code: "usd"}}, nil, enabled, "duplicate currency code USD"},
+		{[]currencySpec{usd, gel, {Code: "EUR", Aliases: []string{"$"}}}, nil, enabled, `alias "$" is used by both USD and EUR`},
+		{[]currencySpec{usd, gel, {Code: "EUR", Aliases: []string{" USD "}}}, nil, enabled, `alias "usd" of EUR is the code of USD`},
+		{[]currencySpec{usd, gel, {Code: "EUR", DefaultCounter: "XXX"}}, nil, enabled, "invalid default counter currency XXX"},
+		{[]currencySpec{usd, gel, {Code: "EUR", DefaultCounter: "eur"}}, nil, enabled, "invalid default counter currency EUR"},
+		{[]currencySpec{usd, gel, {Code: "KWD", MinorUnits: 5}}, nil, enabled, "invalid minor units 5"},
+		{[]currencySpec{usd, gel, {Symbol: "?"}}, nil, enabled, "has no code"},
+		{[]currencySpec{usd, gel}, []regexSpec{{Pattern: "^e", Code: "EUR"}}, enabled, "unknown currency EUR"},
+		{[]currencySpec{usd, gel}, []regexSpec{{Pattern: "(", Code: CurUSD}}, enabled, "invalid regex"},
+		{[]currencySpec{usd, gel}, nil, []string{CurUSD, "EUR"}, "unknown default enabled currency EUR"},
+		{[]currencySpec{usd, gel}, nil, []string{CurUSD}, "at least two currencies"},
+		{nil, nil, enabled, "no currencies"},
+	}
+	for _, tt := range tests {
+		_, err := buildCurrencyRegistry(tt.specs, tt.regexps, tt.enabled)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("buildCurrencyRegistry(%+v, %+v): err = %v, want %q", tt.specs, tt.regexps, err, tt.err)
+		}
+	}
+}
+
+func TestNormalizeCurrency(t *testing.T) {
+	tests := []struct {
+		token, want string
+		ok          bool
+	}{
+		{"$", CurUSD, true},
+		{"Доллары", CurUSD, true}, // by the regexp rule
+		{"лари", CurGEL, true},
+		{"драм", "AMD", true}, // aliases win over the regexp rules
+		{"лира", "TRY", true},
+		{"рубли", CurRUB, true},
+		{"eur", "EUR", true},
+		{"Jpy", "JPY", true},
+		{"xyz", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := normalizeCurrency(tt.token); got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeCurrency(%q) = %q, %v; want %q, %v", tt.token, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMergeCurrencySpecs(t *testing.T) {
+	overrides := []json.RawMessage{
+		json.RawMessage(`{"code": "usd", "aliases": ["зелёные"]}`),
+		json.RawMessage(`{"code": "XAU", "symbol": "oz"}`),
+	}
+	specs, err := mergeCurrencySpecs(currencySpecs, overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(specs, func(s currencySpec) bool { return strings.EqualFold(s.Code, CurUSD) })
+	if !slices.Equal(specs[i].Aliases, []string{"зелёные"}) || specs[i].Symbol != "$" || specs[i].MinorUnits != 2 {
+		t.Errorf("overridden USD = %+v", specs[i])
+	}
+	if builtin := currencySpecs[slices.IndexFunc(currencySpecs, func(s currencySpec) bool { return s.Code == CurUSD })]; slices.Contains(builtin.Aliases, "зелёные") {
+		t.Errorf("built-in USD is modified: %+v", builtin)
+	}
+	if last := specs[len(specs)-1]; last.Code != "XAU" || last.Symbol != "oz" || last.MinorUnits != 2 {
+		t.Errorf("added currency = %+v", last)
+	}
+	if _, err := mergeCurrencySpecs(currencySpecs, []json.RawMessage{json.RawMessage(`{"code": "USD", "minor_units": "two"}`)}); err == nil {
+		t.Error("invalid entry is accepted")
+	}
+}
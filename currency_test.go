@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeRateProvider returns fixed rates after the delay, or an error if down
+type fakeRateProvider struct {
+	delay time.Duration
+	down  bool
+}
+
+func (p *fakeRateProvider) Name() string { return "fake" }
+
+func (p *fakeRateProvider) FetchRates(ctx context.Context) (map[string]float64, error) {
+	select {
+	case <-time.After(p.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if p.down {
+		return nil, errors.New("provider is down")
+	}
+	return map[string]float64{CurUSD: 2.7, CurRUB: 0.033}, nil
+}
+
+func (p *fakeRateProvider) FetchRate(ctx context.Context, code string) (float64, error) {
+	rates, err := p.FetchRates(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if v, ok := rates[code]; ok {
+		return v, nil
+	}
+	return 0, errNoRate
+}
+
+// newBenchRateCache starts a cache, waits for its initial fetch and then sets rates as of asOf
+func newBenchRateCache(b *testing.B, p *fakeRateProvider, asOf time.Time) *tbcRateCache {
+	c := initCurrencyRates([]RateProvider{p}, nil, nil, nil)
+	b.Cleanup(c.stop)
+	// joins the initial fetch, which would replace the rates set below; it fails if the provider is down
+	_ = c.refresh(0, false)
+	c.current.Store(&rateSnapshot{
+		base:        CurGEL,
+		lastUpdated: asOf,
+		rates: map[string]tbcRateCached{
+			CurUSD: {value: 2.7, LastUpdated: asOf, Source: p.Name()},
+			CurRUB: {value: 0.033, LastUpdated: asOf, Source: p.Name()},
+		},
+		commercial: map[string]tbcCommercialRateCached{},
+	})
+	return c
+}
+
+func benchmarkComputeCounterAmount(b *testing.B, c *tbcRateCache) {
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, _, _, err := c.computeCounterAmount(CurUSD, CurRUB, 10000); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkComputeCounterAmount measures concurrent conversions with fresh rates
+func BenchmarkComputeCounterAmount(b *testing.B) {
+	c := newBenchRateCache(b, &fakeRateProvider{}, time.Now())
+	benchmarkComputeCounterAmount(b, c)
+}
+
+// BenchmarkComputeCounterAmountSlowProvider measures concurrent conversions with stale rates
+// while the provider takes a second to answer: conversions use the last known rates
+// and don't wait for the refresh they request
+func BenchmarkComputeCounterAmountSlowProvider(b *testing.B) {
+	c := newBenchRateCache(b, &fakeRateProvider{delay: time.Second}, time.Now().Add(-2*rateRefreshThreshold))
+	benchmarkComputeCounterAmount(b, c)
+}
+
+// BenchmarkComputeCounterAmountProviderDown measures concurrent conversions with stale rates
+// while every fetch fails after a delay
+func BenchmarkComputeCounterAmountProviderDown(b *testing.B) {
+	c := newBenchRateCache(b, &fakeRateProvider{delay: 100 * time.Millisecond, down: true}, time.Now().Add(-2*rateRefreshThreshold))
+	benchmarkComputeCounterAmount(b, c)
+}
+
+func TestBankConvert(t *testing.T) {
+	commercial := map[string]tbcCommercialRateCached{
+		CurUSD: {Buy: 2.68, Sell: 2.72},
+		"EUR":  {Buy: 2.90, Sell: 3.00},
+		"JPY":  {Buy: 0.0180, Sell: 0.0190},
+	}
+	tests := []struct {
+		amount   Amount
+		from, to string
+		want     Amount
+		ok       bool
+	}{
+		// the bank buys foreign currency at its buy rate
+		{10000, CurUSD, CurGEL, 26800, true},
+		// and sells it at its sell rate: 10 GEL is 3.6765 USD, paid as 3.67
+		{1000, CurGEL, CurUSD, 367, true},
+		{100, CurGEL, "JPY", 52, true}, // 52.63 JPY, JPY has no minor units
+		// foreign to foreign buys one and sells the other: 268 GEL for 100 USD buy 89.3333 EUR
+		{10000, CurUSD, "EUR", 8933, true},
+		{10000, "EUR", CurUSD, 10661, true}, // 290 GEL buy 106.6176 USD
+		{10000, CurUSD, "JPY", 14105, true},
+		// no rate, no conversion
+		{10000, "AMD", CurGEL, 0, false},
+		{10000, CurGEL, "AMD", 0, false},
+		{10000, CurUSD, "AMD", 0, false},
+		{10000, "AMD", CurUSD, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := bankConvert(commercial, tt.from, tt.to, tt.amount)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("bankConvert(%d %s to %s) = %d, %v; want %d, %v", tt.amount, tt.from, tt.to, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -2,11 +2,19 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
 )
 
 func getNextUpdateId(db *sql.DB) int {
+	defer observeQuery("getNextUpdateId", time.Now())
 	var lastUpdateID int
 	err := db.QueryRow("SELECT last_update_id FROM bot_settings WHERE id = 1").Scan(&lastUpdateID)
 	if err != nil {
@@ -17,33 +25,66 @@ func getNextUpdateId(db *sql.DB) int {
 
 // saveLastUpdateID saves the last processed update ID to the database
 func saveLastUpdateID(db *sql.DB, updateID int) error {
+	defer observeQuery("saveLastUpdateID", time.Now())
 	_, err := db.Exec("UPDATE bot_settings SET last_update_id = ? WHERE id = 1", updateID)
 	if err != nil {
-		log.Printf("Error saving last update ID: %v", err)
+		slog.Error("Error saving last update ID", "update", updateID, "err", err)
 	}
 	return err
 }
 
 // getUserReputation gets user reputation from database
 func getUserReputation(db *sql.DB, userID int) (reputation int64, err error) {
+	defer observeQuery("getUserReputation", time.Now())
 	err = db.QueryRow("SELECT reputation FROM exchangers WHERE userid = ?", userID).Scan(&reputation)
 	return reputation, err
 }
 
+// getUserLocation gets the default place code from the user profile, empty if not set
+func getUserLocation(db *sql.DB, userID int) (string, error) {
+	defer observeQuery("getUserLocation", time.Now())
+	var location sql.NullString
+	err := db.QueryRow("SELECT location FROM exchangers WHERE userid = ?", userID).Scan(&location)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return location.String, err
+}
+
+// setUserLocation stores the default place code in the user profile, empty code clears it
+func setUserLocation(db *sql.DB, userID int, username string, location string) error {
+	defer observeQuery("setUserLocation", time.Now())
+	var value any
+	if location != "" {
+		value = location
+	}
+	_, err := db.Exec(`
+		INSERT INTO exchangers (userid, reputation, name, location)
+		VALUES (?, 0, ?, ?)
+		ON CONFLICT(userid) DO UPDATE SET location = excluded.location`, userID, username, value)
+	if err != nil {
+		return fmt.Errorf("error saving user location: %w", err)
+	}
+	return nil
+}
+
 type NewOffer struct {
 	UserID       int
 	Username     string
-	HaveAmount   float64
+	HaveAmount   Amount
 	HaveCurrency string
-	WantAmount   float64
+	WantAmount   Amount
 	WantCurrency string
 	ChannelID    int64
 	MessageID    int
 	ReplyID      int64
+	Methods      []string
+	Location     string
 }
 
 // saveOffer saves an offer to the database and returns the new offer ID
-func saveOffer(db *sql.DB, offer NewOffer) (int64, error) {
+func saveOffer(db dbExecutor, offer NewOffer) (int64, error) {
+	defer observeQuery("saveOffer", time.Now())
 	// Ensure the exchangers table has the user
 	if _, err := db.Exec(`
 		INSERT OR IGNORE INTO exchangers (userid, reputation, name)
@@ -53,38 +94,117 @@ func saveOffer(db *sql.DB, offer NewOffer) (int64, error) {
 
 	// Insert the offer
 	res, err := db.Exec(`
-		INSERT INTO offers (userid, username, have_amount, have_currency, want_amount, want_currency, channel_id, message_id, reply_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		INSERT INTO offers (userid, username, have_amount_minor, have_currency, want_amount_minor, want_currency, channel_id, message_id, reply_id, location)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''))`,
 		offer.UserID, offer.Username,
 		offer.HaveAmount, offer.HaveCurrency,
 		offer.WantAmount, offer.WantCurrency,
-		offer.ChannelID, offer.MessageID, offer.ReplyID)
+		offer.ChannelID, offer.MessageID, offer.ReplyID,
+		offer.Location)
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	offerID, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := saveCurrencyScales(db, offer.HaveCurrency, offer.WantCurrency); err != nil {
+		return offerID, err
+	}
+
+	// Attach payment methods
+	for _, m := range offer.Methods {
+		if _, err := db.Exec(`
+			INSERT OR IGNORE INTO offer_methods (offer_id, method)
+			VALUES (?, ?)`, offerID, m); err != nil {
+			return offerID, fmt.Errorf("error inserting into offer_methods: %w", err)
+		}
+	}
+	return offerID, nil
+}
+
+// saveCurrencyScales records minor units the amounts of the currencies are stored in.
+// A recorded scale is only replaced if no offers in the currency remained, see checkCurrencyScales.
+func saveCurrencyScales(db dbExecutor, codes ...string) error {
+	for _, code := range codes {
+		if _, err := db.Exec(`
+			INSERT INTO currency_scales (currency, minor_units) VALUES (?, ?)
+			ON CONFLICT(currency) DO UPDATE SET minor_units = excluded.minor_units`,
+			code, currencyMinorUnits(code)); err != nil {
+			return fmt.Errorf("error inserting into currency_scales: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkCurrencyScales fails if the registry changes minor units of a currency with stored offers,
+// since their amounts would be rescaled by a power of ten
+func checkCurrencyScales(db *sql.DB, reg *currencyRegistry) error {
+	defer observeQuery("checkCurrencyScales", time.Now())
+	rows, err := db.Query(`
+		SELECT s.currency, s.minor_units FROM currency_scales s
+		WHERE EXISTS (SELECT 1 FROM offers o WHERE o.have_currency = s.currency OR o.want_currency = s.currency)
+		ORDER BY s.currency`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		var units int
+		if err := rows.Scan(&code, &units); err != nil {
+			return err
+		}
+		if current := reg.minorUnitsOf(code); current != units {
+			return fmt.Errorf("minor units of %s can't change from %d to %d while offers in %s are stored", code, units, current, code)
+		}
+	}
+	return rows.Err()
 }
 
 type StoredOffer struct {
 	UserID       int
 	Username     string
-	HaveAmount   float64
+	HaveAmount   Amount
 	HaveCurrency string
-	WantAmount   float64
+	WantAmount   Amount
 	WantCurrency string
 	ChannelID    int64
 	MessageID    int
 	PostedAt     string
 	Reputation   int64
+	Methods      []string
+	Location     string
 }
 
-// getFilteredOffers retrieves offers from the database with optional filtering
-func getFilteredOffers(db *sql.DB, limit int, querySuffix string, args ...any) ([]StoredOffer, error) {
+// chatOffersFilter returns an SQL condition selecting offers visible in the chat:
+// the ones posted in it and, if the chat shares offers, the ones of other sharing chats
+func chatOffersFilter(chatID int64) (string, []any) {
+	return `(o.channel_id = ? OR (o.channel_id IN (SELECT chat_id FROM chats WHERE shared = 1)
+		AND EXISTS (SELECT 1 FROM chats WHERE chat_id = ? AND shared = 1)))`, []any{chatID, chatID}
+}
+
+// offerNotExpiredCond is an SQL condition skipping offers older than the TTL of the chat they were posted in
+const offerNotExpiredCond = `NOT EXISTS (SELECT 1 FROM chats t WHERE t.chat_id = o.channel_id AND t.offer_ttl_seconds > 0
+		AND o.posted_at < datetime('now', '-' || t.offer_ttl_seconds || ' seconds'))`
+
+// getFilteredOffers retrieves offers visible in the chat which haven't expired,
+// optionally filtered by an additional SQL condition
+func getFilteredOffers(db *sql.DB, chatID int64, limit int, cond string, args ...any) ([]StoredOffer, error) {
+	defer observeQuery("getFilteredOffers", time.Now())
+	scope, scopeArgs := chatOffersFilter(chatID)
+	where := scope + " AND " + offerNotExpiredCond
+	if cond != "" {
+		where += " AND (" + cond + ")"
+	}
+	args = append(scopeArgs, args...)
 	query := `
-		SELECT o.userid, o.username, o.have_amount, o.have_currency, o.want_amount, o.want_currency, o.channel_id, o.message_id, o.posted_at, e.reputation
+		SELECT o.userid, o.username, o.have_amount_minor, o.have_currency, o.want_amount_minor, o.want_currency, o.channel_id, o.message_id, o.posted_at, e.reputation,
+			COALESCE(o.location, ''),
+			(SELECT GROUP_CONCAT(m.method, ',') FROM offer_methods m WHERE m.offer_id = o.id)
 		FROM offers o
 		LEFT JOIN exchangers e ON o.userid = e.userid
-		` + querySuffix + `
+		WHERE ` + where + `
 		ORDER BY o.posted_at DESC LIMIT ?`
 	rows, err := db.Query(query, append(args, limit)...)
 	if err == sql.ErrNoRows {
@@ -99,6 +219,7 @@ func getFilteredOffers(db *sql.DB, limit int, querySuffix string, args ...any) (
 
 	for rows.Next() {
 		var offer StoredOffer
+		var methods sql.NullString
 
 		err := rows.Scan(&offer.UserID,
 			&offer.Username,
@@ -106,29 +227,63 @@ func getFilteredOffers(db *sql.DB, limit int, querySuffix string, args ...any) (
 			&offer.WantAmount, &offer.WantCurrency,
 			&offer.ChannelID, &offer.MessageID,
 			&offer.PostedAt,
-			&offer.Reputation)
+			&offer.Reputation,
+			&offer.Location,
+			&methods)
 		if err != nil {
-			log.Printf("Error scanning row: %v", err)
+			slog.Error("Error scanning offer", "err", err)
 			continue
 		}
+		if methods.Valid && methods.String != "" {
+			offer.Methods = strings.Split(methods.String, ",")
+		}
 		offers = append(offers, offer)
 	}
 	return offers, nil
 }
 
-// findMatchingOffers finds offers that match the current offer
-func findMatchingOffers(db *sql.DB, offer ParsedOffer) ([]StoredOffer, error) {
-	var colPrefix string
-	if offer.Type == OfferTypeBuy {
-		// User wants to buy, find sellers
-		colPrefix = "have"
-	} else {
-		colPrefix = "want"
-		// User wants to sell, find buyers
+// placeFilter returns an SQL condition selecting offers located in the city of the place
+// (including its districts) and the arguments for it
+func placeFilter(location string) (string, []any) {
+	codes := cityPlaceCodes(location)
+	args := make([]any, len(codes))
+	for i, c := range codes {
+		args[i] = c
 	}
-	amount := offer.Amount
+	return "o.location IN (" + strings.TrimSuffix(strings.Repeat("?,", len(codes)), ",") + ")", args
+}
+
+// findMatchingOffers finds offers on the opposite side of the current offer,
+// i.e. the ones having what the offer wants and wanting what it has.
+// If the offer lists payment methods, only offers sharing at least one of them
+// or not restricting methods at all are returned.
+// Same goes for the location: offers in another city are skipped.
+// Only offers visible in the chat are matched.
+func findMatchingOffers(db *sql.DB, chatID int64, offer ParsedOffer) ([]StoredOffer, error) {
+	conds := []string{"o.have_currency = ?"}
+	args := []any{offer.WantCurrency}
+	if offer.HaveCurrency != "" {
+		conds = append(conds, "o.want_currency = ?")
+		args = append(args, offer.HaveCurrency)
+	}
+	if len(offer.Methods) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(offer.Methods)), ",")
+		conds = append(conds, `(NOT EXISTS (SELECT 1 FROM offer_methods m WHERE m.offer_id = o.id)
+			OR EXISTS (SELECT 1 FROM offer_methods m WHERE m.offer_id = o.id AND m.method IN (`+placeholders+`)))`)
+		for _, m := range offer.Methods {
+			args = append(args, m)
+		}
+	}
+	if offer.Location != "" {
+		cond, placeArgs := placeFilter(offer.Location)
+		conds = append(conds, "(o.location IS NULL OR "+cond+")")
+		args = append(args, placeArgs...)
+	}
+	cond := strings.Join(conds, " AND ") + " AND o.have_amount_minor >= ?"
+
+	amount := offer.WantAmount
 	for i := 0; i < 2; i++ {
-		r, err := getFilteredOffers(db, 5, "WHERE o."+colPrefix+"_currency = ? AND o."+colPrefix+"_amount >= ?", offer.Currency, amount)
+		r, err := getFilteredOffers(db, chatID, 5, cond, append(args[:len(args):len(args)], amount)...)
 		if err != nil {
 			return nil, fmt.Errorf("error finding matching offers: %v", err)
 		}
@@ -174,7 +329,8 @@ func getDefaultValueForType(sqlType string) string {
 }
 
 // saveReplyMessageID updates reply_message_id for an offer
-func saveReplyMessageID(db *sql.DB, original MessageIndex, replyMessageID int) (int64, error) {
+func saveReplyMessageID(db dbExecutor, original MessageIndex, replyMessageID int) (int64, error) {
+	defer observeQuery("saveReplyMessageID", time.Now())
 	r, err := db.Exec(`INSERT INTO command_replies (channel_id, message_id, reply_message_id)
 						VALUES (?, ?, ?)
 				ON CONFLICT(channel_id, message_id) DO
@@ -189,6 +345,7 @@ func saveReplyMessageID(db *sql.DB, original MessageIndex, replyMessageID int) (
 
 // findReplyMessageID finds the last reply message ID for a given original message ID
 func findReplyMessageID(db *sql.DB, original MessageIndex) (MessageIndex, error) {
+	defer observeQuery("findReplyMessageID", time.Now())
 	var reply MessageIndex
 	err := db.QueryRow(`SELECT reply_message_id FROM command_replies
 	WHERE channel_id = ? AND message_id = ?
@@ -205,9 +362,736 @@ func findReplyMessageID(db *sql.DB, original MessageIndex) (MessageIndex, error)
 }
 
 func deleteOfferByMessage(db *sql.DB, original MessageIndex) error {
-	_, err := db.Exec("DELETE FROM offers WHERE channel_id = ? AND message_id = ?", original.ChannelID, original.MessageID)
+	defer observeQuery("deleteOfferByMessage", time.Now())
+	_, err := db.Exec(`DELETE FROM offer_methods WHERE offer_id IN
+		(SELECT id FROM offers WHERE channel_id = ? AND message_id = ?)`, original.ChannelID, original.MessageID)
+	if err != nil {
+		return fmt.Errorf("error deleting offer methods: %w", err)
+	}
+	_, err = db.Exec("DELETE FROM offers WHERE channel_id = ? AND message_id = ?", original.ChannelID, original.MessageID)
 	if err != nil {
 		return fmt.Errorf("error deleting offer: %w", err)
 	}
 	return nil
 }
+
+// countUserOffers counts offers of the user visible in the chat
+func countUserOffers(db *sql.DB, chatID int64, userID int) (int, error) {
+	defer observeQuery("countUserOffers", time.Now())
+	scope, args := chatOffersFilter(chatID)
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM offers o WHERE o.userid = ? AND "+scope, append([]any{userID}, args...)...).Scan(&n)
+	return n, err
+}
+
+// offerPairCount is the number of offers exchanging a pair of currencies
+type offerPairCount struct {
+	HaveCurrency string
+	WantCurrency string
+	Count        int
+}
+
+// countOpenOffersByPair counts offers of all chats which haven't expired, by currency pair
+func countOpenOffersByPair(db *sql.DB) ([]offerPairCount, error) {
+	defer observeQuery("countOpenOffersByPair", time.Now())
+	rows, err := db.Query(`SELECT COALESCE(o.have_currency, ''), COALESCE(o.want_currency, ''), COUNT(*) FROM offers o
+		WHERE ` + offerNotExpiredCond + ` GROUP BY 1, 2`)
+	if err != nil {
+		return nil, fmt.Errorf("error counting offers: %w", err)
+	}
+	defer rows.Close()
+	var counts []offerPairCount
+	for rows.Next() {
+		var c offerPairCount
+		if err := rows.Scan(&c.HaveCurrency, &c.WantCurrency, &c.Count); err != nil {
+			return nil, fmt.Errorf("error scanning offer count: %w", err)
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// ChatConfig holds settings of a chat; chats without a row in the chats table have the defaults
+type ChatConfig struct {
+	ChatID         int64
+	DefaultCounter string        // counter currency of offers with one side, empty to pick by currency
+	Language       string        // language code of replies
+	OfferTTL       time.Duration // offers older than this are not listed or matched, 0 if they don't expire
+	FreeText       bool          // messages starting with sell or buy are handled as offers
+	Shared         bool          // offers are visible in other shared chats and vice versa
+}
+
+// Language of chats which haven't chosen one
+const defaultChatLanguage = "en"
+
+// getChatConfig returns settings of the chat, the defaults if it has none stored
+func getChatConfig(db *sql.DB, chatID int64) (ChatConfig, error) {
+	defer observeQuery("getChatConfig", time.Now())
+	cfg := ChatConfig{ChatID: chatID, Language: defaultChatLanguage}
+	var counter sql.NullString
+	var ttlSeconds int64
+	err := db.QueryRow(`SELECT default_counter, language, offer_ttl_seconds, free_text, shared FROM chats WHERE chat_id = ?`, chatID).
+		Scan(&counter, &cfg.Language, &ttlSeconds, &cfg.FreeText, &cfg.Shared)
+	if err == sql.ErrNoRows {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("error querying chat settings: %w", err)
+	}
+	cfg.DefaultCounter = counter.String
+	cfg.OfferTTL = time.Duration(ttlSeconds) * time.Second
+	return cfg, nil
+}
+
+// saveChatConfig stores settings of the chat
+func saveChatConfig(db *sql.DB, cfg ChatConfig) error {
+	defer observeQuery("saveChatConfig", time.Now())
+	_, err := db.Exec(`
+		INSERT INTO chats (chat_id, default_counter, language, offer_ttl_seconds, free_text, shared)
+		VALUES (?, NULLIF(?, ''), ?, ?, ?, ?)
+		ON CONFLICT(chat_id) DO UPDATE SET
+			default_counter = excluded.default_counter, language = excluded.language,
+			offer_ttl_seconds = excluded.offer_ttl_seconds, free_text = excluded.free_text,
+			shared = excluded.shared, updated_at = CURRENT_TIMESTAMP`,
+		cfg.ChatID, cfg.DefaultCounter, cfg.Language, int64(cfg.OfferTTL/time.Second), cfg.FreeText, cfg.Shared)
+	if err != nil {
+		return fmt.Errorf("error saving chat settings: %w", err)
+	}
+	return nil
+}
+
+// getChatAdmins returns IDs of users made admins of the chat in addition to its Telegram administrators
+func getChatAdmins(db *sql.DB, chatID int64) ([]int, error) {
+	defer observeQuery("getChatAdmins", time.Now())
+	rows, err := db.Query("SELECT userid FROM chat_admins WHERE chat_id = ? ORDER BY id", chatID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying chat admins: %w", err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("error scanning chat admin: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// setChatAdmin adds the user to admins of the chat or removes them
+func setChatAdmin(db *sql.DB, chatID int64, userID int, admin bool) error {
+	defer observeQuery("setChatAdmin", time.Now())
+	if !admin {
+		_, err := db.Exec("DELETE FROM chat_admins WHERE chat_id = ? AND userid = ?", chatID, userID)
+		return err
+	}
+	return inTx(db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO chats (chat_id) VALUES (?)", chatID); err != nil {
+			return fmt.Errorf("error adding chat: %w", err)
+		}
+		if _, err := tx.Exec("INSERT OR IGNORE INTO chat_admins (chat_id, userid) VALUES (?, ?)", chatID, userID); err != nil {
+			return fmt.Errorf("error adding chat admin: %w", err)
+		}
+		return nil
+	})
+}
+
+// getChatCurrencies returns currencies enabled in the chat, or the default ones if the chat hasn't chosen
+func getChatCurrencies(db *sql.DB, chatID int64) ([]string, error) {
+	defer observeQuery("getChatCurrencies", time.Now())
+	rows, err := db.Query("SELECT currency FROM chat_currencies WHERE chat_id = ? ORDER BY id", chatID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying chat currencies: %w", err)
+	}
+	defer rows.Close()
+	var codes []string
+	for rows.Next() {
+		var code string
+		if err := rows.Scan(&code); err != nil {
+			return nil, fmt.Errorf("error scanning chat currency: %w", err)
+		}
+		if isKnownCurrency(code) {
+			codes = append(codes, code)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(codes) == 0 {
+		return currentCurrencies().defaultEnabled, nil
+	}
+	return codes, nil
+}
+
+// setChatCurrencies replaces the set of currencies enabled in the chat
+func setChatCurrencies(db *sql.DB, chatID int64, codes []string) error {
+	defer observeQuery("setChatCurrencies", time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM chat_currencies WHERE chat_id = ?", chatID); err != nil {
+		return fmt.Errorf("error clearing chat currencies: %w", err)
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO chat_currencies (chat_id, currency) VALUES (?, ?)", chatID, code); err != nil {
+			return fmt.Errorf("error saving chat currency: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// saveRateHistory stores fetched rates along with bank buy/sell rates known for the same currencies
+func saveRateHistory(db *sql.DB, rates map[string]tbcRateCached, commercial map[string]tbcCommercialRateCached) error {
+	defer observeQuery("saveRateHistory", time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for code, r := range rates {
+		var buy, sell any
+		if cr, ok := commercial[code]; ok {
+			buy, sell = cr.Buy, cr.Sell
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO rates_history (currency, value, buy, sell, source, rate_date, fetched_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			code, r.value, buy, sell, r.Source, r.LastUpdated.Format(time.DateOnly), r.LastUpdated.UTC()); err != nil {
+			return fmt.Errorf("error saving rate history: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// latestRateKeySQL orders rows of a currency by rate date, then by insertion.
+// SQLite takes bare columns of a query with a single MAX() from the row with the maximum,
+// so grouping by currency over it selects the latest row in one pass.
+const latestRateKeySQL = "MAX(COALESCE(rate_date, '') || printf('%020d', id))"
+
+// loadLatestRates returns the most recently stored rate of every currency,
+// and the most recently stored bank buy/sell rates.
+// Historical rates fetched on demand are not considered, their fetch time doesn't tell their age.
+func loadLatestRates(db *sql.DB) (map[string]tbcRateCached, map[string]tbcCommercialRateCached, error) {
+	defer observeQuery("loadLatestRates", time.Now())
+	rows, err := db.Query(`
+		SELECT currency, value, source, fetched_at, `+latestRateKeySQL+`
+		FROM rates_history WHERE source != ?
+		GROUP BY currency`, rateSourceNBG)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying latest rates: %w", err)
+	}
+	defer rows.Close()
+	rates := make(map[string]tbcRateCached)
+	for rows.Next() {
+		var code, key string
+		var r tbcRateCached
+		if err := rows.Scan(&code, &r.value, &r.Source, &r.LastUpdated, &key); err != nil {
+			return nil, nil, fmt.Errorf("error scanning latest rates: %w", err)
+		}
+		rates[code] = r
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	crows, err := db.Query(`
+		SELECT currency, buy, sell, fetched_at, ` + latestRateKeySQL + `
+		FROM rates_history WHERE buy IS NOT NULL AND sell IS NOT NULL
+		GROUP BY currency`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error querying latest bank rates: %w", err)
+	}
+	defer crows.Close()
+	commercial := make(map[string]tbcCommercialRateCached)
+	for crows.Next() {
+		var code, key string
+		var r tbcCommercialRateCached
+		if err := crows.Scan(&code, &r.Buy, &r.Sell, &r.LastUpdated, &key); err != nil {
+			return nil, nil, fmt.Errorf("error scanning latest bank rates: %w", err)
+		}
+		commercial[code] = r
+	}
+	return rates, commercial, crows.Err()
+}
+
+// getRatesOnDate returns the latest stored rates effective on the date from the given sources
+func getRatesOnDate(db *sql.DB, date string, sources []string) (map[string]float64, error) {
+	defer observeQuery("getRatesOnDate", time.Now())
+	args := []interface{}{date}
+	for _, s := range sources {
+		args = append(args, s)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(sources)), ",")
+	rows, err := db.Query(`
+		SELECT currency, value FROM rates_history
+		WHERE rate_date = ? AND source IN (`+placeholders+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying rates on %s: %w", date, err)
+	}
+	defer rows.Close()
+	rates := make(map[string]float64)
+	for rows.Next() {
+		var code string
+		var value float64
+		if err := rows.Scan(&code, &value); err != nil {
+			return nil, fmt.Errorf("error scanning rates on %s: %w", date, err)
+		}
+		rates[code] = value // later rows win
+	}
+	return rates, rows.Err()
+}
+
+// saveRatesOnDate stores rates effective on the given date, e.g., historical ones fetched on demand
+func saveRatesOnDate(db *sql.DB, date, source string, rates map[string]float64) error {
+	defer observeQuery("saveRatesOnDate", time.Now())
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for code, value := range rates {
+		if _, err := tx.Exec(`
+			INSERT INTO rates_history (currency, value, source, rate_date) VALUES (?, ?, ?, ?)`,
+			code, value, source, date); err != nil {
+			return fmt.Errorf("error saving rates on %s: %w", date, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// getManualRates returns the rate overrides set by bot admins
+func getManualRates(db *sql.DB) (map[string]float64, error) {
+	defer observeQuery("getManualRates", time.Now())
+	rows, err := db.Query("SELECT currency, value FROM manual_rates")
+	if err != nil {
+		return nil, fmt.Errorf("error querying manual rates: %w", err)
+	}
+	defer rows.Close()
+	rates := make(map[string]float64)
+	for rows.Next() {
+		var code string
+		var value float64
+		if err := rows.Scan(&code, &value); err != nil {
+			return nil, fmt.Errorf("error scanning manual rates: %w", err)
+		}
+		rates[code] = value
+	}
+	return rates, rows.Err()
+}
+
+// saveManualRate stores the rate override of the currency; zero removes the override
+func saveManualRate(db *sql.DB, code string, value float64) error {
+	defer observeQuery("saveManualRate", time.Now())
+	var err error
+	if value <= 0 {
+		_, err = db.Exec("DELETE FROM manual_rates WHERE currency = ?", code)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO manual_rates (currency, value) VALUES (?, ?)
+			ON CONFLICT(currency) DO UPDATE SET value = excluded.value, set_at = CURRENT_TIMESTAMP`, code, value)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving the manual %s rate: %w", code, err)
+	}
+	return nil
+}
+
+// getDailyRates returns the latest stored rate of the currency from the given sources for every date since the given one
+func getDailyRates(db *sql.DB, code, since string, sources []string) (map[string]float64, error) {
+	defer observeQuery("getDailyRates", time.Now())
+	args := []interface{}{code, since}
+	for _, s := range sources {
+		args = append(args, s)
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(sources)), ",")
+	rows, err := db.Query(`
+		SELECT rate_date, value FROM rates_history
+		WHERE currency = ? AND rate_date >= ? AND source IN (`+placeholders+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying %s rates history: %w", code, err)
+	}
+	defer rows.Close()
+	rates := make(map[string]float64)
+	for rows.Next() {
+		var date string
+		var value float64
+		if err := rows.Scan(&date, &value); err != nil {
+			return nil, fmt.Errorf("error scanning %s rates history: %w", code, err)
+		}
+		rates[date] = value // later rows win
+	}
+	return rates, rows.Err()
+}
+
+// offerExchange is an exchange of the currency for another one proposed in an offer
+type offerExchange struct {
+	Date          string  // YYYY-MM-DD the offer was posted on, local
+	Amount        float64 // in major units, as rates are
+	Counter       string
+	CounterAmount float64
+}
+
+// getOfferExchanges returns exchanges of the currency with both amounts known, posted since the date
+// in offers visible in the chat, including expired ones.
+// posted_at is in UTC, the dates are local as rate_date is.
+func getOfferExchanges(db *sql.DB, chatID int64, code, since string) ([]offerExchange, error) {
+	defer observeQuery("getOfferExchanges", time.Now())
+	scope, args := chatOffersFilter(chatID)
+	rows, err := db.Query(`
+		SELECT date(o.posted_at, 'localtime'), o.have_currency, o.have_amount_minor, o.want_currency, o.want_amount_minor FROM offers o
+		WHERE `+scope+` AND (o.have_currency = ? OR o.want_currency = ?) AND o.have_currency != o.want_currency
+			AND o.have_amount_minor > 0 AND o.want_amount_minor > 0 AND date(o.posted_at, 'localtime') >= ?`, append(args, code, code, since)...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying %s offers: %w", code, err)
+	}
+	defer rows.Close()
+	var exchanges []offerExchange
+	for rows.Next() {
+		var date, haveCur, wantCur string
+		var haveAmt, wantAmt Amount
+		if err := rows.Scan(&date, &haveCur, &haveAmt, &wantCur, &wantAmt); err != nil {
+			return nil, fmt.Errorf("error scanning %s offers: %w", code, err)
+		}
+		e := offerExchange{Date: date, Amount: haveAmt.Float(haveCur), Counter: wantCur, CounterAmount: wantAmt.Float(wantCur)}
+		if wantCur == code {
+			e = offerExchange{Date: date, Amount: wantAmt.Float(wantCur), Counter: haveCur, CounterAmount: haveAmt.Float(haveCur)}
+		}
+		exchanges = append(exchanges, e)
+	}
+	return exchanges, rows.Err()
+}
+
+// rateAlert notifies a user when the rate of currency in counter currency crosses the threshold
+type rateAlert struct {
+	ID            int64
+	UserID        int
+	ChatID        int64
+	Currency      string
+	Counter       string
+	Op            string
+	Threshold     float64
+	Recurring     bool
+	Cooldown      time.Duration
+	LastState     bool
+	LastTriggered time.Time
+}
+
+// saveRateAlert stores a new alert and returns its ID
+func saveRateAlert(db dbExecutor, a rateAlert) (int64, error) {
+	defer observeQuery("saveRateAlert", time.Now())
+	result, err := db.Exec(`
+		INSERT INTO rate_alerts (userid, chat_id, currency, counter, op, threshold, recurring, cooldown_seconds)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		a.UserID, a.ChatID, a.Currency, a.Counter, a.Op, a.Threshold, a.Recurring, int64(a.Cooldown/time.Second))
+	if err != nil {
+		return 0, fmt.Errorf("error saving rate alert: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// countRateAlerts returns the number of alerts of the user
+func countRateAlerts(db dbExecutor, userID int) (int, error) {
+	defer observeQuery("countRateAlerts", time.Now())
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM rate_alerts WHERE userid = ?`, userID).Scan(&n); err != nil {
+		return 0, fmt.Errorf("error counting rate alerts: %w", err)
+	}
+	return n, nil
+}
+
+// getRateAlerts returns alerts of the user, or all alerts if userID is 0
+func getRateAlerts(db *sql.DB, userID int) ([]rateAlert, error) {
+	defer observeQuery("getRateAlerts", time.Now())
+	query := `
+		SELECT id, userid, chat_id, currency, counter, op, threshold, recurring, cooldown_seconds, last_state, last_triggered_at
+		FROM rate_alerts`
+	var args []interface{}
+	if userID != 0 {
+		query += " WHERE userid = ?"
+		args = append(args, userID)
+	}
+	rows, err := db.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying rate alerts: %w", err)
+	}
+	defer rows.Close()
+	var alerts []rateAlert
+	for rows.Next() {
+		var a rateAlert
+		var cooldown int64
+		var lastTriggered sql.NullTime
+		if err := rows.Scan(&a.ID, &a.UserID, &a.ChatID, &a.Currency, &a.Counter, &a.Op, &a.Threshold,
+			&a.Recurring, &cooldown, &a.LastState, &lastTriggered); err != nil {
+			return nil, fmt.Errorf("error scanning rate alerts: %w", err)
+		}
+		a.Cooldown = time.Duration(cooldown) * time.Second
+		a.LastTriggered = lastTriggered.Time
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
+
+// updateRateAlertState records the outcome of an alert evaluation
+func updateRateAlertState(db *sql.DB, id int64, state bool, triggeredAt time.Time) error {
+	defer observeQuery("updateRateAlertState", time.Now())
+	var err error
+	if triggeredAt.IsZero() {
+		_, err = db.Exec(`UPDATE rate_alerts SET last_state = ? WHERE id = ?`, state, id)
+	} else {
+		_, err = db.Exec(`UPDATE rate_alerts SET last_state = ?, last_triggered_at = ? WHERE id = ?`, state, triggeredAt.UTC(), id)
+	}
+	if err != nil {
+		return fmt.Errorf("error updating rate alert %d: %w", id, err)
+	}
+	return nil
+}
+
+// resetRateAlertState undoes recording a trigger of the alert whose notification wasn't sent,
+// restoring the previous trigger time, which is NULL if zero
+func resetRateAlertState(db *sql.DB, id int64, lastTriggered time.Time) error {
+	defer observeQuery("resetRateAlertState", time.Now())
+	var triggeredAt sql.NullTime
+	if !lastTriggered.IsZero() {
+		triggeredAt = sql.NullTime{Time: lastTriggered.UTC(), Valid: true}
+	}
+	if _, err := db.Exec(`UPDATE rate_alerts SET last_state = 0, last_triggered_at = ? WHERE id = ?`, triggeredAt, id); err != nil {
+		return fmt.Errorf("error resetting rate alert %d: %w", id, err)
+	}
+	return nil
+}
+
+// deleteRateAlert deletes the alert; userID limits deletion to alerts of that user unless 0.
+// Returns false if there was no such alert.
+func deleteRateAlert(db *sql.DB, id int64, userID int) (bool, error) {
+	defer observeQuery("deleteRateAlert", time.Now())
+	query, args := `DELETE FROM rate_alerts WHERE id = ?`, []interface{}{id}
+	if userID != 0 {
+		query += " AND userid = ?"
+		args = append(args, userID)
+	}
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return false, fmt.Errorf("error deleting rate alert %d: %w", id, err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// apiKey is a key of the HTTP API
+type apiKey struct {
+	ID        int64
+	Name      string
+	ChatID    int64 // offers are listed as in this chat
+	RateLimit int   // requests per minute
+	CreatedAt string
+}
+
+// createAPIKey stores the hash of a new API key
+func createAPIKey(db dbExecutor, keyHash string, key apiKey, createdBy int) (int64, error) {
+	defer observeQuery("createAPIKey", time.Now())
+	result, err := db.Exec(`INSERT INTO api_keys (key_hash, name, chat_id, rate_limit, created_by) VALUES (?, ?, ?, ?, ?)`,
+		keyHash, key.Name, key.ChatID, key.RateLimit, createdBy)
+	if err != nil {
+		return 0, fmt.Errorf("error saving API key: %w", err)
+	}
+	return result.LastInsertId()
+}
+
+// findAPIKey returns the API key which isn't revoked by the hash; found is false if there is none
+func findAPIKey(db *sql.DB, keyHash string) (key apiKey, found bool, err error) {
+	defer observeQuery("findAPIKey", time.Now())
+	err = db.QueryRow(`SELECT id, name, chat_id, rate_limit, created_at FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL`,
+		keyHash).Scan(&key.ID, &key.Name, &key.ChatID, &key.RateLimit, &key.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return key, false, nil
+	}
+	if err != nil {
+		return key, false, fmt.Errorf("error querying API key: %w", err)
+	}
+	return key, true, nil
+}
+
+// getAPIKeys returns the API keys which aren't revoked
+func getAPIKeys(db *sql.DB) ([]apiKey, error) {
+	defer observeQuery("getAPIKeys", time.Now())
+	rows, err := db.Query(`SELECT id, name, chat_id, rate_limit, created_at FROM api_keys WHERE revoked_at IS NULL ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("error querying API keys: %w", err)
+	}
+	defer rows.Close()
+	var keys []apiKey
+	for rows.Next() {
+		var key apiKey
+		if err := rows.Scan(&key.ID, &key.Name, &key.ChatID, &key.RateLimit, &key.CreatedAt); err != nil {
+			return nil, fmt.Errorf("error scanning API key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// revokeAPIKey revokes the API key; returns false if there is no such key which isn't revoked
+func revokeAPIKey(db *sql.DB, id int64) (bool, error) {
+	defer observeQuery("revokeAPIKey", time.Now())
+	result, err := db.Exec("UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL", id)
+	if err != nil {
+		return false, fmt.Errorf("error revoking API key: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// dbExecutor is implemented by both *sql.DB and *sql.Tx, so queries can run in a transaction
+type dbExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// inTx runs fn in a transaction, committing if it succeeds
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			slog.Error("Error rolling back transaction", "err", rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// beginUpdate records that processing of the update started.
+// Returns true if it was already processed completely.
+func beginUpdate(db *sql.DB, updateID int) (done bool, err error) {
+	defer observeQuery("beginUpdate", time.Now())
+	if _, err := db.Exec("INSERT OR IGNORE INTO processed_updates (update_id) VALUES (?)", updateID); err != nil {
+		return false, fmt.Errorf("error recording update %d: %w", updateID, err)
+	}
+	if err := db.QueryRow("SELECT done FROM processed_updates WHERE update_id = ?", updateID).Scan(&done); err != nil {
+		return false, fmt.Errorf("error checking update %d: %w", updateID, err)
+	}
+	return done, nil
+}
+
+// saveReceivedUpdate stores the update before it's acknowledged to Telegram, which doesn't send it again then
+func saveReceivedUpdate(db *sql.DB, update tgbotapi.Update) error {
+	defer observeQuery("saveReceivedUpdate", time.Now())
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("error encoding update %d: %w", update.UpdateID, err)
+	}
+	if _, err := db.Exec("INSERT OR IGNORE INTO processed_updates (update_id, payload) VALUES (?, ?)",
+		update.UpdateID, payload); err != nil {
+		return fmt.Errorf("error saving received update %d: %w", update.UpdateID, err)
+	}
+	return nil
+}
+
+// getUnfinishedUpdates returns stored updates which weren't processed completely, in order
+func getUnfinishedUpdates(db *sql.DB) ([]tgbotapi.Update, error) {
+	defer observeQuery("getUnfinishedUpdates", time.Now())
+	rows, err := db.Query("SELECT update_id, payload FROM processed_updates WHERE done = 0 AND payload IS NOT NULL ORDER BY update_id")
+	if err != nil {
+		return nil, fmt.Errorf("error querying unfinished updates: %w", err)
+	}
+	defer rows.Close()
+	var updates []tgbotapi.Update
+	for rows.Next() {
+		var id int
+		var payload string
+		if err := rows.Scan(&id, &payload); err != nil {
+			return nil, fmt.Errorf("error scanning unfinished updates: %w", err)
+		}
+		var update tgbotapi.Update
+		if err := json.Unmarshal([]byte(payload), &update); err != nil {
+			slog.Warn("Skipping stored update which can't be decoded", "update", id, "err", err)
+			continue
+		}
+		updates = append(updates, update)
+	}
+	return updates, rows.Err()
+}
+
+// finishUpdate records that all effects of the update are done
+func finishUpdate(db *sql.DB, updateID int) error {
+	defer observeQuery("finishUpdate", time.Now())
+	if _, err := db.Exec(`UPDATE processed_updates SET done = 1, finished_at = CURRENT_TIMESTAMP
+		WHERE update_id = ?`, updateID); err != nil {
+		return fmt.Errorf("error finishing update %d: %w", updateID, err)
+	}
+	return nil
+}
+
+// getUpdateEffect returns the recorded effect of the update; found is false if it wasn't recorded
+func getUpdateEffect(db dbExecutor, updateID int, effect string) (chatID int64, messageID int, found bool, err error) {
+	defer observeQuery("getUpdateEffect", time.Now())
+	var chat sql.NullInt64
+	var message sql.NullInt64
+	err = db.QueryRow(`SELECT chat_id, message_id FROM update_effects WHERE update_id = ? AND effect = ?`,
+		updateID, effect).Scan(&chat, &message)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("error getting effect %s of update %d: %w", effect, updateID, err)
+	}
+	return chat.Int64, int(message.Int64), true, nil
+}
+
+// saveUpdateEffect records an effect of the update, with the message it sent if any
+func saveUpdateEffect(db dbExecutor, updateID int, effect string, chatID int64, messageID int) error {
+	defer observeQuery("saveUpdateEffect", time.Now())
+	if _, err := db.Exec(`INSERT INTO update_effects (update_id, effect, chat_id, message_id)
+		VALUES (?, ?, NULLIF(?, 0), NULLIF(?, 0))`, updateID, effect, chatID, messageID); err != nil {
+		return fmt.Errorf("error saving effect %s of update %d: %w", effect, updateID, err)
+	}
+	return nil
+}
+
+// getUpdateObject returns the ID of the object the update stored; found is false if it wasn't stored
+func getUpdateObject(db dbExecutor, updateID int, effect string) (id int64, found bool, err error) {
+	defer observeQuery("getUpdateObject", time.Now())
+	var object sql.NullInt64
+	err = db.QueryRow(`SELECT object_id FROM update_effects WHERE update_id = ? AND effect = ?`,
+		updateID, effect).Scan(&object)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error getting effect %s of update %d: %w", effect, updateID, err)
+	}
+	return object.Int64, true, nil
+}
+
+// saveUpdateObject records that the update stored the object with the ID
+func saveUpdateObject(db dbExecutor, updateID int, effect string, id int64) error {
+	defer observeQuery("saveUpdateObject", time.Now())
+	if _, err := db.Exec(`INSERT INTO update_effects (update_id, effect, object_id) VALUES (?, ?, ?)`,
+		updateID, effect, id); err != nil {
+		return fmt.Errorf("error saving effect %s of update %d: %w", effect, updateID, err)
+	}
+	return nil
+}
+
+// pruneProcessedUpdates deletes records of updates started before the time with their effects
+func pruneProcessedUpdates(db *sql.DB, before time.Time) error {
+	defer observeQuery("pruneProcessedUpdates", time.Now())
+	return inTx(db, func(tx *sql.Tx) error {
+		cutoff := before.UTC().Format(time.DateTime)
+		if _, err := tx.Exec(`DELETE FROM update_effects WHERE update_id IN
+			(SELECT update_id FROM processed_updates WHERE started_at < ?)`, cutoff); err != nil {
+			return fmt.Errorf("error pruning update effects: %w", err)
+		}
+		if _, err := tx.Exec("DELETE FROM processed_updates WHERE started_at < ?", cutoff); err != nil {
+			return fmt.Errorf("error pruning processed updates: %w", err)
+		}
+		return nil
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"log/slog"
+	"os"
 	"strings"
 )
 
@@ -29,7 +31,7 @@ func upsertSavedTableConstraints(db *sql.DB, tableName, constraints string) {
 		tableName, constraints,
 	)
 	if err != nil {
-		log.Panicf("WARNING: Failed to upsert table_settings for %s: %v", tableName, err)
+		log.Panicf("Failed to upsert table_settings for %s: %v", tableName, err)
 	}
 }
 
@@ -51,7 +53,20 @@ func ensureParentUniqueIndexes(db *sql.DB, schemas []TableSchema) {
 			idxName := fmt.Sprintf("uq_%s_%s", col.RefTable, col.RefColumn)
 			stmt := fmt.Sprintf("CREATE UNIQUE INDEX IF NOT EXISTS %s ON %s(%s)", idxName, col.RefTable, col.RefColumn)
 			if _, err := db.Exec(stmt); err != nil {
-				log.Printf("WARNING: Could not ensure unique index %s on %s(%s): %v", idxName, col.RefTable, col.RefColumn, err)
+				slog.Warn("Could not ensure unique index", "index", idxName, "table", col.RefTable, "column", col.RefColumn, "err", err)
+			}
+		}
+	}
+}
+
+// ensureIndexes creates indexes of the tables which don't exist yet
+func ensureIndexes(db *sql.DB, schemas []TableSchema) {
+	for _, schema := range schemas {
+		for _, columns := range schema.Indexes {
+			idxName := "idx_" + schema.Name + "_" + strings.NewReplacer(",", "", " ", "_").Replace(columns)
+			stmt := fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s(%s)", idxName, schema.Name, columns)
+			if _, err := db.Exec(stmt); err != nil {
+				log.Panicf("Error creating index %s: %v", idxName, err)
 			}
 		}
 	}
@@ -59,7 +74,7 @@ func ensureParentUniqueIndexes(db *sql.DB, schemas []TableSchema) {
 
 // updateTableSchema updates a table schema to match the expected schema
 func updateTableSchema(db *sql.DB, schema TableSchema) {
-	log.Printf("Checking schema for table: %s", schema.Name)
+	slog.Debug("Checking schema", "table", schema.Name)
 	// Get current columns
 	currentColumns := getCurrentTableColumns(db, schema.Name)
 
@@ -71,7 +86,7 @@ func updateTableSchema(db *sql.DB, schema TableSchema) {
 		if expectedCol.PrimaryKey {
 			log.Panicf("Primary key column %s is missing in table %s, cannot add it", expectedCol.Name, schema.Name)
 		}
-		log.Printf("Adding missing column %s to table %s", expectedCol.Name, schema.Name)
+		slog.Info("Adding missing column", "table", schema.Name, "column", expectedCol.Name)
 
 		// Compose column definition respecting SQLite ALTER TABLE ADD COLUMN constraints.
 		// If this column declares a foreign key, inline the REFERENCES clause here because
@@ -100,7 +115,7 @@ func updateTableSchema(db *sql.DB, schema TableSchema) {
 		if _, err := db.Exec(alterQuery); err != nil {
 			log.Panicf("error adding column %s to table %s: %v", expectedCol.Name, schema.Name, err)
 		}
-		log.Printf("Successfully added column %s to table %s", expectedCol.Name, schema.Name)
+		slog.Info("Added column", "table", schema.Name, "column", expectedCol.Name)
 	}
 
 	// Check for missing foreign keys (cannot be added post-hoc in SQLite)
@@ -111,8 +126,8 @@ func updateTableSchema(db *sql.DB, schema TableSchema) {
 		if foreignKeyExists(db, schema.Name, col.Name, col.RefTable, col.RefColumn) {
 			continue
 		}
-		log.Printf("WARNING: SQLite cannot add a foreign key on existing table %s.%s -> %s(%s).",
-			schema.Name, col.Name, col.RefTable, col.RefColumn)
+		slog.Warn("SQLite cannot add a foreign key on an existing table",
+			"table", schema.Name, "column", col.Name, "ref", col.RefTable+"("+col.RefColumn+")")
 	}
 
 	// Compare stored table-level constraints with expected ones (if table_settings exists)
@@ -120,11 +135,11 @@ func updateTableSchema(db *sql.DB, schema TableSchema) {
 		stored, err := getSavedTableConstraints(db, schema.Name)
 		if err == nil {
 			if stored != schema.SQLConstraints {
-				log.Printf("WARNING: Stored SQL constraints for table %s differ. Stored: %q, Expected: %q",
-					schema.Name, stored, schema.SQLConstraints)
+				slog.Warn("Stored SQL constraints of the table differ",
+					"table", schema.Name, "stored", stored, "expected", schema.SQLConstraints)
 			}
 		} else {
-			log.Printf("WARNING: Could not read stored constraints for table %s: %v", schema.Name, err)
+			slog.Warn("Could not read stored constraints", "table", schema.Name, "err", err)
 		}
 	}
 }
@@ -171,20 +186,20 @@ func createTable(db *sql.DB, schema TableSchema) bool {
 	}
 	query.WriteString("\n);")
 
-	log.Printf("Executing table creation query for: %s", schema.Name)
+	slog.Debug("Creating table", "table", schema.Name)
 	r, err := db.Exec(query.String())
 	if err != nil {
 		log.Panicf("Error creating table %s: %v", schema.Name, err)
 	}
 	liid, err := r.LastInsertId()
 	if err != nil {
-		log.Printf("Error getting LastInsertId for table %s: %v", schema.Name, err)
+		slog.Warn("Error getting LastInsertId", "table", schema.Name, "err", err)
 	}
 	raff, err := r.RowsAffected()
 	if err != nil {
-		log.Printf("Error getting RowsAffected for table %s: %v", schema.Name, err)
+		slog.Warn("Error getting RowsAffected", "table", schema.Name, "err", err)
 	}
-	log.Printf("Result of creating table %s: %v %v", schema.Name, liid, raff)
+	slog.Debug("Result of creating table", "table", schema.Name, "last_insert_id", liid, "rows_affected", raff)
 	// Short return false if table existed already
 	if rows, err := r.RowsAffected(); err == nil {
 		if rows == 0 {
@@ -197,10 +212,38 @@ func createTable(db *sql.DB, schema TableSchema) bool {
 	return true
 }
 
+// migrateData applies data migrations newer than the stored schema version
+func migrateData(db *sql.DB) {
+	var version int
+	if err := db.QueryRow("SELECT schema_version FROM bot_settings WHERE id = 1").Scan(&version); err != nil {
+		log.Panicf("Error getting schema version: %v", err)
+	}
+	for _, m := range getDataMigrations() {
+		if m.Version <= version {
+			continue
+		}
+		slog.Info("Migrating data", "schema_version", m.Version)
+		tx, err := db.Begin()
+		if err != nil {
+			log.Panicf("Error starting migration to version %d: %v", m.Version, err)
+		}
+		for _, stmt := range append(m.Statements, fmt.Sprintf("UPDATE bot_settings SET schema_version = %d WHERE id = 1", m.Version)) {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				log.Panicf("Error migrating data to version %d: %v", m.Version, err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Panicf("Error committing migration to version %d: %v", m.Version, err)
+		}
+	}
+}
+
 // initDB initializes the database and creates/updates tables
 func initDB(dbPath string) *sql.DB {
-	log.Printf("Initializing database at %s", dbPath)
-	db, err := sql.Open("sqlite3", dbPath)
+	slog.Info("Initializing database", "path", dbPath)
+	// Updates are processed concurrently, wait for the write lock instead of failing
+	db, err := sql.Open("sqlite3", dbPath+"?_busy_timeout=5000")
 	if err != nil {
 		log.Panicf("Error opening database: %v", err)
 	}
@@ -208,7 +251,7 @@ func initDB(dbPath string) *sql.DB {
 	defer func() {
 		if r := recover(); r != nil {
 			db.Close()
-			log.Printf("Database initialization failed: %v", r)
+			slog.Error("Database initialization failed", "err", r)
 			panic(r) // Re-throw the panic after closing the database
 		}
 	}()
@@ -227,14 +270,15 @@ func initDB(dbPath string) *sql.DB {
 	for _, schema := range expectedSchemas {
 		err = verifyTableSchema(db, schema)
 		if err != nil {
-			log.Panicf("Warning: Schema verification failed for table %s: %v", schema.Name, err)
+			log.Panicf("Schema verification failed for table %s: %v", schema.Name, err)
 		} else {
-			log.Printf("Schema verified for table: %s", schema.Name)
+			slog.Debug("Schema verified", "table", schema.Name)
 		}
 	}
 
 	// Ensure parent columns referenced by foreign keys have UNIQUE indexes
 	ensureParentUniqueIndexes(db, expectedSchemas)
+	ensureIndexes(db, expectedSchemas)
 
 	// Set foreign key constraints
 	if _, err = db.Exec("PRAGMA foreign_keys = ON;"); err != nil {
@@ -244,7 +288,74 @@ func initDB(dbPath string) *sql.DB {
 	// Ensure the bot_settings row exists
 	_, err = db.Exec("INSERT OR IGNORE INTO bot_settings (id, schema_version, last_update_id) VALUES (1, ?, 0)", dbSchemaVersion)
 
-	log.Println("Database initialized successfully with schema validation")
+	migrateData(db)
+
+	slog.Info("Database initialized with schema validation")
 
 	return db
 }
+
+// checkDB opens the database read-only and checks that this version of the bot can use it.
+// Returns notes about what initDB would change on start.
+func checkDB(dbPath string) (notes []string, err error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return []string{"the database doesn't exist and will be created on start"}, nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	for _, schema := range getExpectedSchemas() {
+		if len(getCurrentTableColumns(db, schema.Name)) == 0 {
+			notes = append(notes, fmt.Sprintf("table %s will be created on start", schema.Name))
+		} else if err := verifyTableSchema(db, schema); err != nil {
+			notes = append(notes, fmt.Sprintf("table %s will be updated on start: %v", schema.Name, err))
+		}
+	}
+	var version int
+	err = db.QueryRow("SELECT schema_version FROM bot_settings WHERE id = 1").Scan(&version)
+	switch {
+	case err == sql.ErrNoRows:
+		return notes, nil
+	case err != nil && len(notes) > 0:
+		// bot_settings may be created or updated on start
+		return notes, nil
+	case err != nil:
+		return notes, fmt.Errorf("error getting schema version: %v", err)
+	case version > dbSchemaVersion:
+		return notes, fmt.Errorf("schema version %d is newer than %d of this bot", version, dbSchemaVersion)
+	case version < dbSchemaVersion:
+		notes = append(notes, fmt.Sprintf("data will be migrated from schema version %d to %d on start", version, dbSchemaVersion))
+	}
+	return notes, nil
+}
+
+// checkDBCurrencyScales opens the database read-only and checks that the registry keeps minor units
+// of currencies with stored offers, as the bot does on start; checked is false if there is nothing to check yet
+func checkDBCurrencyScales(dbPath string, reg *currencyRegistry) (checked bool, err error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return false, nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro&_busy_timeout=5000")
+	if err != nil {
+		return false, fmt.Errorf("error opening database: %v", err)
+	}
+	defer db.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	// scales are recorded from the stored offers when the table is created on start
+	if len(getCurrentTableColumns(db, "currency_scales")) == 0 {
+		return false, nil
+	}
+	return true, checkCurrencyScales(db, reg)
+}
@@ -1,7 +1,12 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 const (
-	dbSchemaVersion = 1 // Increment this when changing the database schema
+	dbSchemaVersion = 4 // Increment this when changing the database schema
 )
 
 // TableColumn represents a database column definition
@@ -19,7 +24,8 @@ type TableColumn struct {
 type TableSchema struct {
 	Name           string
 	Columns        []TableColumn
-	SQLConstraints string // Additional SQL suffix for the table (e.g., UNIQUE constraints)
+	SQLConstraints string   // Additional SQL suffix for the table (e.g., UNIQUE constraints)
+	Indexes        []string // Columns of each index to create (e.g., "currency, rate_date")
 }
 
 // getExpectedSchemas returns the expected database schemas
@@ -47,6 +53,7 @@ func getExpectedSchemas() []TableSchema {
 				{Name: "reputation", Type: "INTEGER", NotNull: true},
 				{Name: "name", Type: "TEXT", NotNull: true},
 				{Name: "date_added", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
+				{Name: "location", Type: "TEXT"}, // default place code for the user's offers
 			},
 		},
 		{
@@ -66,17 +73,126 @@ func getExpectedSchemas() []TableSchema {
 				{Name: "id", Type: "INTEGER", PrimaryKey: true},
 				{Name: "userid", Type: "INTEGER", NotNull: true, RefTable: "exchangers", RefColumn: "userid"},
 				{Name: "username", Type: "TEXT", NotNull: true},
-				{Name: "have_amount", Type: "REAL"},
+				{Name: "have_amount_minor", Type: "INTEGER", NotNull: true, DefaultValue: "0"}, // in minor units of have_currency
 				{Name: "have_currency", Type: "TEXT"},
-				{Name: "want_amount", Type: "REAL"},
+				{Name: "want_amount_minor", Type: "INTEGER", NotNull: true, DefaultValue: "0"}, // in minor units of want_currency
 				{Name: "want_currency", Type: "TEXT"},
 				{Name: "channel_id", Type: "INTEGER", NotNull: true},
 				{Name: "message_id", Type: "INTEGER", NotNull: true},
 				{Name: "reply_id", Type: "INTEGER", RefTable: "command_replies", RefColumn: "id"},
 				{Name: "posted_at", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
+				{Name: "location", Type: "TEXT"},
 			},
 			SQLConstraints: "UNIQUE(channel_id, message_id)",
 		},
+		{
+			Name: "currency_scales",
+			Columns: []TableColumn{
+				{Name: "currency", Type: "TEXT", PrimaryKey: true},
+				{Name: "minor_units", Type: "INTEGER", NotNull: true}, // of the amounts stored in offers
+			},
+		},
+		{
+			Name: "offer_methods",
+			Columns: []TableColumn{
+				{Name: "id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "offer_id", Type: "INTEGER", NotNull: true, RefTable: "offers", RefColumn: "id"},
+				{Name: "method", Type: "TEXT", NotNull: true},
+			},
+			SQLConstraints: "UNIQUE(offer_id, method)",
+		},
+		{
+			Name: "chats",
+			Columns: []TableColumn{
+				{Name: "chat_id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "default_counter", Type: "TEXT"}, // counter currency of offers with one side, NULL to pick by currency
+				{Name: "language", Type: "TEXT", NotNull: true, DefaultValue: "'en'"},
+				{Name: "offer_ttl_seconds", Type: "INTEGER", NotNull: true, DefaultValue: "0"}, // 0 if offers don't expire
+				{Name: "free_text", Type: "INTEGER", NotNull: true, DefaultValue: "0"},         // messages like "sell 100 USD" are offers
+				{Name: "shared", Type: "INTEGER", NotNull: true, DefaultValue: "0"},            // offers are visible in other shared chats
+				{Name: "updated_at", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
+			},
+		},
+		{
+			Name: "chat_admins",
+			Columns: []TableColumn{
+				{Name: "id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "chat_id", Type: "INTEGER", NotNull: true, RefTable: "chats", RefColumn: "chat_id"},
+				{Name: "userid", Type: "INTEGER", NotNull: true},
+			},
+			SQLConstraints: "UNIQUE(chat_id, userid)",
+		},
+		{
+			Name: "chat_currencies",
+			Columns: []TableColumn{
+				{Name: "id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "chat_id", Type: "INTEGER", NotNull: true},
+				{Name: "currency", Type: "TEXT", NotNull: true},
+			},
+			SQLConstraints: "UNIQUE(chat_id, currency)",
+		},
+		{
+			Name: "rates_history",
+			Columns: []TableColumn{
+				{Name: "id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "currency", Type: "TEXT", NotNull: true},
+				{Name: "value", Type: "REAL", NotNull: true}, // GEL per unit
+				{Name: "buy", Type: "REAL"},                  // bank buy rate, if known
+				{Name: "sell", Type: "REAL"},                 // bank sell rate, if known
+				{Name: "source", Type: "TEXT", NotNull: true},
+				{Name: "rate_date", Type: "TEXT"}, // YYYY-MM-DD the rate is effective on
+				{Name: "fetched_at", Type: "TIMESTAMP", NotNull: true, DefaultValue: "CURRENT_TIMESTAMP"},
+			},
+			Indexes: []string{"currency, source, rate_date, id"},
+		},
+		{
+			Name: "manual_rates",
+			Columns: []TableColumn{
+				{Name: "currency", Type: "TEXT", PrimaryKey: true},
+				{Name: "value", Type: "REAL", NotNull: true}, // GEL per unit, set with /rates set
+				{Name: "set_at", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
+			},
+		},
+		{
+			Name: "rate_alerts",
+			Columns: []TableColumn{
+				{Name: "id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "userid", Type: "INTEGER", NotNull: true},
+				{Name: "chat_id", Type: "INTEGER", NotNull: true}, // private chat to notify
+				{Name: "currency", Type: "TEXT", NotNull: true},
+				{Name: "counter", Type: "TEXT", NotNull: true}, // rate is in counter currency per unit of currency
+				{Name: "op", Type: "TEXT", NotNull: true},      // > or <
+				{Name: "threshold", Type: "REAL", NotNull: true},
+				{Name: "recurring", Type: "INTEGER", NotNull: true, DefaultValue: "0"},
+				{Name: "cooldown_seconds", Type: "INTEGER", NotNull: true, DefaultValue: "0"},
+				{Name: "last_state", Type: "INTEGER", NotNull: true, DefaultValue: "0"}, // whether the condition held at the last evaluation
+				{Name: "last_triggered_at", Type: "TIMESTAMP"},
+				{Name: "created_at", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
+			},
+		},
+		{
+			Name: "processed_updates",
+			Columns: []TableColumn{
+				{Name: "update_id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "done", Type: "INTEGER", NotNull: true, DefaultValue: "0"}, // all effects of the update are recorded
+				{Name: "started_at", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
+				{Name: "finished_at", Type: "TIMESTAMP"},
+				{Name: "payload", Type: "TEXT"}, // JSON of an update received via the webhook, to process it again after a crash
+			},
+		},
+		{
+			Name: "update_effects",
+			Columns: []TableColumn{
+				{Name: "id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "update_id", Type: "INTEGER", NotNull: true, RefTable: "processed_updates", RefColumn: "update_id"},
+				{Name: "effect", Type: "TEXT", NotNull: true}, // e.g., send:1 for the first message sent, offer, alert
+				{Name: "chat_id", Type: "INTEGER"},
+				{Name: "message_id", Type: "INTEGER"}, // of the sent message
+				{Name: "object_id", Type: "INTEGER"},  // of the stored object, e.g., the alert
+				{Name: "created_at", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
+			},
+			SQLConstraints: "UNIQUE(update_id, effect)",
+		},
 		{
 			Name: "reviews",
 			Columns: []TableColumn{
@@ -91,5 +207,84 @@ func getExpectedSchemas() []TableSchema {
 				{Name: "posted_at", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
 			},
 		},
+		{
+			Name: "api_keys",
+			Columns: []TableColumn{
+				{Name: "id", Type: "INTEGER", PrimaryKey: true},
+				{Name: "key_hash", Type: "TEXT", NotNull: true},                          // SHA-256 of the key, the key itself is not stored
+				{Name: "name", Type: "TEXT", NotNull: true},                              // of the partner
+				{Name: "chat_id", Type: "INTEGER", NotNull: true},                        // offers are listed as in this chat
+				{Name: "rate_limit", Type: "INTEGER", NotNull: true, DefaultValue: "60"}, // requests per minute
+				{Name: "created_by", Type: "INTEGER", NotNull: true},
+				{Name: "created_at", Type: "TIMESTAMP", DefaultValue: "CURRENT_TIMESTAMP"},
+				{Name: "revoked_at", Type: "TIMESTAMP"},
+			},
+			SQLConstraints: "UNIQUE(key_hash)",
+		},
+	}
+}
+
+// dataMigration updates data of databases created with an older schema version
+type dataMigration struct {
+	Version    int // schema version the migration brings the data to
+	Statements []string
+}
+
+// getDataMigrations returns data migrations in the order of versions
+func getDataMigrations() []dataMigration {
+	return []dataMigration{
+		{
+			// Russian ruble is stored under its ISO 4217 code
+			Version: 2,
+			Statements: []string{
+				"UPDATE offers SET have_currency = 'RUB' WHERE have_currency = 'RUR'",
+				"UPDATE offers SET want_currency = 'RUB' WHERE want_currency = 'RUR'",
+			},
+		},
+		{
+			// Amounts are stored as integer minor units instead of REAL have_amount and want_amount
+			Version: 3,
+			Statements: []string{
+				"UPDATE offers SET have_amount_minor = CAST(ROUND(have_amount * " + minorUnitsFactorSQL("have_currency") + ") AS INTEGER) WHERE have_amount IS NOT NULL",
+				"UPDATE offers SET want_amount_minor = CAST(ROUND(want_amount * " + minorUnitsFactorSQL("want_currency") + ") AS INTEGER) WHERE want_amount IS NOT NULL",
+			},
+		},
+		{
+			// Minor units of stored amounts are recorded, so currencies.json can't change them
+			Version: 4,
+			Statements: []string{
+				"INSERT OR IGNORE INTO currency_scales (currency, minor_units) SELECT DISTINCT have_currency, " + minorUnitsSQL("have_currency") + " FROM offers WHERE have_currency IS NOT NULL",
+				"INSERT OR IGNORE INTO currency_scales (currency, minor_units) SELECT DISTINCT want_currency, " + minorUnitsSQL("want_currency") + " FROM offers WHERE want_currency IS NOT NULL",
+			},
+		},
+	}
+}
+
+// minorUnitsFactorSQL returns an SQL expression for 10^(minor units) of the currency in the column,
+// per the built-in currency table
+func minorUnitsFactorSQL(column string) string {
+	var sb strings.Builder
+	sb.WriteString("CASE " + column)
+	for _, spec := range currencySpecs {
+		if spec.MinorUnits != 2 {
+			sb.WriteString(fmt.Sprintf(" WHEN '%s' THEN %s", spec.Code, pow10(spec.MinorUnits)))
+		}
+	}
+	sb.WriteString(" ELSE 100 END")
+	return sb.String()
+}
+
+// minorUnitsSQL returns an SQL expression for minor units of the currency in the column,
+// per the currency registry in effect
+func minorUnitsSQL(column string) string {
+	reg := currentCurrencies()
+	var sb strings.Builder
+	sb.WriteString("CASE " + column)
+	for i, code := range reg.codes {
+		if reg.minorUnits[i] != 2 {
+			sb.WriteString(fmt.Sprintf(" WHEN '%s' THEN %d", code, reg.minorUnits[i]))
+		}
 	}
+	sb.WriteString(" ELSE 2 END")
+	return sb.String()
 }
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"math/big"
+	"os"
+	"os/signal"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
@@ -24,10 +33,12 @@ const (
 )
 
 type ParsedOffer struct {
-	HaveAmount   float64
+	HaveAmount   Amount
 	HaveCurrency string
-	WantAmount   float64
+	WantAmount   Amount
 	WantCurrency string
+	Methods      []string // payment method codes, empty if any method is fine
+	Location     string   // place code, empty if not specified
 }
 
 type MessageIndex struct {
@@ -44,68 +55,89 @@ func parseNum(s string) (float64, error) {
 var reAmountThenCurrency = regexp.MustCompile(`([0-9]+(?:[.,][0-9]+)?)([\w$₾лрд.])`)
 var reCurrencyThenAmount = regexp.MustCompile(`([\w$₾лрд.][^0-9]*)([0-9]+(?:[.,][0-9]+)?)`)
 
-func checkJoinedAmountThenCurrency(s string) (string, float64) {
+func checkJoinedAmountThenCurrency(s string) (string, *big.Rat) {
 	// Check if currency and amount are in one token: 100USD or $100
 	m := reAmountThenCurrency.FindStringSubmatch(s)
 	if m == nil {
-		return "", 0
+		return "", nil
 	}
-	n, err := parseNum(m[1])
-	if err != nil || n == 0 {
-		return "", 0
+	n, err := parseDecimal(m[1])
+	if err != nil || n.Sign() == 0 {
+		return "", nil
 	}
 	c, ok := normalizeCurrency(m[2])
 	if !ok {
-		return "", 0
+		return "", nil
 	}
 	return c, n
 }
 
-func checkJoinedCurrencyThenAmount(s string) (string, float64) {
+func checkJoinedCurrencyThenAmount(s string) (string, *big.Rat) {
 	// Check if currency and amount are in one token: USD100 or $100
 	m := reCurrencyThenAmount.FindStringSubmatch(s)
 	if m == nil {
-		return "", 0
+		return "", nil
 	}
-	n, err := parseNum(m[2])
-	if err != nil || n == 0 {
-		return "", 0
+	n, err := parseDecimal(m[2])
+	if err != nil || n.Sign() == 0 {
+		return "", nil
 	}
 	c, ok := normalizeCurrency(m[1])
 	if !ok {
-		return "", 0
+		return "", nil
 	}
 	return c, n
 }
 
-func findOfferTokenPurpose(s string) (string, float64) {
+// findOfferTokenPurpose returns the currency and the exact amount in the token, nil if there is no amount
+func findOfferTokenPurpose(s string) (string, *big.Rat) {
 	// Try amount+currency joined
-	if c, n := checkJoinedAmountThenCurrency(s); n > 0 {
+	if c, n := checkJoinedAmountThenCurrency(s); n != nil {
 		return c, n
 	}
-	if c, n := checkJoinedCurrencyThenAmount(s); n > 0 {
+	if c, n := checkJoinedCurrencyThenAmount(s); n != nil {
 		return c, n
 	}
 
 	// Try separate amount or currency
-	if n, err := parseNum(s); err == nil && n > 0 {
+	if n, err := parseDecimal(s); err == nil && n.Sign() > 0 {
 		return "", n
 	}
 	if c, ok := normalizeCurrency(s); ok {
-		return c, 0
+		return c, nil
 	}
-	return "", 0
+	return "", nil
 }
 
-// parseOfferCommand parses /buy or /sell commands with amount and currency
-func parseOfferCommand(message *tgbotapi.Message) (ParsedOffer, error) {
-	parts := strings.Fields(message.CommandArguments())
+// Token purposes reported by parseOfferText
+const (
+	tokenAmount         = "amount"
+	tokenCurrency       = "currency"
+	tokenAmountCurrency = "amount+currency"
+	tokenMethod         = "payment method"
+	tokenPlace          = "place"
+	tokenIgnored        = "ignored"
+)
+
+// offerToken describes how the offer parser interpreted a token (or a multi-word phrase)
+type offerToken struct {
+	Text     string
+	Purpose  string
+	Side     int // 0 for the first currency/amount pair, 1 for the second
+	Currency string
+	Amount   *big.Rat // as written, before rounding to the currency precision
+	Code     string   // payment method or place code
+}
+
+// parseOfferText parses arguments of the /buy or /sell command.
+// Along with the offer it returns how each token was interpreted,
+// up to the one which caused the error if there was any.
+func parseOfferText(command string, arguments string) (ParsedOffer, []offerToken, error) {
+	parts := strings.Fields(arguments)
 	if len(parts) == 0 {
-		return ParsedOffer{}, fmt.Errorf("insufficient parameters")
+		return ParsedOffer{}, nil, fmt.Errorf("insufficient parameters")
 	}
 
-	// Command() already returns without the leading '/'
-	command := message.Command()
 	var offerType OfferType
 	switch command {
 	case OfferTypeSellName:
@@ -113,66 +145,189 @@ func parseOfferCommand(message *tgbotapi.Message) (ParsedOffer, error) {
 	case OfferTypeBuyName:
 		offerType = OfferTypeBuy
 	default:
-		return ParsedOffer{}, fmt.Errorf("unknown offer type: %s", command)
+		return ParsedOffer{}, nil, fmt.Errorf("unknown offer type: %s", command)
 	}
 
-	// [sum] currency [[sum] currency]
-	// currency [sum] [currency [sum]]
+	// [sum] currency [[sum] currency] [method...]
+	// currency [sum] [currency [sum]] [method...]
 	index := 0
 	currency := make([]string, 2)
-	amount := make([]float64, 2)
-	for _, p := range parts {
-		lp := strings.ToLower(strings.TrimSpace(p))
-		c, v := findOfferTokenPurpose(lp)
+	amount := make([]*big.Rat, 2)
+	var methods []string
+	var location string
+	trace := make([]offerToken, 0, len(parts))
+	tokens := make([]string, len(parts))
+	for i, p := range parts {
+		tokens[i] = strings.ToLower(strings.TrimSpace(p))
+	}
+	for i := 0; i < len(tokens); i++ {
+		if m, n := matchPaymentMethod(tokens, i); n > 0 {
+			trace = append(trace, offerToken{Text: strings.Join(parts[i:i+n], " "), Purpose: tokenMethod, Code: m})
+			methods = appendUniqueMethod(methods, m)
+			i += n - 1
+			continue
+		}
+		if p, n := matchPlace(tokens, i); n > 0 {
+			trace = append(trace, offerToken{Text: strings.Join(parts[i:i+n], " "), Purpose: tokenPlace, Code: p})
+			merged, ok := mergePlaces(location, p)
+			if !ok {
+				return ParsedOffer{}, trace, fmt.Errorf("too many locations")
+			}
+			location = merged
+			i += n - 1
+			continue
+		}
+		c, v := findOfferTokenPurpose(tokens[i])
+		trace = append(trace, offerToken{Text: parts[i], Purpose: tokenPurposeName(c, v != nil), Currency: c, Amount: v})
 		if c != "" {
 			if currency[index] != "" {
 				index += 1
 				if index > 1 {
-					return ParsedOffer{}, fmt.Errorf("too many currencies")
+					trace[len(trace)-1].Side = index
+					return ParsedOffer{}, trace, fmt.Errorf("too many currencies: %q is the third one", parts[i])
 				}
-				currency[index] = c
 			}
+			currency[index] = c
 		}
-		if v != 0 {
-			if amount[index] != 0 {
-				return ParsedOffer{}, fmt.Errorf("first currency must be specified before second")
+		if v != nil {
+			if amount[index] != nil {
+				// A complete side is followed by the amount of the second one
+				if currency[index] == "" {
+					return ParsedOffer{}, trace, fmt.Errorf("first currency must be specified before second")
+				}
+				index += 1
+				if index > 1 {
+					trace[len(trace)-1].Side = index
+					return ParsedOffer{}, trace, fmt.Errorf("too many amounts: %q is the third one", parts[i])
+				}
 			}
 			amount[index] = v
 		}
+		trace[len(trace)-1].Side = index
 	}
-	if currency[1] == "" && amount[1] != 0 {
-		return ParsedOffer{}, fmt.Errorf("second currency must be specified if second amount is given")
+	if currency[1] == "" && amount[1] != nil {
+		return ParsedOffer{}, trace, fmt.Errorf("second currency must be specified if second amount is given")
 	}
 
 	// at least one amount must be provided
-	if amount[0] == 0 && amount[1] == 0 {
-		return ParsedOffer{}, fmt.Errorf("at least one amount must be specified")
+	if amount[0] == nil && amount[1] == nil {
+		return ParsedOffer{}, trace, fmt.Errorf("at least one amount must be specified")
+	}
+	if currency[0] == "" {
+		return ParsedOffer{}, trace, fmt.Errorf("currency must be specified")
+	}
+	var exact [2]Amount
+	for side, a := range amount {
+		if a == nil {
+			continue
+		}
+		var err error
+		if exact[side], err = amountFromDecimal(a, currency[side]); err != nil {
+			return ParsedOffer{}, trace, err
+		}
 	}
 
 	if offerType == OfferTypeBuy {
 		// Reverse for buy
 		return ParsedOffer{
-			HaveAmount:   amount[1],
+			HaveAmount:   exact[1],
 			HaveCurrency: currency[1],
-			WantAmount:   amount[0],
+			WantAmount:   exact[0],
 			WantCurrency: currency[0],
-		}, nil
+			Methods:      methods,
+			Location:     location,
+		}, trace, nil
 	}
 	// Sell
 	return ParsedOffer{
-		HaveAmount:   amount[0],
+		HaveAmount:   exact[0],
 		HaveCurrency: currency[0],
-		WantAmount:   amount[1],
+		WantAmount:   exact[1],
 		WantCurrency: currency[1],
-	}, nil
+		Methods:      methods,
+		Location:     location,
+	}, trace, nil
+}
+
+// tokenPurposeName names the result of findOfferTokenPurpose
+func tokenPurposeName(currency string, hasAmount bool) string {
+	switch {
+	case currency != "" && hasAmount:
+		return tokenAmountCurrency
+	case currency != "":
+		return tokenCurrency
+	case hasAmount:
+		return tokenAmount
+	}
+	return tokenIgnored
 }
 
 type BotContext struct {
-	bot      *tgbotapi.BotAPI
+	bot      telegramClient
 	db       *sql.DB
 	settings *Settings
-	commands map[string]func(*tgbotapi.Message, MessageIndex) error
+	commands map[string]func(*BotContext, *tgbotapi.Message, MessageIndex) error
 	rates    *tbcRateCache
+	update   *updateScope // the update being processed, set on the per-update copy of the context
+	logger   *slog.Logger // logs with attributes of the update being processed
+}
+
+// updateScope tracks effects of the update being processed, so they are not repeated
+// when the update is processed again after a restart
+type updateScope struct {
+	id    int
+	sends int // messages sent so far
+}
+
+// Effects recorded when an update stores an object, so it's stored once
+const (
+	effectOffer  = "offer"  // the offer of /buy or /sell
+	effectAlert  = "alert"  // the rate alert of /alert
+	effectAPIKey = "apikey" // the API key of /apikey add
+)
+
+// send sends the message once per update: when the update is processed again, e.g., after a crash,
+// messages it has already sent are not sent again, and their recorded IDs are returned instead.
+// Effects are recorded right after sending, so a crash in between may still repeat a message.
+func (ctx *BotContext) send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	if ctx.update == nil {
+		return ctx.bot.Send(c)
+	}
+	ctx.update.sends++
+	effect := sendEffect(ctx.update.sends)
+	chatID, messageID, found, err := getUpdateEffect(ctx.db, ctx.update.id, effect)
+	if err != nil {
+		ctx.logger.Error("Error checking whether the message was sent", "err", err)
+	} else if found {
+		ctx.logger.Info("Update already sent the message, not sending it again", "message", messageID)
+		return tgbotapi.Message{MessageID: messageID, Chat: &tgbotapi.Chat{ID: chatID}}, nil
+	}
+	sent, err := ctx.bot.Send(c)
+	if err != nil {
+		return sent, err
+	}
+	if sent.Chat != nil {
+		chatID = sent.Chat.ID
+	}
+	if err := saveUpdateEffect(ctx.db, ctx.update.id, effect, chatID, sent.MessageID); err != nil {
+		ctx.logger.Error("Error recording sent message", "err", err)
+	}
+	return sent, nil
+}
+
+// sendEffect is the effect recorded when the update sends its n-th message
+func sendEffect(n int) string {
+	return fmt.Sprintf("send:%d", n)
+}
+
+// nextSendDone reports whether the next message of the update was already sent by an earlier attempt,
+// so the next ctx.send won't send it again
+func (ctx *BotContext) nextSendDone() (bool, error) {
+	if ctx.update == nil {
+		return false, nil
+	}
+	_, _, found, err := getUpdateEffect(ctx.db, ctx.update.id, sendEffect(ctx.update.sends+1))
+	return found, err
 }
 
 // createOfferKeyboard creates inline keyboard for offer interactions
@@ -188,8 +343,25 @@ func createOfferKeyboard(userID int) tgbotapi.InlineKeyboardMarkup {
 	return keyboard
 }
 
-// sendReply sends a reply message to the original message
-func (ctx *BotContext) sendReply(original *tgbotapi.Message, replyText string) (int64, error) {
+// storeOnce runs store in a transaction recording the effect of the update with the ID of the stored object.
+// If the update already stored it, e.g., before a crash, store isn't run, and the recorded ID is returned with found.
+func (ctx *BotContext) storeOnce(effect string, store func(tx *sql.Tx) (int64, error)) (id int64, found bool, err error) {
+	err = inTx(ctx.db, func(tx *sql.Tx) error {
+		if ctx.update != nil {
+			if id, found, err = getUpdateObject(tx, ctx.update.id, effect); err != nil || found {
+				return err
+			}
+		}
+		if id, err = store(tx); err != nil || ctx.update == nil {
+			return err
+		}
+		return saveUpdateObject(tx, ctx.update.id, effect, id)
+	})
+	return id, found, err
+}
+
+// newReply creates a plain text reply to the original message
+func newReply(original *tgbotapi.Message, replyText string) tgbotapi.MessageConfig {
 	msg := tgbotapi.NewMessage(original.Chat.ID, replyText)
 	msg.ReplyToMessageID = original.MessageID
 	// Some channel posts may have nil From; only attach keyboard when we have a user ID
@@ -197,8 +369,12 @@ func (ctx *BotContext) sendReply(original *tgbotapi.Message, replyText string) (
 		msg.ReplyMarkup = createOfferKeyboard(original.From.ID)
 	}
 	// Avoid Markdown/HTML parse errors by sending plain text
+	return msg
+}
 
-	sent, err := ctx.bot.Send(msg)
+// sendReply sends a reply message to the original message
+func (ctx *BotContext) sendReply(original *tgbotapi.Message, replyText string) (int64, error) {
+	sent, err := ctx.send(newReply(original, replyText))
 	if err != nil {
 		return 0, err
 	}
@@ -207,14 +383,31 @@ func (ctx *BotContext) sendReply(original *tgbotapi.Message, replyText string) (
 	replyID, err := saveReplyMessageID(ctx.db, MessageIndex{ChannelID: original.Chat.ID,
 		MessageID: original.MessageID}, sent.MessageID)
 	if err != nil {
-		ctx.logToTelegramAndConsole(fmt.Errorf("Error saving reply_message_id: %w", err).Error())
+		ctx.logger.Error("Error saving reply message ID", "err", err)
 	}
 	return replyID, nil
 }
 
-// handleBuySellCommand handles /buy command
+// handleBuySellCommand handles /buy and /sell commands
 func (ctx *BotContext) handleBuySellCommand(message *tgbotapi.Message, update MessageIndex) error {
-	offer, err := parseOfferCommand(message)
+	// Command() already returns without the leading '/'
+	return ctx.postOffer(message, message.Command(), message.CommandArguments())
+}
+
+// postOffer parses the offer of the buy or sell command, saves it and posts matching offers
+func (ctx *BotContext) postOffer(message *tgbotapi.Message, command, arguments string) error {
+	enabled, err := getChatCurrencies(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	chatConfig, err := getChatConfig(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	offer, _, err := parseOfferText(command, arguments)
+	if err == nil {
+		err = checkCurrenciesEnabled(enabled, offer.HaveCurrency, offer.WantCurrency)
+	}
 	if err != nil {
 		reply := tgbotapi.NewMessage(message.Chat.ID, fmt.Sprintf(
 			"%s\n\nUsage examples (/sell / /buy):\n"+
@@ -222,24 +415,27 @@ func (ctx *BotContext) handleBuySellCommand(message *tgbotapi.Message, update Me
 				"- /sell 100 $ for GEL\n"+
 				"- /sell $ 100 - GEL 270\n"+
 				"- /sell 100 долл за 270 лар\n"+
-				"- /sell 100 USD\n\n"+
+				"- /sell 100 USD\n"+
+				"- /sell 100 USD GEL cash TBC\n"+
+				"- /buy 500 GEL cash Batumi\n\n"+
 				"You can put amount before or after currency on each side; "+
 				"connectors like 'for', 'за', '-' are ignored. "+
 				"In /sell, first currency is what you have, second is what you want. "+
 				"In /buy, it's reverse. "+
-				"If one amount is omitted, it's calculated automatically.",
-			err.Error(), optionsForError(),
+				"If one amount is omitted, it's calculated automatically. "+
+				"Payment methods (cash, card, TBC, BoG, SBP, USDT TRC20...) and the city or district can be listed anywhere; "+
+				"without a place, your /location is used.\n\n%s",
+			err.Error(), optionsForError(enabled),
 		))
 		reply.ReplyToMessageID = message.MessageID
-		_, sendErr := ctx.bot.Send(reply)
+		_, sendErr := ctx.send(reply)
 		return sendErr
 	}
 
 	// Get user reputation
 	reputation, err := getUserReputation(ctx.db, message.From.ID)
-	if err != nil {
-		log.Printf("Error getting user reputation: %v", err)
-		reputation = 0
+	if err != nil && err != sql.ErrNoRows {
+		ctx.logger.Error("Error getting user reputation", "err", err)
 	}
 
 	channelID := message.Chat.ID
@@ -259,57 +455,496 @@ func (ctx *BotContext) handleBuySellCommand(message *tgbotapi.Message, update Me
 	storedOffer.HaveAmount = offer.HaveAmount
 	storedOffer.WantCurrency = offer.WantCurrency
 	storedOffer.WantAmount = offer.WantAmount
-	// Compute missing side
+	storedOffer.Methods = offer.Methods
+	storedOffer.Location = offer.Location
+	if storedOffer.Location == "" {
+		if storedOffer.Location, err = getUserLocation(ctx.db, message.From.ID); err != nil {
+			ctx.logger.Error("Error getting user location", "err", err)
+		}
+	}
+	// Compute missing side; /buy has the amount on the want side
+	rateNote := ""
 	if storedOffer.WantAmount == 0 {
-		if wantCur, wantAmt, err := ctx.rates.computeCounterAmount(storedOffer.HaveCurrency, storedOffer.WantCurrency, storedOffer.HaveAmount); err == nil {
+		if storedOffer.WantCurrency == "" {
+			storedOffer.WantCurrency = chatConfig.counterCurrency(storedOffer.HaveCurrency, enabled)
+		}
+		if wantCur, wantAmt, asOf, err := ctx.rates.computeCounterAmount(storedOffer.HaveCurrency, storedOffer.WantCurrency, storedOffer.HaveAmount); err == nil {
 			storedOffer.WantCurrency = wantCur
 			storedOffer.WantAmount = wantAmt
+			rateNote = rateWarning(asOf)
 		} else {
-			ctx.logToTelegramAndConsole(fmt.Sprintf("Error computing amount for offer: %v", err))
+			ctx.logger.Warn("Error computing amount for offer", "err", err)
 		}
+	} else if storedOffer.HaveAmount == 0 {
+		if storedOffer.HaveCurrency == "" {
+			storedOffer.HaveCurrency = chatConfig.counterCurrency(storedOffer.WantCurrency, enabled)
+		}
+		if haveCur, haveAmt, asOf, err := ctx.rates.computeCounterAmount(storedOffer.WantCurrency, storedOffer.HaveCurrency, storedOffer.WantAmount); err == nil {
+			storedOffer.HaveCurrency = haveCur
+			storedOffer.HaveAmount = haveAmt
+			rateNote = rateWarning(asOf)
+		} else {
+			ctx.logger.Warn("Error computing amount for offer", "err", err)
+		}
+	}
+	offerText := ctx.formatOffer(nil, storedOffer)
+	if rateNote != "" {
+		offerText.WriteString("\n" + rateNote)
 	}
-	offerText := storedOfferToStringBuilder(nil, storedOffer)
 
-	replyID, err := ctx.sendReply(message, offerText.String())
+	sent, err := ctx.send(newReply(message, offerText.String()))
 	if err != nil {
 		return err
 	}
 
-	// Save offer to database
-	_, err = saveOffer(ctx.db, NewOffer{
-		UserID:       message.From.ID,
-		Username:     message.From.UserName,
-		HaveAmount:   storedOffer.HaveAmount,
-		HaveCurrency: storedOffer.HaveCurrency,
-		WantAmount:   storedOffer.WantAmount,
-		WantCurrency: storedOffer.WantCurrency,
-		ChannelID:    channelID,
-		MessageID:    message.MessageID,
-		ReplyID:      replyID,
+	// Save the reply and the offer to database along with the effect, so the offer is saved once
+	_, _, err = ctx.storeOnce(effectOffer, func(tx *sql.Tx) (int64, error) {
+		replyID, err := saveReplyMessageID(tx, MessageIndex{ChannelID: channelID, MessageID: message.MessageID}, sent.MessageID)
+		if err != nil {
+			return 0, err
+		}
+		return saveOffer(tx, NewOffer{
+			UserID:       message.From.ID,
+			Username:     message.From.UserName,
+			HaveAmount:   storedOffer.HaveAmount,
+			HaveCurrency: storedOffer.HaveCurrency,
+			WantAmount:   storedOffer.WantAmount,
+			WantCurrency: storedOffer.WantCurrency,
+			ChannelID:    channelID,
+			MessageID:    message.MessageID,
+			ReplyID:      replyID,
+			Methods:      storedOffer.Methods,
+			Location:     storedOffer.Location,
+		})
 	})
 	if err != nil {
-		ctx.logToTelegramAndConsole(fmt.Sprintf("Error saving offer: %v", err))
+		ctx.logger.Error("Error saving offer", "err", err)
 		return err
 	}
 
 	// Find and post matching offers
-	matches, err := findMatchingOffers(ctx.db, offer)
+	matches, err := findMatchingOffers(ctx.db, channelID, ParsedOffer{
+		HaveAmount:   storedOffer.HaveAmount,
+		HaveCurrency: storedOffer.HaveCurrency,
+		WantAmount:   storedOffer.WantAmount,
+		WantCurrency: storedOffer.WantCurrency,
+		Methods:      storedOffer.Methods,
+		Location:     storedOffer.Location,
+	})
 	if err != nil {
-		log.Printf("Error finding matches: %v", err)
+		ctx.logger.Error("Error finding matches", "err", err)
 		return nil
 	}
 
 	for _, match := range matches {
-		matchesText := storedOfferToStringBuilder(nil, match)
+		matchesText := ctx.formatOffer(nil, match)
 
 		keyboard := createOfferKeyboard(match.UserID)
 		matchMsg := tgbotapi.NewMessage(channelID, matchesText.String())
 		matchMsg.ReplyMarkup = keyboard
-		if _, err = ctx.bot.Send(matchMsg); err != nil {
-			log.Printf("Error sending match: %v", err)
+		if _, err = ctx.send(matchMsg); err != nil {
+			ctx.logger.Error("Error sending match", "err", err)
+		}
+	}
+
+	return nil
+}
+
+// handleParseCommand handles /parse: explains how an offer text would be interpreted without saving it.
+// The text may start with buy or sell, otherwise it is parsed as /sell.
+func (ctx *BotContext) handleParseCommand(message *tgbotapi.Message, update MessageIndex) error {
+	arguments := strings.TrimSpace(message.CommandArguments())
+	command := OfferTypeSellName
+	first, rest, _ := strings.Cut(arguments, " ")
+	switch strings.ToLower(strings.TrimPrefix(first, "/")) {
+	case OfferTypeSellName:
+		arguments = rest
+	case OfferTypeBuyName:
+		command = OfferTypeBuyName
+		arguments = rest
+	}
+
+	enabled, err := getChatCurrencies(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	chatConfig, err := getChatConfig(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	offer, trace, err := parseOfferText(command, arguments)
+	if err == nil {
+		err = checkCurrenciesEnabled(enabled, offer.HaveCurrency, offer.WantCurrency)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Parsing as /%s %s\n\n", command, arguments))
+	for _, t := range trace {
+		sb.WriteString(fmt.Sprintf("%q: %s", t.Text, t.Purpose))
+		switch t.Purpose {
+		case tokenAmount:
+			sb.WriteString(" " + formatDecimal(t.Amount))
+		case tokenCurrency:
+			sb.WriteString(" " + t.Currency)
+		case tokenAmountCurrency:
+			sb.WriteString(fmt.Sprintf(" %s %s", formatDecimal(t.Amount), t.Currency))
+		case tokenMethod:
+			sb.WriteString(" " + formatPaymentMethods([]string{t.Code}))
+		case tokenPlace:
+			sb.WriteString(" " + formatPlace(t.Code))
+		}
+		if t.Purpose != tokenIgnored && t.Purpose != tokenMethod && t.Purpose != tokenPlace {
+			sb.WriteString(fmt.Sprintf(" (side %d)", t.Side+1))
+		}
+		sb.WriteString("\n")
+	}
+	if err != nil {
+		sb.WriteString("\nError: " + err.Error())
+		return ctx.sendExplanation(message, sb.String())
+	}
+
+	sb.WriteString("\nHas: " + formatParsedSide(offer.HaveAmount, offer.HaveCurrency))
+	sb.WriteString("\nWants: " + formatParsedSide(offer.WantAmount, offer.WantCurrency))
+	if len(offer.Methods) > 0 {
+		sb.WriteString("\nPayment methods: " + formatPaymentMethods(offer.Methods))
+	}
+	if offer.Location != "" {
+		sb.WriteString("\nLocation: " + formatPlace(offer.Location))
+	}
+	if offer.WantAmount == 0 {
+		if offer.WantCurrency == "" {
+			offer.WantCurrency = chatConfig.counterCurrency(offer.HaveCurrency, enabled)
+		}
+		sb.WriteString("\nCounter amount: ")
+		if ctx.rates == nil {
+			sb.WriteString("not available, rates cache is not initialized")
+		} else if cur, amt, asOf, err := ctx.rates.computeCounterAmount(offer.HaveCurrency, offer.WantCurrency, offer.HaveAmount); err != nil {
+			sb.WriteString("not available, " + err.Error())
+		} else {
+			sb.WriteString(formatAmount(amt, cur) + " " + formatCodeWithRep(cur))
+			if note := rateWarning(asOf); note != "" {
+				sb.WriteString("\n" + note)
+			}
+		}
+	}
+	return ctx.sendExplanation(message, sb.String())
+}
+
+// sendExplanation replies with plain text; unlike sendReply, it attaches no offer keyboard
+// and records no reply, so editing the original message doesn't treat it as an offer
+func (ctx *BotContext) sendExplanation(original *tgbotapi.Message, text string) error {
+	msg := tgbotapi.NewMessage(original.Chat.ID, text)
+	msg.ReplyToMessageID = original.MessageID
+	_, err := ctx.send(msg)
+	return err
+}
+
+// formatParsedSide formats one side of a parsed offer, with placeholders for omitted parts
+func formatParsedSide(amount Amount, currency string) string {
+	amountText := "?"
+	if amount != 0 {
+		amountText = formatAmount(amount, currency)
+	}
+	if currency == "" {
+		return amountText + " (currency not specified)"
+	}
+	return amountText + " " + formatCodeWithRep(currency)
+}
+
+// isBotAdmin checks whether the user is listed in the admin_user_ids setting
+func (ctx *BotContext) isBotAdmin(user *tgbotapi.User) bool {
+	if user == nil {
+		return false
+	}
+	for _, id := range ctx.settings.AdminUserIDs {
+		if id == user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// isChatAdmin checks whether the user may change settings of the chat:
+// bot admins anywhere, everyone in private chats, admins set with /chat and Telegram chat administrators in groups
+func (ctx *BotContext) isChatAdmin(chat *tgbotapi.Chat, user *tgbotapi.User) bool {
+	if user == nil {
+		return false
+	}
+	if ctx.isBotAdmin(user) || chat.IsPrivate() {
+		return true
+	}
+	if admins, err := getChatAdmins(ctx.db, chat.ID); err != nil {
+		ctx.logger.Error("Error getting chat admins", "err", err)
+	} else if slices.Contains(admins, user.ID) {
+		return true
+	}
+	admins, err := ctx.bot.ChatAdministrators(chat.ID)
+	if err != nil {
+		ctx.logger.Warn("Error getting Telegram chat administrators", "err", err)
+		return false
+	}
+	for _, admin := range admins {
+		if admin.User != nil && admin.User.ID == user.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// handleCurrenciesCommand handles /currencies:
+//   - /currencies lists currencies enabled in the chat
+//   - /currencies all lists every supported currency
+//   - /currencies enable EUR TRY, /currencies disable TRY change the chat set (chat admins)
+//   - /currencies reload re-reads currencies.json (bot admins)
+func (ctx *BotContext) handleCurrenciesCommand(message *tgbotapi.Message, update MessageIndex) error {
+	args := strings.Fields(message.CommandArguments())
+	subcommand := ""
+	if len(args) > 0 {
+		subcommand = strings.ToLower(args[0])
+	}
+	enabled, err := getChatCurrencies(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+
+	switch subcommand {
+	case "":
+	case "all":
+		_, err := ctx.sendReply(message, optionsForError(nil))
+		return err
+	case "reload":
+		if !ctx.isBotAdmin(message.From) {
+			_, err := ctx.sendReply(message, "Only bot admins can reload currencies")
+			return err
+		}
+		if err := loadCurrencyConfig(getCurrenciesPath(), ctx.db); err != nil {
+			_, err = ctx.sendReply(message, "Reload failed, keeping current currencies: "+err.Error())
+			return err
+		}
+		if enabled, err = getChatCurrencies(ctx.db, message.Chat.ID); err != nil {
+			return err
+		}
+	case "enable", "disable":
+		if !ctx.isChatAdmin(message.Chat, message.From) {
+			_, err := ctx.sendReply(message, "Only chat admins can change currencies of the chat")
+			return err
+		}
+		if len(args) < 2 {
+			_, err := ctx.sendReply(message, "Usage: /currencies "+subcommand+" <code> [<code>...]")
+			return err
+		}
+		updated := slices.Clone(enabled)
+		for _, arg := range args[1:] {
+			code, ok := normalizeCurrency(arg)
+			if !ok {
+				_, err := ctx.sendReply(message, fmt.Sprintf("Unknown currency %q, see /currencies all", arg))
+				return err
+			}
+			if subcommand == "enable" && !slices.Contains(updated, code) {
+				updated = append(updated, code)
+			} else if subcommand == "disable" {
+				updated = slices.DeleteFunc(updated, func(c string) bool { return c == code })
+			}
+		}
+		if len(updated) < 2 {
+			_, err := ctx.sendReply(message, "At least two currencies must stay enabled")
+			return err
+		}
+		if err := setChatCurrencies(ctx.db, message.Chat.ID, updated); err != nil {
+			return err
+		}
+		enabled = updated
+	default:
+		_, err := ctx.sendReply(message, "Usage: /currencies [all | enable <codes> | disable <codes> | reload]")
+		return err
+	}
+	_, err = ctx.sendReply(message, "Currencies enabled in this chat: "+strings.Join(enabled, ", ")+"\n"+optionsForError(enabled))
+	return err
+}
+
+// handleChatCommand handles /chat: shows settings of the chat, chat admins change them:
+//   - /chat counter USD, /chat counter auto set the counter currency of offers with one side
+//   - /chat language ru sets the language of replies
+//   - /chat ttl 7d, /chat ttl off set how long offers are listed and matched
+//   - /chat freetext on|off handles messages like "sell 100 USD for GEL" as offers
+//   - /chat share on|off shows offers of the chat in other sharing chats and theirs in the chat
+//   - /chat admins add|remove <user ID> changes admins in addition to Telegram chat administrators,
+//     without the ID, the author of the replied message is used
+//
+// Enabled currencies are changed with /currencies.
+func (ctx *BotContext) handleChatCommand(message *tgbotapi.Message, update MessageIndex) error {
+	const usage = "Usage: /chat [counter <code>|auto | language <code> | ttl <duration>|off | " +
+		"freetext on|off | share on|off | admins add|remove <user ID>]"
+	args := strings.Fields(strings.ToLower(message.CommandArguments()))
+	cfg, err := getChatConfig(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		if !ctx.isChatAdmin(message.Chat, message.From) {
+			_, err := ctx.sendReply(message, "Only chat admins can change settings of the chat")
+			return err
+		}
+		if args[0] == "admins" {
+			return ctx.changeChatAdmins(message, args[1:], usage)
+		}
+		if len(args) != 2 {
+			_, err := ctx.sendReply(message, usage)
+			return err
+		}
+		value := args[1]
+		switch args[0] {
+		case "counter":
+			if value == "auto" {
+				cfg.DefaultCounter = ""
+			} else if code, ok := normalizeCurrency(value); ok {
+				cfg.DefaultCounter = code
+			} else {
+				err = fmt.Errorf("unknown currency %q, see /currencies all", value)
+			}
+		case "language":
+			if reLanguageCode.MatchString(value) {
+				cfg.Language = value
+			} else {
+				err = fmt.Errorf("invalid language %q, expected a code like en or ru", value)
+			}
+		case "ttl":
+			cfg.OfferTTL, err = parseOfferTTL(value)
+		case "freetext":
+			cfg.FreeText, err = parseOnOff(value)
+		case "share":
+			cfg.Shared, err = parseOnOff(value)
+		default:
+			err = fmt.Errorf("unknown setting %q", args[0])
+		}
+		if err != nil {
+			_, err = ctx.sendReply(message, err.Error()+"\n"+usage)
+			return err
+		}
+		if err := saveChatConfig(ctx.db, cfg); err != nil {
+			return err
+		}
+	}
+
+	enabled, err := getChatCurrencies(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	admins, err := getChatAdmins(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	counter := "picked by currency"
+	if cfg.DefaultCounter != "" {
+		counter = cfg.DefaultCounter
+	}
+	ttl := "never"
+	if cfg.OfferTTL > 0 {
+		ttl = formatOfferTTL(cfg.OfferTTL)
+	}
+	adminList := "Telegram chat administrators"
+	for _, id := range admins {
+		adminList += fmt.Sprintf(", %d", id)
+	}
+	var sb strings.Builder
+	sb.WriteString("Settings of this chat:\n")
+	sb.WriteString("Currencies: " + strings.Join(enabled, ", ") + " (see /currencies)\n")
+	sb.WriteString("Counter currency: " + counter + "\n")
+	sb.WriteString("Language: " + cfg.Language + "\n")
+	sb.WriteString("Offers expire after: " + ttl + "\n")
+	sb.WriteString("Free-text offers: " + formatOnOff(cfg.FreeText) + "\n")
+	sb.WriteString("Shared with other chats: " + formatOnOff(cfg.Shared) + "\n")
+	sb.WriteString("Admins: " + adminList + "\n\n")
+	sb.WriteString(usage)
+	_, err = ctx.sendReply(message, sb.String())
+	return err
+}
+
+// changeChatAdmins handles /chat admins add|remove [<user ID>]
+func (ctx *BotContext) changeChatAdmins(message *tgbotapi.Message, args []string, usage string) error {
+	if len(args) == 0 || len(args) > 2 || (args[0] != "add" && args[0] != "remove") {
+		_, err := ctx.sendReply(message, usage)
+		return err
+	}
+	var userID int
+	if len(args) == 2 {
+		id, err := strconv.Atoi(args[1])
+		if err != nil || id <= 0 {
+			_, err = ctx.sendReply(message, fmt.Sprintf("Invalid user ID %q\n%s", args[1], usage))
+			return err
+		}
+		userID = id
+	} else if message.ReplyToMessage != nil && message.ReplyToMessage.From != nil {
+		userID = message.ReplyToMessage.From.ID
+	} else {
+		_, err := ctx.sendReply(message, "Give the user ID or reply to a message of the user\n"+usage)
+		return err
+	}
+	add := args[0] == "add"
+	if err := setChatAdmin(ctx.db, message.Chat.ID, userID, add); err != nil {
+		return err
+	}
+	reply := fmt.Sprintf("User %d is an admin of the chat now", userID)
+	if !add {
+		reply = fmt.Sprintf("User %d is not an admin of the chat now, unless they are a Telegram chat administrator", userID)
+	}
+	_, err := ctx.sendReply(message, reply)
+	return err
+}
+
+var reLanguageCode = regexp.MustCompile(`^[a-z]{2,3}$`)
+
+// reRateDate matches arguments of /rates meant as a date, parseRateDate validates them
+var reRateDate = regexp.MustCompile(`^[0-9]{4}-[0-9]{1,2}-[0-9]{1,2}$`)
+
+// parseOfferTTL parses the offer lifetime: days like 7d, a duration like 12h, or off
+func parseOfferTTL(s string) (time.Duration, error) {
+	if s == "off" || s == "0" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return time.Duration(n) * 24 * time.Hour, nil
 		}
+	} else if d, err := time.ParseDuration(s); err == nil && d >= time.Minute {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid TTL %q, expected days like 7d, a duration like 12h, or off", s)
+}
+
+// formatOfferTTL formats the offer lifetime in days if it is a whole number of them
+func formatOfferTTL(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
 	}
+	return d.String()
+}
+
+// parseOnOff parses on or off
+func parseOnOff(s string) (bool, error) {
+	switch s {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("expected on or off, got %q", s)
+}
 
+func formatOnOff(b bool) string {
+	if b {
+		return "on"
+	}
+	return "off"
+}
+
+// checkCurrenciesEnabled returns an error naming the first currency not enabled in the chat
+func checkCurrenciesEnabled(enabled []string, codes ...string) error {
+	for _, code := range codes {
+		if code != "" && !slices.Contains(enabled, code) {
+			return fmt.Errorf("%s is not enabled in this chat, chat admins can enable it with /currencies enable %s", code, code)
+		}
+	}
 	return nil
 }
 
@@ -317,16 +952,14 @@ func (ctx *BotContext) handleBuySellCommand(message *tgbotapi.Message, update Me
 func (ctx *BotContext) handleStatsCommand(message *tgbotapi.Message, update MessageIndex) error {
 	// Get user statistics
 	reputation, err := getUserReputation(ctx.db, message.From.ID)
-	if err != nil {
-		log.Printf("Error getting user reputation: %v", err)
-		reputation = 0
+	if err != nil && err != sql.ErrNoRows {
+		ctx.logger.Error("Error getting user reputation", "err", err)
 	}
 
 	// Count user's offers
-	var offerCount int
-	err = ctx.db.QueryRow("SELECT COUNT(*) FROM offers WHERE userid = ?", message.From.ID).Scan(&offerCount)
+	offerCount, err := countUserOffers(ctx.db, message.Chat.ID, message.From.ID)
 	if err != nil {
-		log.Printf("Error counting offers: %v", err)
+		ctx.logger.Error("Error counting offers", "err", err)
 		offerCount = 0
 	}
 
@@ -341,22 +974,33 @@ func (ctx *BotContext) formatStoredOffers(offers []StoredOffer, listText *string
 	listText.WriteString("Recent offers:\n\n")
 
 	for _, offer := range offers {
-		listText = storedOfferToStringBuilder(listText, offer)
+		listText = ctx.formatOffer(listText, offer)
 		listText.WriteString("\n")
 	}
 }
 
-// handleListCommand handles /list command
+// handleListCommand handles /list command, optionally filtered by place: /list batumi
 func (ctx *BotContext) handleListCommand(message *tgbotapi.Message, update MessageIndex) error {
+	cond := ""
+	var args []any
+	if placeText := strings.TrimSpace(message.CommandArguments()); placeText != "" {
+		location, ok := parsePlace(placeText)
+		if !ok {
+			_, err := ctx.sendReply(message, fmt.Sprintf("Unknown place %q. %s", placeText, placesHelp()))
+			return err
+		}
+		cond, args = placeFilter(location)
+	}
+
 	// Get recent offers
-	offers, err := getFilteredOffers(ctx.db, 10, "")
+	offers, err := getFilteredOffers(ctx.db, message.Chat.ID, 10, cond, args...)
 	if err != nil {
-		ctx.logToTelegramAndConsole(fmt.Sprintf("Error getting recent offers: %v", err))
+		ctx.logger.Error("Error getting recent offers", "err", err)
 		return err
 	}
 	if len(offers) == 0 {
 		reply := tgbotapi.NewMessage(message.Chat.ID, "No offers found.")
-		_, err = ctx.bot.Send(reply)
+		_, err = ctx.send(reply)
 		return err
 	}
 
@@ -367,25 +1011,101 @@ func (ctx *BotContext) handleListCommand(message *tgbotapi.Message, update Messa
 	return err
 }
 
-// handleRatesCommand handles /rates command to dump current rates and their age
+// handleLocationCommand shows or sets the default place for the user's offers: /location batumi, /location none
+func (ctx *BotContext) handleLocationCommand(message *tgbotapi.Message, update MessageIndex) error {
+	placeText := strings.TrimSpace(message.CommandArguments())
+	if placeText == "" {
+		location, err := getUserLocation(ctx.db, message.From.ID)
+		if err != nil {
+			return err
+		}
+		if location == "" {
+			_, err = ctx.sendReply(message, "Your location is not set. Use /location <city or district>.\n"+placesHelp())
+		} else {
+			_, err = ctx.sendReply(message, "Your location: "+formatPlace(location))
+		}
+		return err
+	}
+
+	location := ""
+	if !strings.EqualFold(placeText, "none") && placeText != "-" {
+		var ok bool
+		if location, ok = parsePlace(placeText); !ok {
+			_, err := ctx.sendReply(message, fmt.Sprintf("Unknown place %q. %s", placeText, placesHelp()))
+			return err
+		}
+	}
+	if err := setUserLocation(ctx.db, message.From.ID, message.From.UserName, location); err != nil {
+		return err
+	}
+	reply := "Location cleared"
+	if location != "" {
+		reply = "Location set to " + formatPlace(location)
+	}
+	_, err := ctx.sendReply(message, reply)
+	return err
+}
+
+// handleRatesCommand handles /rates command to dump current rates and their age.
+// /rates 2025-03-01 shows official NBG rates on the date.
+// Bot admins can override rates: /rates set USD 2.71, /rates unset USD
 func (ctx *BotContext) handleRatesCommand(message *tgbotapi.Message, update MessageIndex) error {
+	if args := strings.Fields(message.CommandArguments()); len(args) == 1 && reRateDate.MatchString(args[0]) {
+		return ctx.sendHistoricalRates(message, args[0])
+	}
 	if ctx.rates == nil {
 		reply := tgbotapi.NewMessage(message.Chat.ID, "Rates cache is not initialized")
-		_, err := ctx.bot.Send(reply)
+		_, err := ctx.send(reply)
+		return err
+	}
+	// If user asked to refresh, wait for a full refresh then dump
+	args := strings.Fields(message.CommandArguments())
+	refresh := len(args) == 1 && args[0] == "refresh"
+	if len(args) > 0 && !refresh && args[0] != "set" && args[0] != "unset" {
+		_, err := ctx.sendReply(message, "Usage: /rates [YYYY-MM-DD|refresh], /rates set <currency> <GEL per unit> or /rates unset <currency>")
 		return err
 	}
-	// If user asked to refresh, perform a blocking full refresh (no timeout) then dump
-	args := strings.TrimSpace(message.CommandArguments())
-	if args == "refresh" {
-		// Synchronously refresh with no timeout
-		done := make(chan error, 1)
-		ctx.rates.reqCh <- refreshReq{timeout: 0, respCh: done}
-		if err := <-done; err != nil {
+	if len(args) > 0 && (args[0] == "set" || args[0] == "unset") {
+		if !ctx.isBotAdmin(message.From) {
+			_, err := ctx.sendReply(message, "Only bot admins can override rates")
+			return err
+		}
+		manual := ctx.rates.manualProvider()
+		if manual == nil {
+			_, err := ctx.sendReply(message, "The manual rate provider is not enabled in rate_providers")
+			return err
+		}
+		var value float64
+		var err error
+		if args[0] == "set" && len(args) == 3 {
+			value, err = parseNum(args[2])
+		} else if args[0] == "set" || len(args) != 2 {
+			err = fmt.Errorf("usage: /rates set <currency> <GEL per unit> or /rates unset <currency>")
+		}
+		code, ok := "", false
+		if err == nil {
+			if code, ok = normalizeCurrency(args[1]); !ok {
+				err = fmt.Errorf("unknown currency %q", args[1])
+			}
+		}
+		if err != nil {
+			_, err = ctx.sendReply(message, err.Error())
+			return err
+		}
+		if err := manual.set(code, value); err != nil {
+			return err
+		}
+		refresh = true
+	}
+	if refresh {
+		// Synchronously wait for a fetch started after the request, so it includes manual overrides
+		if err := ctx.rates.refresh(0, true); err != nil {
 			_, _ = ctx.sendReply(message, "Refresh failed: "+err.Error())
 			return nil
 		}
 	}
 	base, cacheTS, rates := ctx.rates.snapshot()
+	commercial := ctx.rates.commercialSnapshot()
 	var sb strings.Builder
 	sb.WriteString("Rates (base=" + base + ")\n")
 	sb.WriteString("Cache: ")
@@ -413,12 +1133,363 @@ func (ctx *BotContext) handleRatesCommand(message *tgbotapi.Message, update Mess
 			age = fmt.Sprintf("%02d:%02d", h, m)
 		}
 		// USD: buy/sell and age
-		sb.WriteString(fmt.Sprintf("%s: value=%.4f age=%s\n", code, r.value, age))
+		sb.WriteString(fmt.Sprintf("%s: value=%.4f source=%s age=%s", code, r.value, r.Source, age))
+		if cr, ok := commercial[code]; ok {
+			sb.WriteString(fmt.Sprintf(" bank buy=%.4f sell=%.4f spread=%.2f%%", cr.Buy, cr.Sell, (cr.Sell-cr.Buy)/cr.Sell*100))
+		}
+		sb.WriteString("\n")
+	}
+	if health := ctx.rates.health.summary(); health != "" {
+		sb.WriteString("\nProviders:\n" + health)
 	}
 	_, err := ctx.sendReply(message, sb.String())
 	return err
 }
 
+// sendHistoricalRates replies with official NBG rates of known currencies on the date
+func (ctx *BotContext) sendHistoricalRates(message *tgbotapi.Message, dateArg string) error {
+	date, err := parseRateDate(dateArg)
+	if err != nil {
+		_, err = ctx.sendReply(message, err.Error()+"\nUsage: /rates [YYYY-MM-DD|refresh]")
+		return err
+	}
+	enabled, err := getChatCurrencies(ctx.db, message.Chat.ID)
+	if err != nil {
+		return err
+	}
+	rates, err := historicalRates(ctx.db, ctx.settings.nbgRatesURL(), date, enabled...)
+	if err != nil {
+		_, err = ctx.sendReply(message, "Rates on "+date+" are not available: "+err.Error())
+		return err
+	}
+	codes := make([]string, 0, len(rates))
+	for code := range rates {
+		if isKnownCurrency(code) {
+			codes = append(codes, code)
+		}
+	}
+	sort.Strings(codes)
+	var sb strings.Builder
+	sb.WriteString("NBG rates on " + date + " (GEL per unit)\n")
+	for _, code := range codes {
+		sb.WriteString(fmt.Sprintf("%s: %.4f\n", code, rates[code]))
+	}
+	_, err = ctx.sendReply(message, sb.String())
+	return err
+}
+
+// handleConvertCommand handles /convert <amount> <from> <to> [YYYY-MM-DD].
+// Without a date, current rates are used; with a date, official NBG rates on that date.
+func (ctx *BotContext) handleConvertCommand(message *tgbotapi.Message, update MessageIndex) error {
+	const usage = "Usage: /convert <amount> <from> <to> [YYYY-MM-DD], e.g., /convert 100 usd gel 2025-03-01"
+	args := strings.Fields(message.CommandArguments())
+	if len(args) != 3 && len(args) != 4 {
+		_, err := ctx.sendReply(message, usage)
+		return err
+	}
+	decimal, err := parseDecimal(args[0])
+	if err != nil || decimal.Sign() <= 0 {
+		_, err = ctx.sendReply(message, fmt.Sprintf("Invalid amount %q\n%s", args[0], usage))
+		return err
+	}
+	var codes [2]string
+	for i, arg := range args[1:3] {
+		code, ok := normalizeCurrency(arg)
+		if !ok {
+			_, err = ctx.sendReply(message, fmt.Sprintf("Unknown currency %q. Options: %s", arg, optionsForError(nil)))
+			return err
+		}
+		codes[i] = code
+	}
+	from, to := codes[0], codes[1]
+	amount, err := amountFromDecimal(decimal, from)
+	if err != nil {
+		_, err = ctx.sendReply(message, err.Error())
+		return err
+	}
+
+	var result Amount
+	var note string
+	if len(args) == 4 {
+		date, err := parseRateDate(args[3])
+		if err != nil {
+			_, err = ctx.sendReply(message, err.Error()+"\n"+usage)
+			return err
+		}
+		if result, err = convertByHistoricalRates(ctx.db, ctx.settings.nbgRatesURL(), date, from, to, amount); err != nil {
+			_, err = ctx.sendReply(message, "Conversion failed: "+err.Error())
+			return err
+		}
+		note = "by NBG rates on " + date
+	} else {
+		if ctx.rates == nil {
+			_, err := ctx.sendReply(message, "Rates cache is not initialized")
+			return err
+		}
+		_, amt, asOf, err := ctx.rates.computeCounterAmount(from, to, amount)
+		if err != nil {
+			_, err = ctx.sendReply(message, "Conversion failed: "+err.Error())
+			return err
+		}
+		result, note = amt, rateWarning(asOf)
+	}
+	reply := fmt.Sprintf("%s %s = %s %s", formatAmount(amount, from), formatCodeWithRep(from), formatAmount(result, to), formatCodeWithRep(to))
+	if note != "" {
+		reply += "\n" + note
+	}
+	_, err = ctx.sendReply(message, reply)
+	return err
+}
+
+// handleChartCommand handles /chart <currency> [<days>d] [png] to show official and P2P rate history.
+// The text reply has sparklines; with png, a line chart is sent as a photo.
+func (ctx *BotContext) handleChartCommand(message *tgbotapi.Message, update MessageIndex) error {
+	const usage = "Usage: /chart <currency> [<days>d] [png], e.g., /chart USD 30d"
+	args := strings.Fields(strings.ToLower(message.CommandArguments()))
+	if len(args) == 0 {
+		_, err := ctx.sendReply(message, usage)
+		return err
+	}
+	code, ok := normalizeCurrency(args[0])
+	if !ok || code == CurGEL {
+		_, err := ctx.sendReply(message, fmt.Sprintf("Unknown currency %q, rates are charted in GEL\n%s", args[0], usage))
+		return err
+	}
+	days, asPNG := 30, false
+	for _, arg := range args[1:] {
+		if arg == "png" {
+			asPNG = true
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(arg, "d"))
+		if err != nil || n < 1 || n > maxChartDays {
+			_, err = ctx.sendReply(message, fmt.Sprintf("Invalid period %q, expected 1d to %dd\n%s", arg, maxChartDays, usage))
+			return err
+		}
+		days = n
+	}
+
+	series, err := buildRateSeries(ctx.db, message.Chat.ID, code, days)
+	if err != nil {
+		_, _ = ctx.sendReply(message, "Error reading rate history")
+		return err
+	}
+	text := formatRateSeries(series)
+	if !asPNG {
+		_, err = ctx.sendReply(message, text)
+		return err
+	}
+	chart, err := renderRateChart(series)
+	if err != nil {
+		_, err = ctx.sendReply(message, text)
+		return err
+	}
+	photo := tgbotapi.NewPhotoUpload(message.Chat.ID, tgbotapi.FileBytes{Name: "chart.png", Bytes: chart})
+	photo.ReplyToMessageID = message.MessageID
+	photo.Caption = text + "Blue: NBG, red: P2P median"
+	_, err = ctx.send(photo)
+	return err
+}
+
+// handleAlertCommand handles /alert USD GEL > 2.75 [recurring] [cooldown 6h] to create a rate alert.
+// Triggered alerts are sent in a private message.
+func (ctx *BotContext) handleAlertCommand(message *tgbotapi.Message, update MessageIndex) error {
+	const usage = "Usage: /alert <currency> <counter currency> >|< <rate> [recurring] [cooldown <duration>], " +
+		"e.g., /alert USD GEL > 2.75 or /alert USD GEL < 2.6 recurring cooldown 6h\nList and delete alerts with /alerts"
+	if message.From == nil {
+		return nil
+	}
+	alert, err := parseRateAlert(strings.Fields(message.CommandArguments()))
+	if err != nil {
+		_, err = ctx.sendReply(message, err.Error()+"\n"+usage)
+		return err
+	}
+	alert.UserID = message.From.ID
+	alert.ChatID = int64(message.From.ID) // private chat with the user
+	id, _, err := ctx.storeOnce(effectAlert, func(tx *sql.Tx) (int64, error) {
+		n, err := countRateAlerts(tx, alert.UserID)
+		if err != nil {
+			return 0, err
+		}
+		if n >= maxAlertsPerUser {
+			return 0, errTooManyAlerts
+		}
+		return saveRateAlert(tx, alert)
+	})
+	if errors.Is(err, errTooManyAlerts) {
+		_, err = ctx.sendReply(message, fmt.Sprintf("You already have %d alerts, delete some with /alerts delete <id>", maxAlertsPerUser))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	reply := fmt.Sprintf("Alert #%d set: %s", id, alert)
+	if !message.Chat.IsPrivate() {
+		reply += "\nAlerts are sent in a private message, please start a chat with me if you haven't yet"
+	}
+	_, err = ctx.sendReply(message, reply)
+	return err
+}
+
+// handleAlertsCommand handles /alerts to list own rate alerts and /alerts delete <id> to remove one
+func (ctx *BotContext) handleAlertsCommand(message *tgbotapi.Message, update MessageIndex) error {
+	if message.From == nil {
+		return nil
+	}
+	args := strings.Fields(message.CommandArguments())
+	if len(args) > 0 {
+		var id int64
+		var err error
+		if len(args) == 2 && args[0] == "delete" {
+			id, err = strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+		}
+		if len(args) != 2 || args[0] != "delete" || err != nil {
+			_, err = ctx.sendReply(message, "Usage: /alerts or /alerts delete <id>")
+			return err
+		}
+		deleted, err := deleteRateAlert(ctx.db, id, message.From.ID)
+		if err != nil {
+			return err
+		}
+		reply := fmt.Sprintf("Alert #%d deleted", id)
+		if !deleted {
+			reply = fmt.Sprintf("You have no alert #%d", id)
+		}
+		_, err = ctx.sendReply(message, reply)
+		return err
+	}
+
+	alerts, err := getRateAlerts(ctx.db, message.From.ID)
+	if err != nil {
+		return err
+	}
+	if len(alerts) == 0 {
+		_, err = ctx.sendReply(message, "You have no rate alerts. Create one with /alert USD GEL > 2.75")
+		return err
+	}
+	var sb strings.Builder
+	sb.WriteString("Your rate alerts:\n")
+	for _, a := range alerts {
+		sb.WriteString(fmt.Sprintf("#%d %s", a.ID, a))
+		if !a.LastTriggered.IsZero() {
+			sb.WriteString(", last triggered " + a.LastTriggered.Local().Format("2006-01-02 15:04"))
+		}
+		sb.WriteString("\n")
+	}
+	_, err = ctx.sendReply(message, sb.String())
+	return err
+}
+
+// handleAPIKeyCommand handles /apikey, bot admins manage keys of the HTTP API:
+//   - /apikey lists the keys
+//   - /apikey add <chat ID> <name> [<requests per minute>] creates a key listing offers as in the chat,
+//     only in a private chat since the key is shown once
+//   - /apikey revoke <id> revokes a key
+func (ctx *BotContext) handleAPIKeyCommand(message *tgbotapi.Message, update MessageIndex) error {
+	const usage = "Usage: /apikey [add <chat ID> <name> [<requests per minute>] | revoke <id>]"
+	if !ctx.isBotAdmin(message.From) {
+		_, err := ctx.sendReply(message, "Only bot admins can manage API keys")
+		return err
+	}
+	args := strings.Fields(message.CommandArguments())
+	switch {
+	case len(args) == 0:
+		keys, err := getAPIKeys(ctx.db)
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			_, err = ctx.sendReply(message, "There are no API keys\n"+usage)
+			return err
+		}
+		var sb strings.Builder
+		sb.WriteString("API keys:\n")
+		for _, k := range keys {
+			sb.WriteString(fmt.Sprintf("#%d %s, chat %d, %d requests per minute, created %s\n", k.ID, k.Name, k.ChatID, k.RateLimit, k.CreatedAt))
+		}
+		_, err = ctx.sendReply(message, sb.String())
+		return err
+	case args[0] == "add" && (len(args) == 3 || len(args) == 4):
+		if !message.Chat.IsPrivate() {
+			_, err := ctx.sendReply(message, "Create API keys in a private chat with me, the key is shown once")
+			return err
+		}
+		key := apiKey{Name: args[2], RateLimit: defaultAPIRateLimit}
+		chatID, err := strconv.ParseInt(args[1], 10, 64)
+		if err == nil && len(args) == 4 {
+			key.RateLimit, err = strconv.Atoi(args[3])
+			if err == nil && key.RateLimit < 1 {
+				err = fmt.Errorf("requests per minute must be positive")
+			}
+		}
+		if err != nil {
+			_, err = ctx.sendReply(message, usage)
+			return err
+		}
+		key.ChatID = chatID
+		secret, hash, err := newAPIKey()
+		if err != nil {
+			return fmt.Errorf("error generating API key: %w", err)
+		}
+		id, found, err := ctx.storeOnce(effectAPIKey, func(tx *sql.Tx) (int64, error) {
+			return createAPIKey(tx, hash, key, message.From.ID)
+		})
+		if err != nil {
+			return err
+		}
+		reply := fmt.Sprintf("API key #%d for %s, send it in the Authorization: Bearer header:\n%s", id, key.Name, secret)
+		if found {
+			// the key was created before a restart; only its hash is stored, so a key not shown yet can't be shown
+			shown, err := ctx.nextSendDone()
+			if err != nil {
+				return err
+			}
+			if !shown {
+				if _, err := revokeAPIKey(ctx.db, id); err != nil {
+					return err
+				}
+			}
+			reply = fmt.Sprintf("API key #%d for %s was created, but the bot restarted before showing it, so it's revoked; add a new one", id, key.Name)
+		}
+		_, err = ctx.sendReply(message, reply)
+		return err
+	case args[0] == "revoke" && len(args) == 2:
+		id, err := strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+		if err != nil {
+			_, err = ctx.sendReply(message, usage)
+			return err
+		}
+		revoked, err := revokeAPIKey(ctx.db, id)
+		if err != nil {
+			return err
+		}
+		reply := fmt.Sprintf("API key #%d revoked", id)
+		if !revoked {
+			reply = fmt.Sprintf("There is no API key #%d", id)
+		}
+		_, err = ctx.sendReply(message, reply)
+		return err
+	}
+	_, err := ctx.sendReply(message, usage)
+	return err
+}
+
+// formatOffer formats an offer for display along with how it compares to exchanging at the bank
+func (ctx *BotContext) formatOffer(sb *strings.Builder, offer StoredOffer) *strings.Builder {
+	sb = storedOfferToStringBuilder(sb, offer)
+	if ctx.rates == nil || offer.HaveAmount <= 0 || offer.WantAmount <= 0 {
+		return sb
+	}
+	bankAmount, ok := bankConvert(ctx.rates.commercialSnapshot(), offer.HaveCurrency, offer.WantCurrency, offer.HaveAmount)
+	if !ok || bankAmount <= 0 {
+		return sb
+	}
+	sb.WriteString(fmt.Sprintf("(selling to the bank gives %s %s, offer is %+.2f%%) ",
+		formatAmount(bankAmount, offer.WantCurrency), offer.WantCurrency,
+		float64(offer.WantAmount-bankAmount)/float64(bankAmount)*100))
+	return sb
+}
+
 // storedOfferToStringBuilder formats a StoredOffer for display
 func storedOfferToStringBuilder(sb *strings.Builder, offer StoredOffer) *strings.Builder {
 	if sb == nil {
@@ -431,26 +1502,21 @@ func storedOfferToStringBuilder(sb *strings.Builder, offer StoredOffer) *strings
 	))
 
 	if offer.HaveAmount > 0 {
-		sb.WriteString(fmt.Sprintf("has %.2f %s ", offer.HaveAmount, formatCodeWithRep(offer.HaveCurrency)))
+		sb.WriteString(fmt.Sprintf("has %s %s ", formatAmount(offer.HaveAmount, offer.HaveCurrency), formatCodeWithRep(offer.HaveCurrency)))
 	}
 	if offer.HaveAmount > 0 && offer.WantAmount > 0 {
 		sb.WriteString("and ")
 	}
 	if offer.WantAmount > 0 {
-		sb.WriteString(fmt.Sprintf("wants %.2f %s ", offer.WantAmount, formatCodeWithRep(offer.WantCurrency)))
+		sb.WriteString(fmt.Sprintf("wants %s %s ", formatAmount(offer.WantAmount, offer.WantCurrency), formatCodeWithRep(offer.WantCurrency)))
 	}
-	return sb
-}
-
-// logToTelegramAndConsole logs messages to both console and Telegram channel
-func (ctx BotContext) logToTelegramAndConsole(message string) {
-	// Log to console
-	log.Println(message)
-
-	// Send to Telegram channel
-	if err := sendToTelegram(ctx.bot, ctx.settings.TelegramServiceChannelID, message); err != nil {
-		log.Printf("Error sending log message to Telegram: %v", err)
+	if len(offer.Methods) > 0 {
+		sb.WriteString("via " + formatPaymentMethods(offer.Methods) + " ")
 	}
+	if offer.Location != "" {
+		sb.WriteString("in " + formatPlace(offer.Location) + " ")
+	}
+	return sb
 }
 
 // handleUpdate processes incoming updates from Telegram
@@ -482,18 +1548,20 @@ func (ctx *BotContext) handleUpdate(update tgbotapi.Update) (err error) {
 	}
 	prevReply, err := findReplyMessageID(ctx.db, MessageIndex{message.Chat.ID, message.MessageID})
 	if err != nil {
-		ctx.logToTelegramAndConsole(fmt.Sprintf("Error finding reply message ID: %v", err))
+		ctx.logger.Error("Error finding reply message ID", "err", err)
 		return err
 	}
 
 	// Handle commands
 	command := message.Command()
 	if command == "" {
+		if handled, err := ctx.handleFreeTextOffer(message); handled || err != nil {
+			return err
+		}
 		if prevReply.MessageID != 0 {
-			ctx.logToTelegramAndConsole(fmt.Sprintf("Received message without command, deleting message with ID %d", prevReply))
-			delRequest := tgbotapi.NewDeleteMessage(prevReply.ChannelID, prevReply.MessageID)
-			if _, err := ctx.bot.Send(delRequest); err != nil {
-				log.Printf("Error deleting message with ID %d: %v", prevReply, err)
+			ctx.logger.Info("Message without command has a reply, deleting the reply", "reply", prevReply.MessageID)
+			if err := ctx.bot.Delete(prevReply.ChannelID, prevReply.MessageID); err != nil {
+				ctx.logger.Warn("Error deleting the reply", "reply", prevReply.MessageID, "err", err)
 			}
 			deleteOfferByMessage(ctx.db, prevReply)
 		}
@@ -504,93 +1572,302 @@ func (ctx *BotContext) handleUpdate(update tgbotapi.Update) (err error) {
 	if message.From != nil {
 		fromUser = message.From.UserName
 	}
-	log.Printf(`Received command "%s" from user "%s"`, command, fromUser)
+	ctx.logger.Debug("Received command", "command", command, "from", fromUser)
 
 	if handler, exists := ctx.commands[command]; exists {
-		if err := handler(message, prevReply); err != nil {
-			log.Printf("Error handling %s command: %v", command, err)
+		start := time.Now()
+		if err := handler(ctx, message, prevReply); err != nil {
+			ctx.logger.Error("Error handling command", "command", command, "err", err)
 		}
+		metricCommandDuration.observe(time.Since(start).Seconds(), command)
 	} else {
 		commandNames := make([]string, 0, len(ctx.commands))
 		for name := range ctx.commands {
 			commandNames = append(commandNames, "/"+name)
 		}
 		reply := tgbotapi.NewMessage(message.Chat.ID, "Unknown command. Available commands: "+strings.Join(commandNames, ", "))
-		if _, err := ctx.bot.Send(reply); err != nil {
-			log.Printf("Error sending reply: %v", err)
+		if _, err := ctx.send(reply); err != nil {
+			ctx.logger.Error("Error sending reply", "err", err)
 		}
 	}
 
 	return nil
 }
 
+// freeTextOfferWords maps the first word of a free-text offer to its command
+var freeTextOfferWords = map[string]string{
+	"sell":   OfferTypeSellName,
+	"продам": OfferTypeSellName,
+	"продаю": OfferTypeSellName,
+	"buy":    OfferTypeBuyName,
+	"куплю":  OfferTypeBuyName,
+}
+
+// handleFreeTextOffer posts the offer of a message like "sell 100 USD for GEL" if free-text offers are on in the chat.
+// Messages which don't parse as an offer are left alone, they are likely a regular conversation.
+func (ctx *BotContext) handleFreeTextOffer(message *tgbotapi.Message) (handled bool, err error) {
+	words := strings.Fields(message.Text)
+	if len(words) < 2 || message.From == nil {
+		return false, nil
+	}
+	command, ok := freeTextOfferWords[strings.ToLower(strings.TrimRight(words[0], ":,"))]
+	if !ok {
+		return false, nil
+	}
+	chatConfig, err := getChatConfig(ctx.db, message.Chat.ID)
+	if err != nil || !chatConfig.FreeText {
+		return false, err
+	}
+	enabled, err := getChatCurrencies(ctx.db, message.Chat.ID)
+	if err != nil {
+		return false, err
+	}
+	arguments := strings.Join(words[1:], " ")
+	offer, _, err := parseOfferText(command, arguments)
+	if err == nil {
+		err = checkCurrenciesEnabled(enabled, offer.HaveCurrency, offer.WantCurrency)
+	}
+	if err != nil {
+		return false, nil
+	}
+	return true, ctx.postOffer(message, command, arguments)
+}
+
 // handleCallbackQuery processes callback queries from inline buttons
 func (ctx *BotContext) handleCallbackQuery(callback *tgbotapi.CallbackQuery) error {
 	if strings.HasPrefix(callback.Data, "feedback_") {
 		// Handle feedback button press
-		response := tgbotapi.CallbackConfig{
-			CallbackQueryID: callback.ID,
-			Text:            "Feedback feature coming soon!",
-		}
-		_, err := ctx.bot.AnswerCallbackQuery(response)
-		if err != nil {
-			log.Printf("Error answering callback: %v", err)
+		if err := ctx.bot.AnswerCallback(callback.ID, "Feedback feature coming soon!"); err != nil {
+			ctx.logger.Warn("Error answering callback", "err", err)
 		}
 	}
 	return nil
 }
 
-// handleUpdates sets up the message handling loop
-func (ctx *BotContext) handleUpdates() {
-	u := tgbotapi.NewUpdate(getNextUpdateId(ctx.db))
-	u.Timeout = 60
+// How long shutdown waits for updates in progress
+const shutdownTimeout = 30 * time.Second
 
-	updates, err := ctx.bot.GetUpdatesChan(u)
+// handleUpdates runs the message handling loop until runCtx is done,
+// then stops receiving and waits for updates in progress up to shutdownTimeout.
+// Returns false if some updates were still in progress.
+func (ctx *BotContext) handleUpdates(runCtx context.Context) bool {
+	updates, stop, err := ctx.bot.ReceiveUpdates(getNextUpdateId(ctx.db))
 	if err != nil {
 		log.Fatalf("Error getting updates channel: %v", err)
 	}
 
-	ctx.commands = map[string]func(*tgbotapi.Message, MessageIndex) error{
-		OfferTypeBuyName:  ctx.handleBuySellCommand,
-		OfferTypeSellName: ctx.handleBuySellCommand,
-		"stats":           ctx.handleStatsCommand,
-		"list":            ctx.handleListCommand,
-		"rates":           ctx.handleRatesCommand,
+	ctx.commands = map[string]func(*BotContext, *tgbotapi.Message, MessageIndex) error{
+		OfferTypeBuyName:  (*BotContext).handleBuySellCommand,
+		OfferTypeSellName: (*BotContext).handleBuySellCommand,
+		"stats":           (*BotContext).handleStatsCommand,
+		"list":            (*BotContext).handleListCommand,
+		"location":        (*BotContext).handleLocationCommand,
+		"parse":           (*BotContext).handleParseCommand,
+		"currencies":      (*BotContext).handleCurrenciesCommand,
+		"chat":            (*BotContext).handleChatCommand,
+		"rates":           (*BotContext).handleRatesCommand,
+		"convert":         (*BotContext).handleConvertCommand,
+		"chart":           (*BotContext).handleChartCommand,
+		"alert":           (*BotContext).handleAlertCommand,
+		"alerts":          (*BotContext).handleAlertsCommand,
+		"apikey":          (*BotContext).handleAPIKeyCommand,
 	}
 
-	for update := range updates {
-		if update.Message != nil || update.ChannelPost != nil {
-			if err := ctx.handleUpdate(update); err != nil {
-				log.Printf("Error %v handling update %v", err, update)
+	pool := newUpdatePool(ctx.settings.UpdateWorkers, ctx.processUpdate, func(updateID int) {
+		if err := saveLastUpdateID(ctx.db, updateID); err != nil {
+			slog.Error("Error saving last update ID", "update", updateID, "err", err)
+		}
+	})
+	// updates acknowledged to the webhook are stored, the ones a crash interrupted are processed again
+	unfinished, err := getUnfinishedUpdates(ctx.db)
+	if err != nil {
+		slog.Error("Error loading unfinished updates", "err", err)
+	}
+	if len(unfinished) > 0 {
+		slog.Info("Processing updates unfinished before restart", "count", len(unfinished))
+	}
+	for _, update := range unfinished {
+		pool.dispatch(update)
+	}
+receive:
+	for {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				break receive
 			}
+			pool.dispatch(update)
+		case <-runCtx.Done():
+			break receive
 		}
-		if update.CallbackQuery != nil {
-			if err := ctx.handleCallbackQuery(update.CallbackQuery); err != nil {
-				log.Printf("Error %v handling callback query %v", err, update)
+	}
+
+	slog.Info("Stopping receiving updates")
+	// stopping the webhook listener waits for requests blocked on a full updates channel, so it is drained meanwhile;
+	// updates already received may have been acknowledged to Telegram, so they are processed as well
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		stop()
+	}()
+	for receiving := true; receiving; {
+		select {
+		case update, ok := <-updates:
+			if !ok {
+				// a nil channel is never ready, wait for stop to return
+				updates = nil
+				continue
 			}
+			pool.dispatch(update)
+		case <-stopped:
+			receiving = false
+		}
+	}
+	for drained := false; !drained; {
+		select {
+		case update, ok := <-updates:
+			if ok {
+				pool.dispatch(update)
+			} else {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+	if !pool.wait(shutdownTimeout) {
+		slog.Warn("Updates still in progress, stopping anyway; they are processed again on start",
+			"timeout", shutdownTimeout, "updates", pool.inProgress())
+		return false
+	}
+	return true
+}
+
+// processUpdate passes the update to its handler; called concurrently for updates of different chats.
+// Updates already processed are skipped, partially processed ones are processed without repeating
+// recorded effects.
+func (ctx *BotContext) processUpdate(update tgbotapi.Update) {
+	logger := slog.With("update", update.UpdateID)
+	if chat := updateChat(update); chat != nil {
+		logger = logger.With("chat", chat.ID)
+	}
+	done, err := beginUpdate(ctx.db, update.UpdateID)
+	if err != nil {
+		logger.Error("Error recording update, processing it untracked", "err", err)
+	} else if done {
+		logger.Info("Update was already processed, skipping")
+		return
+	}
+	// handlers run on a copy of the context carrying the update
+	uctx := *ctx
+	uctx.logger = logger
+	if err == nil {
+		uctx.update = &updateScope{id: update.UpdateID}
+	}
+	uctx.handleUpdateByType(update)
+	metricUpdates.inc(updateType(update))
+	if uctx.update != nil {
+		if err := finishUpdate(ctx.db, update.UpdateID); err != nil {
+			logger.Error("Error finishing update", "err", err)
+		}
+	}
+}
+
+// handleUpdateByType passes the update to the handler of its type
+func (ctx *BotContext) handleUpdateByType(update tgbotapi.Update) {
+	if update.Message != nil || update.ChannelPost != nil {
+		if err := ctx.handleUpdate(update); err != nil {
+			ctx.logger.Error("Error handling update", "err", err)
 		}
-		if err := saveLastUpdateID(ctx.db, update.UpdateID); err != nil {
-			log.Printf("Error saving last update ID: %v", err)
+	}
+	if update.CallbackQuery != nil {
+		if err := ctx.handleCallbackQuery(update.CallbackQuery); err != nil {
+			ctx.logger.Error("Error handling callback query", "data", update.CallbackQuery.Data, "err", err)
 		}
 	}
 }
 
 // Run executes the service
 func main() {
-	secrets, settings := getConfig()
+	if len(os.Args) > 1 && os.Args[1] == "fake-rates-server" {
+		runFakeRatesServer(os.Args[2:])
+		return
+	}
+	opts, err := parseCommandLine(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+	if opts.init {
+		if err := runInitWizard(os.Stdin, os.Stdout, verifyBotToken); err != nil {
+			log.Fatalf("Initialization failed: %v", err)
+		}
+		return
+	}
+	if opts.checkConfig {
+		os.Exit(checkConfig(os.Stdout, opts))
+	}
+	secrets, settings := getConfig(opts)
+	// warnings and errors are collected from the start and sent once the bot is connected
+	digest := newServiceDigest()
+	if err := setupLogging(settings, digest); err != nil {
+		log.Fatalf("Error configuring logging: %v", err)
+	}
+	if err := loadPlaces(getPlacesPath()); err != nil {
+		log.Fatalf("Error loading places: %v", err)
+	}
+	// data migrations use the registry, so currencies are loaded before the database
+	if err := loadCurrencyConfig(getCurrenciesPath(), nil); err != nil {
+		log.Fatalf("Error loading currencies: %v", err)
+	}
 	db := initDB(getDBPath())
-	defer db.Close()
+	if err := checkCurrencyScales(db, currentCurrencies()); err != nil {
+		log.Fatalf("Error in currencies file %s: %v", getCurrenciesPath(), err)
+	}
+	// Telegram keeps undelivered updates for a day, older records are not needed to skip them
+	if err := pruneProcessedUpdates(db, time.Now().AddDate(0, 0, -7)); err != nil {
+		slog.Error("Error pruning processed updates", "err", err)
+	}
 
 	// Initialize bot
-	bot, err := tgbotapi.NewBotAPI(secrets.TelegramBotToken)
+	api, err := tgbotapi.NewBotAPI(secrets.TelegramBotToken)
 	if err != nil {
 		log.Fatalf("Error initializing bot: %v", err)
 	}
 
-	bot.Debug = false
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+	api.Debug = false
+	slog.Info("Authorized", "account", api.Self.UserName)
+	bot := newTelegramBot(api, settings, secrets, db)
+	stopDigest := digest.start(time.Duration(settings.ServiceDigestSeconds)*time.Second, func(text string) error {
+		return sendToTelegram(bot, settings.TelegramServiceChannelID, text)
+	})
 
-	rates := initCurrencyRates(secrets.TBCApiKey)
+	providers, err := newRateProviders(settings, secrets, db)
+	if err != nil {
+		log.Fatalf("Error configuring rate providers: %v", err)
+	}
+	rates := initCurrencyRates(providers, db, func(chatID int64, text string) error {
+		return sendToTelegram(bot, chatID, text)
+	}, func(text string) {
+		// provider health changes are reported in the service channel digest
+		slog.Warn(text)
+	})
+
+	stopMetrics := func() {}
+	if settings.MetricsListenAddr != "" {
+		if stopMetrics, err = startMetricsServer(settings.MetricsListenAddr, db, rates); err != nil {
+			log.Fatalf("Error serving metrics: %v", err)
+		}
+	}
+
+	stopAPI := func() {}
+	if settings.APIListenAddr != "" {
+		if stopAPI, err = startAPIServer(settings.APIListenAddr, settings.APICORSOrigins, db, rates); err != nil {
+			log.Fatalf("Error serving API: %v", err)
+		}
+	}
 
 	// Send test message to verify channel connection
 	if err := sendToTelegram(bot, settings.TelegramServiceChannelID, "ExchangeBot started"); err != nil {
@@ -602,8 +1879,31 @@ func main() {
 		db:       db,
 		settings: settings,
 		rates:    rates,
+		logger:   slog.Default(),
 	}
 
+	runCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	// a second signal kills the process without waiting
+	context.AfterFunc(runCtx, stopSignals)
+
+	go watchCurrencyConfig(runCtx, getCurrenciesPath(), db, 30*time.Second)
+
 	// Start message handler
-	ctx.handleUpdates()
+	finished := ctx.handleUpdates(runCtx)
+
+	stopAPI()
+	stopMetrics()
+	rates.stop()
+	stopDigest()
+	if err := sendToTelegram(bot, settings.TelegramServiceChannelID, "ExchangeBot stopping"); err != nil {
+		slog.Error("Error sending message to Telegram channel", "err", err)
+	}
+	// updates still in progress would fail on a closed database; SQLite keeps it consistent on exit anyway
+	if finished {
+		if err := db.Close(); err != nil {
+			slog.Error("Error closing database", "err", err)
+		}
+	}
+	slog.Info("Stopped")
 }
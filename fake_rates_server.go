@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fakeRatesFixture is the format of the fake-rates-server fixture file
+type fakeRatesFixture struct {
+	NBG        map[string]float64 `json:"nbg"` // GEL per unit
+	Commercial map[string]struct {
+		Buy  float64 `json:"buy"`
+		Sell float64 `json:"sell"`
+	} `json:"commercial"`
+}
+
+// runFakeRatesServer serves TBC exchange rates API and NBG historical rates responses from a fixture file,
+// so the rate path can run offline. The fixture is re-read on every request.
+// Point the bot at it with "tbc_rates_base_url": "http://127.0.0.1:8089"
+// and "nbg_rates_url": "http://127.0.0.1:8089/nbg-history?date=" in settings; any TBC API key works.
+func runFakeRatesServer(args []string) {
+	fs := flag.NewFlagSet("fake-rates-server", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8089", "listen address")
+	fixturePath := fs.String("fixture", "fake_rates.example.json", "fixture file with rates")
+	_ = fs.Parse(args)
+
+	log.Printf("Fake rates server listening on %s with fixture %s", *addr, *fixturePath)
+	log.Fatal(http.ListenAndServe(*addr, logRequests(fakeRatesHandler(*fixturePath))))
+}
+
+// fakeRatesHandler serves the fake rates API with the rates of the fixture file, re-read on every request
+func fakeRatesHandler(fixturePath string) http.Handler {
+	load := func(w http.ResponseWriter) (fakeRatesFixture, bool) {
+		var f fakeRatesFixture
+		rawdata, err := os.ReadFile(fixturePath)
+		if err == nil {
+			err = json.Unmarshal(rawdata, &f)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error loading fixture: %v", err), http.StatusInternalServerError)
+			return f, false
+		}
+		return f, true
+	}
+	reply := func(w http.ResponseWriter, v any) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Printf("Error writing response: %v", err)
+		}
+	}
+	nbgList := func(f fakeRatesFixture, currency string) []tbcNbgRate {
+		out := []tbcNbgRate{}
+		for code, v := range f.NBG {
+			if currency == "" || strings.EqualFold(code, currency) {
+				out = append(out, tbcNbgRate{Currency: code, Value: v})
+			}
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Currency < out[j].Currency })
+		return out
+	}
+
+	mux := http.NewServeMux()
+	// /nbg/ lists all rates, /nbg?currency=USD returns the single one
+	nbg := func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := load(w); ok {
+			reply(w, nbgList(f, r.URL.Query().Get("currency")))
+		}
+	}
+	mux.HandleFunc("/nbg", nbg)
+	mux.HandleFunc("/nbg/{$}", nbg)
+	mux.HandleFunc("/nbg/convert", func(w http.ResponseWriter, r *http.Request) {
+		f, ok := load(w)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		from, to := strings.ToUpper(q.Get("From")), strings.ToUpper(q.Get("To"))
+		amount, err := strconv.ParseFloat(q.Get("Amount"), 64)
+		rate := func(code string) (float64, bool) {
+			if code == CurGEL {
+				return 1, true
+			}
+			v, ok := f.NBG[code]
+			return v, ok
+		}
+		rateFrom, okFrom := rate(from)
+		rateTo, okTo := rate(to)
+		if err != nil || !okFrom || !okTo {
+			http.Error(w, "unknown currency or invalid amount", http.StatusBadRequest)
+			return
+		}
+		reply(w, map[string]any{"from": from, "to": to, "amount": amount, "value": amount * rateFrom / rateTo})
+	})
+	mux.HandleFunc("/commercial", func(w http.ResponseWriter, r *http.Request) {
+		f, ok := load(w)
+		if !ok {
+			return
+		}
+		currency := r.URL.Query().Get("currency")
+		out := tbcCommercialRatesResponse{Base: CurGEL, CommercialRatesList: []tbcCommercialRate{}}
+		for code, v := range f.Commercial {
+			if currency == "" || strings.EqualFold(code, currency) {
+				out.CommercialRatesList = append(out.CommercialRatesList, tbcCommercialRate{Currency: code, Buy: v.Buy, Sell: v.Sell})
+			}
+		}
+		sort.Slice(out.CommercialRatesList, func(i, j int) bool {
+			return out.CommercialRatesList[i].Currency < out.CommercialRatesList[j].Currency
+		})
+		reply(w, out)
+	})
+	// NBG website format; the same fixture rates are returned for any date
+	mux.HandleFunc("/nbg-history", func(w http.ResponseWriter, r *http.Request) {
+		f, ok := load(w)
+		if !ok {
+			return
+		}
+		date := r.URL.Query().Get("date")
+		if _, err := time.Parse(time.DateOnly, date); err != nil {
+			http.Error(w, "invalid date", http.StatusBadRequest)
+			return
+		}
+		day := struct {
+			Date       string            `json:"date"`
+			Currencies []nbgCurrencyRate `json:"currencies"`
+		}{Date: date + "T00:00:00.000Z"}
+		for _, r := range nbgList(f, "") {
+			day.Currencies = append(day.Currencies, nbgCurrencyRate{Code: r.Currency, Quantity: 1, Rate: r.Value})
+		}
+		reply(w, []any{day})
+	})
+	return mux
+}
+
+// logRequests logs every request passed to the handler
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("%s %s", r.Method, r.URL)
+		h.ServeHTTP(w, r)
+	})
+}
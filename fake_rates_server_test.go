@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFakeRatesHandler(t *testing.T) {
+	fixturePath := filepath.Join(t.TempDir(), "fake_rates.json")
+	writeFixture := func(usd float64) {
+		t.Helper()
+		fixture := `{"nbg": {"USD": ` + trimFloat(usd) + `, "EUR": 3, "AMD": 0.0069},
+			"commercial": {"USD": {"buy": 2.68, "sell": 2.72}}}`
+		if err := os.WriteFile(fixturePath, []byte(fixture), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFixture(2.7)
+	srv := httptest.NewServer(fakeRatesHandler(fixturePath))
+	t.Cleanup(srv.Close)
+	// the bot is pointed at the server the way the fake server documents
+	settings := &Settings{TBCRatesBaseURL: srv.URL + "/", NBGRatesURL: srv.URL + "/nbg-history?date="}
+	ctx := context.Background()
+
+	nbg := &tbcNbgProvider{apiKey: "any", baseURL: settings.tbcRatesBaseURL()}
+	rates, err := nbg.FetchRates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 3 || rates[CurUSD] != 2.7 || rates["EUR"] != 3 {
+		t.Errorf("NBG rates = %v", rates)
+	}
+	if rate, err := nbg.FetchRate(ctx, "eur"); err != nil || rate != 3 {
+		t.Errorf("EUR rate = %v, %v; want 3", rate, err)
+	}
+	if _, err := nbg.FetchRate(ctx, "JPY"); err != errNoRate {
+		t.Errorf("JPY rate: err = %v, want %v", err, errNoRate)
+	}
+	if value, err := nbg.Convert(ctx, CurUSD, "EUR", 100); err != nil || math.Abs(value-90) > 1e-9 {
+		t.Errorf("100 USD in EUR = %v, %v; want 90", value, err)
+	}
+	if _, err := nbg.Convert(ctx, CurUSD, "JPY", 100); err == nil {
+		t.Error("converting to an unknown currency succeeded")
+	}
+
+	commercial := &tbcCommercialProvider{apiKey: "any", baseURL: settings.tbcRatesBaseURL()}
+	bank, err := commercial.FetchCommercialRates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := bank[CurUSD]; len(bank) != 1 || r.Buy != 2.68 || r.Sell != 2.72 {
+		t.Errorf("commercial rates = %+v", bank)
+	}
+
+	// the fixture is re-read on every request
+	writeFixture(2.8)
+	if rate, err := nbg.FetchRate(ctx, CurUSD); err != nil || rate != 2.8 {
+		t.Errorf("USD rate after editing the fixture = %v, %v; want 2.8", rate, err)
+	}
+
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	t.Cleanup(func() { db.Close() })
+	date := time.Now().AddDate(0, 0, -10).Format(time.DateOnly)
+	historical, err := historicalRates(db, settings.nbgRatesURL(), date, CurUSD, "AMD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if historical[CurUSD] != 2.8 || historical["AMD"] != 0.0069 {
+		t.Errorf("rates on %s = %v", date, historical)
+	}
+	if _, err := fetchNBGRatesOn(ctx, settings.nbgRatesURL(), "yesterday"); err == nil {
+		t.Error("fetching rates on an invalid date succeeded")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+// Built-in currencies: ISO 4217 codes with minor units, display symbols and common aliases.
+// Covers the currencies published by NBG. Entries in currencies.json with the same code
+// override individual fields, new codes are appended.
+// Aliases must be unique across all currencies, so ambiguous symbols like "¥" or "kr" are left out.
+var currencySpecs = []currencySpec{
+	{Code: CurRUB, Symbol: "₽", MinorUnits: 2, Aliases: []string{"р", "₽", "r", "rub", "rur", "руб", "рубль", "рублей", "рубля"}, DefaultCounter: CurUSD},
+	{Code: CurUSD, Symbol: "$", MinorUnits: 2, Aliases: []string{"$", "usd", "долл", "доллар", "долларов", "доллара", "бакс", "баксов"}, DefaultCounter: CurRUB},
+	{Code: CurGEL, Symbol: "₾", MinorUnits: 2, Aliases: []string{"л", "₾", "ლ", "лар", "лари", "gel", "lari"}, DefaultCounter: CurRUB},
+	{Code: "EUR", Symbol: "€", MinorUnits: 2, Aliases: []string{"€", "eur", "euro", "евро"}, DefaultCounter: CurGEL},
+	{Code: "TRY", Symbol: "₺", MinorUnits: 2, Aliases: []string{"₺", "tl", "лира", "лиры", "лир"}, DefaultCounter: CurGEL},
+	{Code: "AMD", Symbol: "֏", MinorUnits: 2, Aliases: []string{"֏", "amd", "dram", "драм", "драмов", "драма"}, DefaultCounter: CurGEL},
+	{Code: "AZN", Symbol: "₼", MinorUnits: 2, Aliases: []string{"₼", "azn", "манат", "маната", "манатов"}, DefaultCounter: CurGEL},
+	{Code: "KZT", Symbol: "₸", MinorUnits: 2, Aliases: []string{"₸", "kzt", "tenge", "тенге"}, DefaultCounter: CurRUB},
+	{Code: "UAH", Symbol: "₴", MinorUnits: 2, Aliases: []string{"₴", "uah", "грн", "гривна", "гривны", "гривен"}, DefaultCounter: CurGEL},
+	{Code: "BYN", Symbol: "Br", MinorUnits: 2, Aliases: []string{"byn", "белруб"}, DefaultCounter: CurRUB},
+	{Code: "KGS", Symbol: "с", MinorUnits: 2, Aliases: []string{"kgs", "сом", "сомов"}, DefaultCounter: CurRUB},
+	{Code: "UZS", Symbol: "soʻm", MinorUnits: 2, Aliases: []string{"uzs", "сум", "сумов"}, DefaultCounter: CurRUB},
+	{Code: "TJS", Symbol: "SM", MinorUnits: 2, Aliases: []string{"tjs", "сомони"}, DefaultCounter: CurRUB},
+	{Code: "TMT", Symbol: "m", MinorUnits: 2, Aliases: []string{"tmt"}, DefaultCounter: CurUSD},
+	{Code: "MDL", Symbol: "L", MinorUnits: 2, Aliases: []string{"mdl", "лей", "леев", "лея"}, DefaultCounter: CurGEL},
+	{Code: "GBP", Symbol: "£", MinorUnits: 2, Aliases: []string{"£", "gbp", "фунт", "фунтов", "фунта"}, DefaultCounter: CurGEL},
+	{Code: "CHF", Symbol: "Fr", MinorUnits: 2, Aliases: []string{"chf", "франк", "франков"}, DefaultCounter: CurGEL},
+	{Code: "CNY", Symbol: "¥", MinorUnits: 2, Aliases: []string{"cny", "rmb", "юань", "юаней", "юаня"}, DefaultCounter: CurGEL},
+	{Code: "JPY", Symbol: "¥", MinorUnits: 0, Aliases: []string{"jpy", "yen", "иена", "иен", "йена", "йен"}, DefaultCounter: CurGEL},
+	{Code: "KRW", Symbol: "₩", MinorUnits: 0, Aliases: []string{"₩", "krw", "вона", "вон"}, DefaultCounter: CurGEL},
+	{Code: "ILS", Symbol: "₪", MinorUnits: 2, Aliases: []string{"₪", "ils", "шекель", "шекелей", "шекеля"}, DefaultCounter: CurGEL},
+	{Code: "AED", Symbol: "د.إ", MinorUnits: 2, Aliases: []string{"aed", "дирхам", "дирхамов"}, DefaultCounter: CurGEL},
+	{Code: "INR", Symbol: "₹", MinorUnits: 2, Aliases: []string{"₹", "inr", "рупия", "рупий", "рупии"}, DefaultCounter: CurGEL},
+	{Code: "PLN", Symbol: "zł", MinorUnits: 2, Aliases: []string{"zł", "pln", "злотый", "злотых"}, DefaultCounter: CurGEL},
+	{Code: "CZK", Symbol: "Kč", MinorUnits: 2, Aliases: []string{"kč", "czk", "крона", "крон"}, DefaultCounter: CurGEL},
+	{Code: "HUF", Symbol: "Ft", MinorUnits: 2, Aliases: []string{"huf", "форинт", "форинтов"}, DefaultCounter: CurGEL},
+	{Code: "RON", Symbol: "lei", MinorUnits: 2, Aliases: []string{"ron", "lei"}, DefaultCounter: CurGEL},
+	{Code: "BGN", Symbol: "лв", MinorUnits: 2, Aliases: []string{"bgn", "лв", "лев", "левов"}, DefaultCounter: CurGEL},
+	{Code: "RSD", Symbol: "дин", MinorUnits: 2, Aliases: []string{"rsd", "динар", "динаров"}, DefaultCounter: CurGEL},
+	{Code: "SEK", Symbol: "kr", MinorUnits: 2, Aliases: []string{"sek"}, DefaultCounter: CurGEL},
+	{Code: "NOK", Symbol: "kr", MinorUnits: 2, Aliases: []string{"nok"}, DefaultCounter: CurGEL},
+	{Code: "DKK", Symbol: "kr", MinorUnits: 2, Aliases: []string{"dkk"}, DefaultCounter: CurGEL},
+	{Code: "ISK", Symbol: "kr", MinorUnits: 0, Aliases: []string{"isk"}, DefaultCounter: CurGEL},
+	{Code: "CAD", Symbol: "C$", MinorUnits: 2, Aliases: []string{"c$", "cad"}, DefaultCounter: CurGEL},
+	{Code: "AUD", Symbol: "A$", MinorUnits: 2, Aliases: []string{"a$", "aud"}, DefaultCounter: CurGEL},
+	{Code: "NZD", Symbol: "NZ$", MinorUnits: 2, Aliases: []string{"nz$", "nzd"}, DefaultCounter: CurGEL},
+	{Code: "HKD", Symbol: "HK$", MinorUnits: 2, Aliases: []string{"hk$", "hkd"}, DefaultCounter: CurGEL},
+	{Code: "SGD", Symbol: "S$", MinorUnits: 2, Aliases: []string{"s$", "sgd"}, DefaultCounter: CurGEL},
+	{Code: "BRL", Symbol: "R$", MinorUnits: 2, Aliases: []string{"r$", "brl"}, DefaultCounter: CurGEL},
+	{Code: "ZAR", Symbol: "R", MinorUnits: 2, Aliases: []string{"zar", "рэнд"}, DefaultCounter: CurGEL},
+	{Code: "EGP", Symbol: "E£", MinorUnits: 2, Aliases: []string{"e£", "egp"}, DefaultCounter: CurGEL},
+	{Code: "KWD", Symbol: "د.ك", MinorUnits: 3, Aliases: []string{"kwd"}, DefaultCounter: CurGEL},
+	{Code: "QAR", Symbol: "ر.ق", MinorUnits: 2, Aliases: []string{"qar"}, DefaultCounter: CurGEL},
+	{Code: "IRR", Symbol: "﷼", MinorUnits: 2, Aliases: []string{"irr", "риал", "риалов"}, DefaultCounter: CurGEL},
+}
+
+// Currencies enabled in chats which haven't chosen their own set
+var defaultEnabledCurrencies = []string{CurRUB, CurUSD, CurGEL}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Service channel digests are sent this often unless configured otherwise
+	defaultDigestInterval = time.Minute
+	// Distinct messages kept in a digest, the rest are only counted
+	maxDigestEntries = 50
+	// Telegram doesn't send longer messages
+	maxTelegramMessageLength = 4096
+)
+
+// Attributes identifying where a message came from rather than what happened;
+// they are left out of digests, so the same problem in different updates is reported once
+var correlationAttrs = map[string]bool{"update": true, "chat": true, "user": true}
+
+// setupLogging makes the default slog logger (and the standard log package) write to the console
+// with the configured level and format, passing warnings and errors to the digest
+func setupLogging(settings *Settings, digest *serviceDigest) error {
+	var level slog.Level
+	if settings.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(settings.LogLevel)); err != nil {
+			return fmt.Errorf("invalid log_level %q: %w", settings.LogLevel, err)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var console slog.Handler
+	switch settings.LogFormat {
+	case "", "text":
+		console = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		console = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf(`invalid log_format %q, expected "text" or "json"`, settings.LogFormat)
+	}
+	digest.console = slog.New(console)
+	slog.SetDefault(slog.New(&digestHandler{next: console, digest: digest}))
+	return nil
+}
+
+// digestHandler passes records to the next handler, adding warnings and errors to the digest
+type digestHandler struct {
+	next   slog.Handler
+	digest *serviceDigest
+	attrs  []slog.Attr // added with WithAttrs, groups are not reflected in digests
+}
+
+func (h *digestHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= slog.LevelWarn || h.next.Enabled(ctx, level)
+}
+
+func (h *digestHandler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level >= slog.LevelWarn {
+		var sb strings.Builder
+		sb.WriteString(r.Message)
+		appendAttr := func(a slog.Attr) bool {
+			if !correlationAttrs[a.Key] {
+				sb.WriteString(" " + a.Key + "=" + a.Value.String())
+			}
+			return true
+		}
+		for _, a := range h.attrs {
+			appendAttr(a)
+		}
+		r.Attrs(appendAttr)
+		h.digest.add(r.Level, sb.String(), r.Time)
+	}
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+func (h *digestHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &digestHandler{next: h.next.WithAttrs(attrs), digest: h.digest, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)}
+}
+
+func (h *digestHandler) WithGroup(name string) slog.Handler {
+	return &digestHandler{next: h.next.WithGroup(name), digest: h.digest, attrs: h.attrs}
+}
+
+// serviceDigest collects warnings and errors to send them to the service channel in one periodic message
+// instead of a message each, which would get the bot rate limited by Telegram in a burst of errors.
+// Repeated messages are counted rather than listed again.
+type serviceDigest struct {
+	console *slog.Logger // logs problems of the digest itself, which must not be added to it
+
+	mu      sync.Mutex
+	entries []*digestEntry
+	byText  map[string]*digestEntry
+	dropped int // messages not kept because of maxDigestEntries
+}
+
+type digestEntry struct {
+	level       slog.Level
+	text        string
+	count       int
+	first, last time.Time
+}
+
+func newServiceDigest() *serviceDigest {
+	return &serviceDigest{console: slog.Default(), byText: make(map[string]*digestEntry)}
+}
+
+// add records the message, counting repeated ones
+func (d *serviceDigest) add(level slog.Level, text string, at time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.byText[text]; ok {
+		e.count++
+		e.last = at
+		return
+	}
+	if len(d.entries) >= maxDigestEntries {
+		d.dropped++
+		return
+	}
+	e := &digestEntry{level: level, text: text, count: 1, first: at, last: at}
+	d.entries = append(d.entries, e)
+	d.byText[text] = e
+}
+
+// take returns the text of the digest and starts a new one; empty if nothing was added
+func (d *serviceDigest) take() string {
+	d.mu.Lock()
+	entries, dropped := d.entries, d.dropped
+	d.entries, d.byText, d.dropped = nil, make(map[string]*digestEntry), 0
+	d.mu.Unlock()
+	if len(entries) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("Warnings and errors since %s:\n", entries[0].first.Format("15:04:05")))
+	for i, e := range entries {
+		line := e.level.String() + " " + e.text
+		if e.count > 1 {
+			line += fmt.Sprintf(" (%d times, last at %s)", e.count, e.last.Format("15:04:05"))
+		}
+		line += "\n"
+		// leave room for the note about the rest
+		if sb.Len()+len(line) > maxTelegramMessageLength-100 {
+			dropped += len(entries) - i
+			break
+		}
+		sb.WriteString(line)
+	}
+	if dropped > 0 {
+		sb.WriteString(fmt.Sprintf("...and %d more messages, see the console log", dropped))
+	}
+	return sb.String()
+}
+
+// start sends the digest every interval while there is something to send.
+// stop sends the rest and stops.
+func (d *serviceDigest) start(interval time.Duration, send func(text string) error) (stop func()) {
+	if interval <= 0 {
+		interval = defaultDigestInterval
+	}
+	flush := func() {
+		if text := d.take(); text != "" {
+			if err := send(text); err != nil {
+				d.console.Error("Error sending digest to the service channel", "err", err)
+			}
+		}
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flush()
+			case <-done:
+				flush()
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
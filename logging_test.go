@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestServiceDigest(t *testing.T) {
+	digest := newServiceDigest()
+	logger := slog.New(&digestHandler{next: slog.NewTextHandler(io.Discard, nil), digest: digest})
+
+	logger.Info("Not reported")
+	for update := range 3 {
+		logger.With("update", update, "chat", testChatID).Error("Error saving offer", "err", "database is locked")
+	}
+	logger.Warn("Rates refresh failed")
+	text := digest.take()
+	for _, want := range []string{"ERROR Error saving offer err=database is locked (3 times", "WARN Rates refresh failed\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("digest %q doesn't contain %q", text, want)
+		}
+	}
+	if strings.Contains(text, "Not reported") || strings.Contains(text, "update=") {
+		t.Errorf("digest %q has info messages or correlation attributes", text)
+	}
+	if text := digest.take(); text != "" {
+		t.Errorf("digest is not empty after taking it: %q", text)
+	}
+
+	for i := range maxDigestEntries + 10 {
+		logger.Error(fmt.Sprintf("Error %d %s", i, strings.Repeat("x", 100)))
+	}
+	text = digest.take()
+	if len(text) > maxTelegramMessageLength {
+		t.Errorf("digest is longer than a Telegram message: %d", len(text))
+	}
+	if !strings.Contains(text, "more messages") {
+		t.Errorf("digest doesn't mention messages left out: %q", text)
+	}
+}
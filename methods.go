@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+)
+
+// Normalized payment method codes
+const (
+	MethodCash      = "CASH"
+	MethodCard      = "CARD"
+	MethodTBC       = "TBC"
+	MethodBoG       = "BOG"
+	MethodSBP       = "SBP"
+	MethodUSDTTRC20 = "USDT_TRC20"
+	MethodUSDTERC20 = "USDT_ERC20"
+)
+
+// paymentMethodSpec describes a payment method the offer parser recognizes
+type paymentMethodSpec struct {
+	Code    string   // normalized code, e.g., CASH
+	Name    string   // display name, e.g., cash
+	Aliases []string // lowercase aliases; multi-word aliases are separated by a single space
+}
+
+var paymentMethodSpecs = []paymentMethodSpec{
+	{Code: MethodCash, Name: "cash", Aliases: []string{"cash", "нал", "налом", "наличные", "наличными", "кэш", "кеш"}},
+	{Code: MethodCard, Name: "card", Aliases: []string{"card", "карта", "картой", "карту", "безнал"}},
+	{Code: MethodTBC, Name: "TBC", Aliases: []string{"tbc", "тбс", "тбц"}},
+	{Code: MethodBoG, Name: "BoG", Aliases: []string{"bog", "бог", "bank of georgia"}},
+	{Code: MethodSBP, Name: "SBP", Aliases: []string{"sbp", "сбп"}},
+	{Code: MethodUSDTTRC20, Name: "USDT TRC20", Aliases: []string{"usdt trc20", "usdt-trc20", "trc20", "trc-20"}},
+	{Code: MethodUSDTERC20, Name: "USDT ERC20", Aliases: []string{"usdt erc20", "usdt-erc20", "erc20", "erc-20"}},
+}
+
+// Derived at init
+var (
+	paymentMethodNames   map[string]string // code -> display name
+	paymentMethodAliases map[string]string // lowercase alias -> code
+	// longest alias length in words, bounds the parser lookahead
+	paymentMethodMaxWords int
+)
+
+func init() {
+	initPaymentMethodMappings()
+}
+
+func initPaymentMethodMappings() {
+	paymentMethodNames = make(map[string]string, len(paymentMethodSpecs))
+	paymentMethodAliases = make(map[string]string)
+	paymentMethodMaxWords = 1
+	for _, s := range paymentMethodSpecs {
+		paymentMethodNames[s.Code] = s.Name
+		for _, a := range s.Aliases {
+			a = strings.ToLower(a)
+			paymentMethodAliases[a] = s.Code
+			if n := len(strings.Fields(a)); n > paymentMethodMaxWords {
+				paymentMethodMaxWords = n
+			}
+		}
+	}
+}
+
+// matchPaymentMethod checks whether the tokens starting at index i name a payment method.
+// Tokens must already be lowercased. Returns the method code and the number of tokens consumed.
+func matchPaymentMethod(tokens []string, i int) (code string, consumed int) {
+	return matchAliasPhrase(paymentMethodAliases, paymentMethodMaxWords, tokens, i)
+}
+
+// matchAliasPhrase looks up the longest phrase of up to maxWords tokens starting at index i
+// in the alias map, so "usdt trc20" wins over a lone "trc20".
+// Returns the mapped value and the number of tokens consumed, 0 if nothing matched.
+func matchAliasPhrase(aliases map[string]string, maxWords int, tokens []string, i int) (string, int) {
+	for n := min(maxWords, len(tokens)-i); n > 0; n-- {
+		words := make([]string, n)
+		for k := range n {
+			words[k] = strings.Trim(tokens[i+k], ",;")
+		}
+		if v, ok := aliases[strings.Join(words, " ")]; ok {
+			return v, n
+		}
+	}
+	return "", 0
+}
+
+// formatPaymentMethods returns display names of the method codes joined with commas
+func formatPaymentMethods(codes []string) string {
+	names := make([]string, 0, len(codes))
+	for _, code := range codes {
+		if name, ok := paymentMethodNames[code]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, code)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// appendUniqueMethod appends a method code unless it is already present
+func appendUniqueMethod(methods []string, code string) []string {
+	for _, m := range methods {
+		if m == code {
+			return methods
+		}
+	}
+	return append(methods, code)
+}
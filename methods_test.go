@@ -0,0 +1,87 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseOfferText(t *testing.T) {
+	tests := []struct {
+		command, text string
+		want          ParsedOffer
+		err           string
+	}{
+		{OfferTypeSellName, "100 usd 270 gel", ParsedOffer{HaveAmount: 10000, HaveCurrency: CurUSD, WantAmount: 27000, WantCurrency: CurGEL}, ""},
+		{OfferTypeBuyName, "100$ лари", ParsedOffer{HaveCurrency: CurGEL, WantAmount: 10000, WantCurrency: CurUSD}, ""},
+		{OfferTypeSellName, "100,5 usd gel", ParsedOffer{HaveAmount: 10050, HaveCurrency: CurUSD, WantCurrency: CurGEL}, ""},
+		// the longest method phrase wins, the same method is listed once
+		{OfferTypeSellName, "100 usd gel usdt trc20 trc-20 нал", ParsedOffer{HaveAmount: 10000, HaveCurrency: CurUSD, WantCurrency: CurGEL,
+			Methods: []string{MethodUSDTTRC20, MethodCash}}, ""},
+		// тбс is the bank, tbs is Tbilisi
+		{OfferTypeSellName, "100 usd gel тбс tbs", ParsedOffer{HaveAmount: 10000, HaveCurrency: CurUSD, WantCurrency: CurGEL,
+			Methods: []string{MethodTBC}, Location: "TBILISI"}, ""},
+		{OfferTypeSellName, "100 usd 270 gel 5 rub", ParsedOffer{}, "too many"},
+		{OfferTypeSellName, "usd gel", ParsedOffer{}, "at least one amount"},
+		{OfferTypeSellName, "100", ParsedOffer{}, "currency must be specified"},
+		{OfferTypeSellName, "cash card", ParsedOffer{}, "at least one amount"},
+	}
+	for _, tt := range tests {
+		got, _, err := parseOfferText(tt.command, tt.text)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("/%s %s: err = %v, want %q", tt.command, tt.text, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("/%s %s: %v", tt.command, tt.text, err)
+			continue
+		}
+		if got.HaveAmount != tt.want.HaveAmount || got.HaveCurrency != tt.want.HaveCurrency ||
+			got.WantAmount != tt.want.WantAmount || got.WantCurrency != tt.want.WantCurrency ||
+			!slices.Equal(got.Methods, tt.want.Methods) || got.Location != tt.want.Location {
+			t.Errorf("/%s %s = %+v, want %+v", tt.command, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestFindMatchingOffersByMethod(t *testing.T) {
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	t.Cleanup(func() { db.Close() })
+	for i, methods := range [][]string{{MethodCash}, {MethodTBC, MethodCard}, nil} {
+		replyID, err := saveReplyMessageID(db, MessageIndex{ChannelID: testChatID, MessageID: i + 1}, 100+i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := saveOffer(db, NewOffer{UserID: i + 1, Username: "seller", HaveAmount: 10000, HaveCurrency: CurUSD,
+			WantCurrency: CurGEL, ChannelID: testChatID, MessageID: i + 1, ReplyID: replyID, Methods: methods}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		methods []string
+		users   []int // sellers of the matching offers
+	}{
+		{nil, []int{1, 2, 3}},
+		{[]string{MethodCash}, []int{1, 3}},
+		{[]string{MethodCard, MethodBoG}, []int{2, 3}},
+		{[]string{MethodSBP}, []int{3}},
+	}
+	for _, tt := range tests {
+		offers, err := findMatchingOffers(db, testChatID, ParsedOffer{HaveCurrency: CurGEL, WantCurrency: CurUSD, WantAmount: 5000, Methods: tt.methods})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var users []int
+		for _, o := range offers {
+			users = append(users, o.UserID)
+		}
+		slices.Sort(users)
+		if !slices.Equal(users, tt.users) {
+			t.Errorf("offers matching methods %v are of users %v, want %v", tt.methods, users, tt.users)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Histogram buckets in seconds
+var (
+	commandBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+	queryBuckets   = []float64{0.0001, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1}
+)
+
+// Metrics collected while the bot runs; gauges are computed on scrape by metricsHandler
+var (
+	metricUpdates         = newCounterVec("exchangebot_updates_total", "Updates processed, by type.", "type")
+	metricCommandDuration = newHistogramVec("exchangebot_command_duration_seconds", "Time to handle a command, by command.", commandBuckets, "command")
+	metricTelegramErrors  = newCounterVec("exchangebot_telegram_errors_total", "Failed Telegram Bot API calls, by method.", "method")
+	metricRateFetches     = newCounterVec("exchangebot_rate_fetches_total", "Rate provider calls, by provider, endpoint and result.", "provider", "endpoint", "result")
+	metricQueryDuration   = newHistogramVec("exchangebot_db_query_duration_seconds", "Time of database queries, by function.", queryBuckets, "query")
+)
+
+// counterVec is a Prometheus counter with labels
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // by formatted label values
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// inc increments the counter with the label values, given in the order of label names
+func (c *counterVec) inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatValue(c.values[key]))
+	}
+}
+
+// histogramVec is a Prometheus histogram with labels
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64 // upper bounds, ascending
+	mu         sync.Mutex
+	series     map[string]*histogram // by label values joined with labelSeparator
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // observations per bucket, the last one is +Inf
+	sum         float64
+	count       uint64
+}
+
+// labelSeparator can't appear in label values the bot uses, which are command and function names
+const labelSeparator = "\x00"
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+// observe records the value with the label values, given in the order of label names
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, labelSeparator)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	i, _ := slices.BinarySearch(h.buckets, value)
+	s.counts[i]++
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatValue(h.buckets[i])
+			}
+			labels := formatLabels(append(h.labels[:len(h.labels):len(h.labels)], "le"), append(s.labelValues[:len(s.labelValues):len(s.labelValues)], le))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels, cumulative)
+		}
+		labels := formatLabels(h.labels, s.labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, s.count)
+	}
+}
+
+// gaugeSample is a value of a gauge computed on scrape
+type gaugeSample struct {
+	labelValues []string
+	value       float64
+}
+
+// writeGauge writes the gauge samples computed on scrape
+func writeGauge(w io.Writer, name, help string, labels []string, samples []gaugeSample) {
+	writeHeader(w, name, help, "gauge")
+	lines := make([]string, 0, len(samples))
+	for _, s := range samples {
+		lines = append(lines, fmt.Sprintf("%s%s %s\n", name, formatLabels(labels, s.labelValues), formatValue(s.value)))
+	}
+	slices.Sort(lines)
+	for _, line := range lines {
+		io.WriteString(w, line)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// formatLabels formats label pairs like {name="value"}, empty without labels
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		sb.WriteString(name + `="` + labelValueEscaper.Replace(value) + `"`)
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// observeQuery records the duration of the database function started at start:
+// defer observeQuery("getFilteredOffers", time.Now())
+func observeQuery(name string, start time.Time) {
+	metricQueryDuration.observe(time.Since(start).Seconds(), name)
+}
+
+// countRateFetch counts the result of a rate provider call and returns its error
+func countRateFetch(provider, endpoint string, err error) error {
+	result := "success"
+	switch {
+	case err == nil:
+	case errors.Is(err, errNoRate):
+		result = "no_rate"
+	case errors.Is(err, errCircuitOpen):
+		result = "circuit_open"
+	default:
+		result = "failure"
+	}
+	metricRateFetches.inc(provider, endpoint, result)
+	return err
+}
+
+// updateType names the kind of the update for metrics
+func updateType(update tgbotapi.Update) string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.EditedMessage != nil:
+		return "edited_message"
+	case update.ChannelPost != nil:
+		return "channel_post"
+	case update.EditedChannelPost != nil:
+		return "edited_channel_post"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	case update.InlineQuery != nil:
+		return "inline_query"
+	}
+	return "other"
+}
+
+// metricsHandler serves the collected metrics along with gauges of the rate cache and the database
+func metricsHandler(db *sql.DB, rates *tbcRateCache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metricUpdates.write(w)
+		metricCommandDuration.write(w)
+		metricTelegramErrors.write(w)
+		metricRateFetches.write(w)
+		metricQueryDuration.write(w)
+		metricAPIRequests.write(w)
+
+		if rates != nil {
+			_, _, snapshot := rates.snapshot()
+			now := time.Now()
+			var ages []gaugeSample
+			for code, rate := range snapshot {
+				if !rate.LastUpdated.IsZero() {
+					ages = append(ages, gaugeSample{[]string{code, rate.Source}, now.Sub(rate.LastUpdated).Seconds()})
+				}
+			}
+			writeGauge(w, "exchangebot_rate_age_seconds",
+				fmt.Sprintf("Time since the rate was fetched, by currency; rates older than %s are stale.", rateStaleThreshold),
+				[]string{"currency", "source"}, ages)
+		}
+
+		pairs, err := countOpenOffersByPair(db)
+		if err != nil {
+			slog.Error("Error counting open offers for metrics", "err", err)
+			return
+		}
+		var offers []gaugeSample
+		for _, p := range pairs {
+			offers = append(offers, gaugeSample{[]string{p.HaveCurrency, p.WantCurrency}, float64(p.Count)})
+		}
+		writeGauge(w, "exchangebot_open_offers", "Offers which haven't expired, by the currency offered and the one wanted.",
+			[]string{"have", "want"}, offers)
+	})
+}
+
+// startMetricsServer serves metrics at /metrics on the address until stop is called
+func startMetricsServer(addr string, db *sql.DB, rates *tbcRateCache) (stop func(), err error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsHandler(db, rates))
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error starting metrics listener: %w", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Metrics listener failed", "err", err)
+		}
+	}()
+	slog.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", ln.Addr()))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("Error stopping metrics listener", "err", err)
+		}
+		<-served
+	}, nil
+}
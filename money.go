@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Amount is an exact money amount in minor units of its currency, e.g., cents for USD.
+// The currency is kept alongside, the precision comes from the currency registry.
+type Amount int64
+
+// RoundingMode selects how an inexact result is rounded to the minor unit
+type RoundingMode int
+
+const (
+	RoundHalfEven RoundingMode = iota // to the nearest, ties to even; used for estimates
+	RoundHalfUp                       // to the nearest, ties away from zero
+	RoundDown                         // toward zero
+	RoundUp                           // away from zero
+)
+
+var errAmountTooLarge = errors.New("amount is too large")
+
+// pow10 returns 10^n as a big integer
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// parseDecimal parses a decimal number exactly; comma is accepted as the decimal separator
+func parseDecimal(s string) (*big.Rat, error) {
+	s = strings.ReplaceAll(s, ",", ".")
+	// big.Rat also accepts fractions and exponents, amounts are plain decimals only
+	if s == "" || strings.Trim(s, "0123456789.") != "" || strings.Count(s, ".") > 1 {
+		return nil, fmt.Errorf("invalid number %q", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid number %q", s)
+	}
+	return r, nil
+}
+
+// amountFromDecimal converts an exact decimal to the amount of the currency.
+// Fails if the decimal has more digits after the point than the currency allows.
+func amountFromDecimal(r *big.Rat, code string) (Amount, error) {
+	units := currencyMinorUnits(code)
+	scaled := new(big.Rat).Mul(r, new(big.Rat).SetInt(pow10(units)))
+	if !scaled.IsInt() {
+		if units == 0 {
+			return 0, fmt.Errorf("%s amounts must be whole, got %s", code, formatDecimal(r))
+		}
+		return 0, fmt.Errorf("%s amounts can't have more than %d digits after the decimal point, got %s",
+			code, units, formatDecimal(r))
+	}
+	if !scaled.Num().IsInt64() {
+		return 0, errAmountTooLarge
+	}
+	return Amount(scaled.Num().Int64()), nil
+}
+
+// roundRat rounds the rational number to an integer with the given mode
+func roundRat(r *big.Rat, mode RoundingMode) (int64, error) {
+	quo, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		away := false
+		switch mode {
+		case RoundUp:
+			away = true
+		case RoundHalfUp, RoundHalfEven:
+			// compare 2*|rem| with the denominator
+			cmp := new(big.Int).Abs(rem)
+			cmp.Lsh(cmp, 1)
+			switch cmp.Cmp(r.Denom()) {
+			case 1:
+				away = true
+			case 0:
+				away = mode == RoundHalfUp || new(big.Int).Abs(quo).Bit(0) == 1
+			}
+		}
+		if away {
+			quo.Add(quo, big.NewInt(int64(r.Sign())))
+		}
+	}
+	if !quo.IsInt64() {
+		return 0, errAmountTooLarge
+	}
+	return quo.Int64(), nil
+}
+
+// amountFromFloat converts a computed value, e.g., from a provider, to the amount of the currency
+func amountFromFloat(v float64, code string, mode RoundingMode) (Amount, error) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("invalid amount %v", v)
+	}
+	r := rateToRat(v)
+	r.Mul(r, new(big.Rat).SetInt(pow10(currencyMinorUnits(code))))
+	n, err := roundRat(r, mode)
+	return Amount(n), err
+}
+
+// rateToRat converts a float rate to its shortest decimal representation,
+// which is what providers send, rather than its binary approximation
+func rateToRat(v float64) *big.Rat {
+	r, _ := new(big.Rat).SetString(strconv.FormatFloat(v, 'g', -1, 64))
+	return r
+}
+
+// Rat returns the exact value of the amount in major units of the currency
+func (a Amount) Rat(code string) *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(int64(a)), pow10(currencyMinorUnits(code)))
+}
+
+// Float returns the approximate value in major units, for ratios and charts only
+func (a Amount) Float(code string) float64 {
+	f, _ := a.Rat(code).Float64()
+	return f
+}
+
+// convertAmount converts the amount at rates given in GEL per unit of each currency,
+// rounding to the minor unit of the target currency with the given mode
+func convertAmount(a Amount, from, to string, rateFrom, rateTo float64, mode RoundingMode) (Amount, error) {
+	if from == to {
+		return a, nil
+	}
+	if rateFrom <= 0 || rateTo <= 0 {
+		return 0, fmt.Errorf("invalid rate for %s or %s", from, to)
+	}
+	r := a.Rat(from)
+	r.Mul(r, rateToRat(rateFrom))
+	r.Quo(r, rateToRat(rateTo))
+	r.Mul(r, new(big.Rat).SetInt(pow10(currencyMinorUnits(to))))
+	n, err := roundRat(r, mode)
+	return Amount(n), err
+}
+
+// formatDecimal formats an exact decimal without trailing zeros, e.g., 100.5
+func formatDecimal(r *big.Rat) string {
+	s := r.FloatString(20)
+	return strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+}
+
+// formatAmount formats the amount with the precision of the currency, e.g., 100.50 for USD
+func formatAmount(amount Amount, code string) string {
+	return amount.Rat(code).FloatString(currencyMinorUnits(code))
+}
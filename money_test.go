@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestParseDecimal(t *testing.T) {
+	tests := []struct {
+		text, want string // want is empty if the text is invalid
+	}{
+		{"100", "100"},
+		{"100.5", "100.5"},
+		{"100,5", "100.5"},
+		{"0.1", "0.1"},
+		{".5", "0.5"},
+		{"1.2.3", ""},
+		{"1e3", ""},
+		{"1/3", ""},
+		{"-5", ""},
+		{"", ""},
+		{"abc", ""},
+	}
+	for _, tt := range tests {
+		got, err := parseDecimal(tt.text)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("parseDecimal(%q) = %s, want an error", tt.text, formatDecimal(got))
+		case tt.want != "" && err != nil:
+			t.Errorf("parseDecimal(%q): %v", tt.text, err)
+		case tt.want != "" && formatDecimal(got) != tt.want:
+			t.Errorf("parseDecimal(%q) = %s, want %s", tt.text, formatDecimal(got), tt.want)
+		}
+	}
+}
+
+func TestAmountFromDecimal(t *testing.T) {
+	tests := []struct {
+		text, code string
+		want       Amount
+		err        string
+	}{
+		{"100.5", CurUSD, 10050, ""},
+		{"100.50", CurUSD, 10050, ""},
+		{"0.01", CurUSD, 1, ""},
+		{"100.555", CurUSD, 0, "more than 2 digits"},
+		{"100", "JPY", 100, ""},
+		{"100.5", "JPY", 0, "must be whole"},
+		{"1.234", "KWD", 1234, ""},
+		{"92233720368547758.07", CurUSD, 9223372036854775807, ""}, // the largest int64 of minor units
+		{"92233720368547758.08", CurUSD, 0, errAmountTooLarge.Error()},
+		{"9223372036854775808", "JPY", 0, errAmountTooLarge.Error()},
+	}
+	for _, tt := range tests {
+		r, err := parseDecimal(tt.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := amountFromDecimal(r, tt.code)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("amountFromDecimal(%s %s) = %d, %v; want error %q", tt.text, tt.code, got, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("amountFromDecimal(%s %s) = %d, %v; want %d", tt.text, tt.code, got, err, tt.want)
+		}
+	}
+}
+
+func TestRoundRat(t *testing.T) {
+	tests := []struct {
+		num, denom int64
+		mode       RoundingMode
+		want       int64
+	}{
+		// ties go to the even neighbor
+		{5, 2, RoundHalfEven, 2},
+		{7, 2, RoundHalfEven, 4},
+		{-5, 2, RoundHalfEven, -2},
+		{-7, 2, RoundHalfEven, -4},
+		{1, 2, RoundHalfEven, 0},
+		{26, 10, RoundHalfEven, 3},
+		{24, 10, RoundHalfEven, 2},
+		// ties go away from zero
+		{5, 2, RoundHalfUp, 3},
+		{-5, 2, RoundHalfUp, -3},
+		{24, 10, RoundHalfUp, 2},
+		{29, 10, RoundDown, 2},
+		{-29, 10, RoundDown, -2},
+		{21, 10, RoundUp, 3},
+		{-21, 10, RoundUp, -3},
+		{4, 2, RoundUp, 2},
+	}
+	for _, tt := range tests {
+		got, err := roundRat(big.NewRat(tt.num, tt.denom), tt.mode)
+		if err != nil || got != tt.want {
+			t.Errorf("roundRat(%d/%d, %d) = %d, %v; want %d", tt.num, tt.denom, tt.mode, got, err, tt.want)
+		}
+	}
+	huge := new(big.Rat).SetInt(new(big.Int).Lsh(big.NewInt(1), 63))
+	if _, err := roundRat(huge, RoundHalfEven); !errors.Is(err, errAmountTooLarge) {
+		t.Errorf("roundRat(2^63): err = %v, want %v", err, errAmountTooLarge)
+	}
+}
+
+func TestConvertAmount(t *testing.T) {
+	tests := []struct {
+		amount           Amount
+		from, to         string
+		rateFrom, rateTo float64
+		mode             RoundingMode
+		want             Amount
+	}{
+		{10000, CurUSD, CurGEL, 2.7, 1, RoundHalfEven, 27000},
+		// 0.125 GEL is a tie: down to the even 0.12, up with half up
+		{5, "JPY", CurGEL, 0.025, 1, RoundHalfEven, 12},
+		{5, "JPY", CurGEL, 0.025, 1, RoundHalfUp, 13},
+		// 0.135 GEL rounds to the even 0.14
+		{27, "JPY", CurGEL, 0.005, 1, RoundHalfEven, 14},
+		// rates are taken as the decimals providers send: 0.3 / 0.1 is exactly 3, not 2.999…
+		{10, CurUSD, CurGEL, 0.3, 0.1, RoundDown, 30},
+		{1000, CurGEL, "JPY", 1, 0.0185, RoundHalfEven, 541},
+		{1000, CurGEL, "KWD", 1, 8.9, RoundHalfEven, 1124},
+		{12345, CurUSD, CurUSD, 2.7, 2.7, RoundUp, 12345},
+	}
+	for _, tt := range tests {
+		got, err := convertAmount(tt.amount, tt.from, tt.to, tt.rateFrom, tt.rateTo, tt.mode)
+		if err != nil || got != tt.want {
+			t.Errorf("convertAmount(%d %s to %s at %v/%v, %d) = %d, %v; want %d",
+				tt.amount, tt.from, tt.to, tt.rateFrom, tt.rateTo, tt.mode, got, err, tt.want)
+		}
+	}
+	if _, err := convertAmount(9223372036854775807, CurUSD, CurGEL, 2.7, 1, RoundHalfEven); !errors.Is(err, errAmountTooLarge) {
+		t.Errorf("converting the largest amount: err = %v, want %v", err, errAmountTooLarge)
+	}
+	if _, err := convertAmount(100, CurUSD, CurGEL, 0, 1, RoundHalfEven); err == nil {
+		t.Error("converting at a zero rate: no error")
+	}
+}
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		amount Amount
+		code   string
+		want   string
+	}{
+		{10050, CurUSD, "100.50"},
+		{5, CurUSD, "0.05"},
+		{-5, CurUSD, "-0.05"},
+		{100, "JPY", "100"},
+		{1234, "KWD", "1.234"},
+		{9223372036854775807, CurUSD, "92233720368547758.07"},
+	}
+	for _, tt := range tests {
+		if got := formatAmount(tt.amount, tt.code); got != tt.want {
+			t.Errorf("formatAmount(%d, %s) = %q, want %q", tt.amount, tt.code, got, tt.want)
+		}
+	}
+}
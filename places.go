@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+)
+
+// placeSpec describes a city or a district recognized in offers and user profiles
+type placeSpec struct {
+	Code    string   `json:"code"`           // normalized code, e.g., TBILISI
+	Name    string   `json:"name"`           // display name, e.g., Tbilisi
+	City    string   `json:"city,omitempty"` // parent city code for districts, empty for cities
+	Aliases []string `json:"aliases"`        // lowercase aliases; multi-word aliases are separated by a single space
+}
+
+// defaultPlaceSpecs is used when there is no places.json next to settings.json
+var defaultPlaceSpecs = []placeSpec{
+	{Code: "TBILISI", Name: "Tbilisi", Aliases: []string{"tbilisi", "tbs", "тбилиси", "თბილისი"}},
+	{Code: "SABURTALO", Name: "Saburtalo", City: "TBILISI", Aliases: []string{"saburtalo", "сабуртало"}},
+	{Code: "VAKE", Name: "Vake", City: "TBILISI", Aliases: []string{"vake", "ваке"}},
+	{Code: "DIDUBE", Name: "Didube", City: "TBILISI", Aliases: []string{"didube", "дидубе"}},
+	{Code: "GLDANI", Name: "Gldani", City: "TBILISI", Aliases: []string{"gldani", "глдани"}},
+	{Code: "ISANI", Name: "Isani", City: "TBILISI", Aliases: []string{"isani", "исани"}},
+	{Code: "OLD_TBILISI", Name: "Old Tbilisi", City: "TBILISI", Aliases: []string{"old tbilisi", "старый тбилиси", "старый город"}},
+	{Code: "BATUMI", Name: "Batumi", Aliases: []string{"batumi", "батуми", "ბათუმი"}},
+	{Code: "KUTAISI", Name: "Kutaisi", Aliases: []string{"kutaisi", "кутаиси", "ქუთაისი"}},
+	{Code: "RUSTAVI", Name: "Rustavi", Aliases: []string{"rustavi", "рустави", "რუსთავი"}},
+}
+
+// Derived from the place dictionary
+var (
+	placeByCode      map[string]placeSpec
+	placeAliasToCode map[string]string
+	placeMaxWords    int
+)
+
+func init() {
+	if err := initPlaceMappings(defaultPlaceSpecs); err != nil {
+		log.Panicf("invalid built-in place dictionary: %v", err)
+	}
+}
+
+// initPlaceMappings validates the place dictionary and rebuilds lookup maps from it
+func initPlaceMappings(specs []placeSpec) error {
+	byCode := make(map[string]placeSpec, len(specs))
+	aliases := make(map[string]string)
+	maxWords := 1
+	for _, s := range specs {
+		s.Code = strings.ToUpper(strings.TrimSpace(s.Code))
+		s.City = strings.ToUpper(strings.TrimSpace(s.City))
+		if s.Code == "" {
+			return fmt.Errorf("place without code: %+v", s)
+		}
+		if _, dup := byCode[s.Code]; dup {
+			return fmt.Errorf("duplicate place code %s", s.Code)
+		}
+		if s.Name == "" {
+			s.Name = s.Code
+		}
+		byCode[s.Code] = s
+		for _, a := range append([]string{strings.ToLower(s.Code)}, s.Aliases...) {
+			a = strings.Join(strings.Fields(strings.ToLower(a)), " ")
+			if other, dup := aliases[a]; dup && other != s.Code {
+				return fmt.Errorf("alias %q is used by both %s and %s", a, other, s.Code)
+			}
+			aliases[a] = s.Code
+			if n := len(strings.Fields(a)); n > maxWords {
+				maxWords = n
+			}
+		}
+	}
+	for _, s := range byCode {
+		if s.City == "" {
+			continue
+		}
+		parent, ok := byCode[s.City]
+		if !ok {
+			return fmt.Errorf("place %s refers to unknown city %s", s.Code, s.City)
+		}
+		if parent.City != "" {
+			return fmt.Errorf("place %s refers to %s, which is not a city", s.Code, s.City)
+		}
+	}
+
+	placeByCode = byCode
+	placeAliasToCode = aliases
+	placeMaxWords = maxWords
+	return nil
+}
+
+// loadPlaces replaces the built-in place dictionary with the one from the file, if it exists
+func loadPlaces(filePath string) error {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil
+	}
+	var specs []placeSpec
+	if err := json.Unmarshal(loadFile(filePath, "places"), &specs); err != nil {
+		return fmt.Errorf("error parsing places file: %v", err)
+	}
+	if err := initPlaceMappings(specs); err != nil {
+		return fmt.Errorf("error in places file %s: %v", filePath, err)
+	}
+	slog.Info("Loaded places", "count", len(specs), "file", filePath)
+	return nil
+}
+
+// matchPlace checks whether the tokens starting at index i name a place.
+// Tokens must already be lowercased. Returns the place code and the number of tokens consumed.
+func matchPlace(tokens []string, i int) (code string, consumed int) {
+	return matchAliasPhrase(placeAliasToCode, placeMaxWords, tokens, i)
+}
+
+// parsePlace looks up a place by free text, e.g., "Batumi" or "old tbilisi"
+func parsePlace(text string) (string, bool) {
+	tokens := strings.Fields(strings.ToLower(text))
+	if len(tokens) == 0 {
+		return "", false
+	}
+	code, n := matchPlace(tokens, 0)
+	return code, n == len(tokens)
+}
+
+// placeCity returns the city code of a place: the place itself for cities, the parent for districts
+func placeCity(code string) string {
+	if p, ok := placeByCode[code]; ok && p.City != "" {
+		return p.City
+	}
+	return code
+}
+
+// cityPlaceCodes returns the city of the place and all of its districts
+func cityPlaceCodes(code string) []string {
+	city := placeCity(code)
+	codes := []string{city}
+	for c, p := range placeByCode {
+		if p.City == city {
+			codes = append(codes, c)
+		}
+	}
+	sort.Strings(codes[1:])
+	return codes
+}
+
+// mergePlaces combines two places mentioned in the same offer, preferring the more specific one.
+// Returns false if they are unrelated.
+func mergePlaces(a, b string) (string, bool) {
+	switch {
+	case a == "" || a == b:
+		return b, true
+	case b == "":
+		return a, true
+	case placeByCode[b].City == a:
+		return b, true
+	case placeByCode[a].City == b:
+		return a, true
+	}
+	return "", false
+}
+
+// formatPlace returns the display name of a place, including its city for districts
+func formatPlace(code string) string {
+	p, ok := placeByCode[code]
+	if !ok {
+		return code
+	}
+	if p.City != "" {
+		return p.Name + ", " + formatPlace(p.City)
+	}
+	return p.Name
+}
+
+// placesHelp lists the known cities and their districts
+func placesHelp() string {
+	var cities []string
+	for code, p := range placeByCode {
+		if p.City == "" {
+			cities = append(cities, code)
+		}
+	}
+	sort.Strings(cities)
+	parts := make([]string, 0, len(cities))
+	for _, city := range cities {
+		names := []string{}
+		for _, code := range cityPlaceCodes(city)[1:] {
+			names = append(names, placeByCode[code].Name)
+		}
+		if len(names) > 0 {
+			parts = append(parts, fmt.Sprintf("%s (%s)", placeByCode[city].Name, strings.Join(names, ", ")))
+		} else {
+			parts = append(parts, placeByCode[city].Name)
+		}
+	}
+	return "Known places: " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParsePlace(t *testing.T) {
+	tests := []struct {
+		text, want string
+		ok         bool
+	}{
+		{"Batumi", "BATUMI", true},
+		{"тбилиси", "TBILISI", true},
+		{"old  Tbilisi", "OLD_TBILISI", true}, // the longest phrase wins over "tbilisi"
+		{"старый город", "OLD_TBILISI", true},
+		{"vake", "VAKE", true},
+		{"gldani", "GLDANI", true},
+		{"vake street", "VAKE", false}, // only a whole text is a place
+		{"moscow", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := parsePlace(tt.text); got != tt.want || ok != tt.ok {
+			t.Errorf("parsePlace(%q) = %q, %v; want %q, %v", tt.text, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMergePlaces(t *testing.T) {
+	tests := []struct {
+		a, b, want string
+		ok         bool
+	}{
+		{"", "VAKE", "VAKE", true},
+		{"BATUMI", "", "BATUMI", true},
+		{"TBILISI", "VAKE", "VAKE", true}, // the district is more specific than its city
+		{"VAKE", "TBILISI", "VAKE", true},
+		{"VAKE", "VAKE", "VAKE", true},
+		{"VAKE", "ISANI", "", false},
+		{"BATUMI", "VAKE", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := mergePlaces(tt.a, tt.b); got != tt.want || ok != tt.ok {
+			t.Errorf("mergePlaces(%q, %q) = %q, %v; want %q, %v", tt.a, tt.b, got, ok, tt.want, tt.ok)
+		}
+	}
+	if got := cityPlaceCodes("VAKE"); got[0] != "TBILISI" || !slices.Contains(got, "SABURTALO") || slices.Contains(got, "BATUMI") {
+		t.Errorf("cityPlaceCodes(VAKE) = %v", got)
+	}
+	if got := formatPlace("VAKE"); got != "Vake, Tbilisi" {
+		t.Errorf("formatPlace(VAKE) = %q", got)
+	}
+}
+
+func TestInitPlaceMappingsErrors(t *testing.T) {
+	t.Cleanup(func() {
+		if err := initPlaceMappings(defaultPlaceSpecs); err != nil {
+			t.Fatal(err)
+		}
+	})
+	tests := []struct {
+		specs []placeSpec
+		err   string
+	}{
+		{[]placeSpec{{Code: "A", Aliases: []string{"x"}}, {Code: "B", Aliases: []string{"X "}}}, `alias "x" is used by both A and B`},
+		{[]placeSpec{{Code: "A"}, {Code: "B", Aliases: []string{"a"}}}, `alias "a" is used by both A and B`},
+		{[]placeSpec{{Code: "A"}, {Code: "a"}}, "duplicate place code A"},
+		{[]placeSpec{{Code: "D", City: "C"}}, "unknown city C"},
+		{[]placeSpec{{Code: "C"}, {Code: "D", City: "C"}, {Code: "E", City: "D"}}, "not a city"},
+		{[]placeSpec{{Name: "Nowhere"}}, "without code"},
+	}
+	for _, tt := range tests {
+		err := initPlaceMappings(tt.specs)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("initPlaceMappings(%+v): err = %v, want %q", tt.specs, err, tt.err)
+		}
+	}
+	// a failed load keeps the places in effect
+	if got, ok := parsePlace("batumi"); !ok || got != "BATUMI" {
+		t.Errorf("places are replaced by an invalid dictionary: %q, %v", got, ok)
+	}
+}
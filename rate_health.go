@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Rate provider endpoints tracked separately by the circuit breakers
+const (
+	endpointList       = "list"
+	endpointSingle     = "single"
+	endpointConvert    = "convert"
+	endpointCommercial = "commercial"
+)
+
+// Circuit breaker tuning: the breaker opens after breakerFailureThreshold consecutive failures
+// for breakerBaseBackoff, doubling on every failed probe up to breakerMaxBackoff
+const (
+	breakerFailureThreshold = 3
+	breakerBaseBackoff      = 30 * time.Second
+	breakerMaxBackoff       = 30 * time.Minute
+)
+
+// errCircuitOpen is returned instead of calling an endpoint whose breaker is open
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // calls pass through
+	breakerOpen                         // calls fail immediately until the backoff expires
+	breakerHalfOpen                     // a single probe call is let through
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker holds the health of a single provider endpoint
+type circuitBreaker struct {
+	state       breakerState
+	failures    int // consecutive
+	succeeded   int64
+	failed      int64
+	rejected    int64 // calls not made while open
+	backoff     time.Duration
+	openUntil   time.Time
+	probing     bool // a half-open probe is in flight
+	lastError   string
+	lastSuccess time.Time
+	lastFailure time.Time
+}
+
+// rateHealth tracks failures of rate provider endpoints and stops calling failing ones for a while,
+// so a provider being down doesn't make every command wait for its timeouts.
+// All methods are safe for concurrent use; a nil *rateHealth calls endpoints unguarded.
+type rateHealth struct {
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker // keyed by provider/endpoint
+	reports  chan string                // breaker state changes, in order; nil if not reported
+}
+
+// newRateHealth creates the breakers; report, if not nil, receives state changes in order
+func newRateHealth(report func(string)) *rateHealth {
+	h := &rateHealth{breakers: make(map[string]*circuitBreaker)}
+	if report != nil {
+		h.reports = make(chan string, 32)
+		go func() {
+			for msg := range h.reports {
+				report(msg)
+			}
+		}()
+	}
+	return h
+}
+
+// call runs fn through the breaker of the provider endpoint, counting the result in metrics.
+// errNoRate is an answer rather than a failure and doesn't count against the endpoint.
+func (h *rateHealth) call(provider, endpoint string, fn func() error) error {
+	if h == nil {
+		return countRateFetch(provider, endpoint, fn())
+	}
+	key := provider + "/" + endpoint
+	if err := h.allow(key); err != nil {
+		return countRateFetch(provider, endpoint, err)
+	}
+	err := countRateFetch(provider, endpoint, fn())
+	h.record(key, err == nil || errors.Is(err, errNoRate), err)
+	return err
+}
+
+// allow checks whether the endpoint may be called now, moving an expired open breaker to half-open
+func (h *rateHealth) allow(key string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b, ok := h.breakers[key]
+	if !ok {
+		b = &circuitBreaker{}
+		h.breakers[key] = b
+	}
+	switch b.state {
+	case breakerOpen:
+		if time.Now().Before(b.openUntil) {
+			b.rejected++
+			return fmt.Errorf("%w until %s", errCircuitOpen, b.openUntil.Format("15:04:05"))
+		}
+		h.setState(key, b, breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing {
+			b.rejected++
+			return fmt.Errorf("%w, probe in progress", errCircuitOpen)
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a call
+func (h *rateHealth) record(key string, ok bool, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := h.breakers[key]
+	now := time.Now()
+	b.probing = false
+	if ok {
+		b.succeeded++
+		b.failures = 0
+		b.backoff = 0
+		b.lastSuccess = now
+		h.setState(key, b, breakerClosed)
+		return
+	}
+	b.failed++
+	b.failures++
+	b.lastFailure = now
+	b.lastError = err.Error()
+	switch {
+	case b.state == breakerHalfOpen:
+		b.backoff = min(b.backoff*2, breakerMaxBackoff)
+	case b.failures >= breakerFailureThreshold:
+		b.backoff = breakerBaseBackoff
+	default:
+		return
+	}
+	b.openUntil = now.Add(b.backoff)
+	h.setState(key, b, breakerOpen)
+}
+
+// setState changes the breaker state, reporting changes. Must be called with the mutex held.
+func (h *rateHealth) setState(key string, b *circuitBreaker, state breakerState) {
+	if b.state == state {
+		return
+	}
+	from := b.state
+	b.state = state
+	if h.reports == nil {
+		return
+	}
+	msg := fmt.Sprintf("Rate provider %s: circuit %s -> %s", key, from, state)
+	if state == breakerOpen {
+		msg += fmt.Sprintf(" for %s after %d failures, last error: %s", b.backoff, b.failures, b.lastError)
+	}
+	// don't block callers holding the mutex on sending the report
+	select {
+	case h.reports <- msg:
+	default:
+		slog.Warn("Dropped rate provider health report", "report", msg)
+	}
+}
+
+// summary describes the state and counters of every endpoint called so far
+func (h *rateHealth) summary() string {
+	if h == nil {
+		return ""
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.breakers))
+	for k := range h.breakers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		b := h.breakers[k]
+		sb.WriteString(fmt.Sprintf("%s: %s ok=%d failed=%d skipped=%d", k, b.state, b.succeeded, b.failed, b.rejected))
+		if b.state == breakerOpen {
+			sb.WriteString(" retry at " + b.openUntil.Format("15:04:05"))
+		}
+		if b.failures > 0 {
+			sb.WriteString(fmt.Sprintf(" (%d failures in a row, last: %s)", b.failures, b.lastError))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateHealthBreaker(t *testing.T) {
+	reports := make(chan string, 32)
+	h := newRateHealth(func(msg string) { reports <- msg })
+	const key = ProviderTBCNBG + "/" + endpointList
+	errDown := errors.New("provider is down")
+	calls := 0
+	call := func(err error) error {
+		t.Helper()
+		return h.call(ProviderTBCNBG, endpointList, func() error {
+			calls++
+			return err
+		})
+	}
+	state := func() breakerState {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.breakers[key].state
+	}
+	// expire the backoff instead of waiting for it
+	expire := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.breakers[key].openUntil = time.Now().Add(-time.Second)
+	}
+	backoff := func() time.Duration {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.breakers[key].backoff
+	}
+
+	// errNoRate is an answer, it doesn't open the breaker
+	for range breakerFailureThreshold {
+		if err := call(fmt.Errorf("no USD: %w", errNoRate)); !errors.Is(err, errNoRate) {
+			t.Fatalf("call = %v, want %v", err, errNoRate)
+		}
+	}
+	if state() != breakerClosed {
+		t.Fatalf("breaker is %s after missing rates, want closed", state())
+	}
+
+	for i := range breakerFailureThreshold {
+		if state() != breakerClosed {
+			t.Fatalf("breaker is %s after %d failures, want closed", state(), i)
+		}
+		if err := call(errDown); !errors.Is(err, errDown) {
+			t.Fatalf("call = %v, want %v", err, errDown)
+		}
+	}
+	if state() != breakerOpen || backoff() != breakerBaseBackoff {
+		t.Fatalf("breaker is %s for %s after %d failures, want open for %s", state(), backoff(), breakerFailureThreshold, breakerBaseBackoff)
+	}
+	calls = 0
+	if err := call(nil); !errors.Is(err, errCircuitOpen) || calls != 0 {
+		t.Errorf("call through the open breaker = %v with %d calls, want %v without calls", err, calls, errCircuitOpen)
+	}
+
+	// a failed probe opens the breaker again for twice as long
+	expire()
+	if err := call(errDown); !errors.Is(err, errDown) {
+		t.Fatalf("failed probe = %v, want %v", err, errDown)
+	}
+	if state() != breakerOpen || backoff() != 2*breakerBaseBackoff {
+		t.Fatalf("breaker is %s for %s after a failed probe, want open for %s", state(), backoff(), 2*breakerBaseBackoff)
+	}
+
+	expire()
+	if err := h.allow(key); err != nil {
+		t.Fatalf("probe after the backoff is rejected: %v", err)
+	}
+	if state() != breakerHalfOpen {
+		t.Fatalf("breaker is %s during the probe, want half-open", state())
+	}
+	calls = 0
+	if err := call(nil); !errors.Is(err, errCircuitOpen) || calls != 0 {
+		t.Errorf("call during the probe = %v with %d calls, want %v without calls", err, calls, errCircuitOpen)
+	}
+	h.record(key, true, nil)
+	if state() != breakerClosed || backoff() != 0 {
+		t.Fatalf("breaker is %s for %s after a successful probe, want closed", state(), backoff())
+	}
+	if err := call(nil); err != nil || calls != 1 {
+		t.Errorf("call through the recovered breaker = %v with %d calls", err, calls)
+	}
+
+	// every state change is reported in order
+	want := []string{"closed -> open", "open -> half-open", "half-open -> open", "open -> half-open", "half-open -> closed"}
+	for _, w := range want {
+		select {
+		case msg := <-reports:
+			if !strings.Contains(msg, key+": circuit "+w) {
+				t.Errorf("reported %q, want %q", msg, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("state change %q isn't reported", w)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Source recorded for rates fetched from the NBG website for a specific date
+const rateSourceNBG = "nbg"
+
+// Sources whose stored rates are official NBG rates for their rate_date
+var officialRateSources = []string{rateSourceNBG, ProviderTBCNBG}
+
+// NBG API structures
+type nbgCurrencyRate struct {
+	Code     string  `json:"code"`
+	Quantity float64 `json:"quantity"` // the rate is given per this many units
+	Rate     float64 `json:"rate"`
+}
+
+type nbgRatesResponse []struct {
+	Date       string            `json:"date"`
+	Currencies []nbgCurrencyRate `json:"currencies"`
+}
+
+// fetchNBGRatesOn fetches official NBG rates effective on the date, in GEL per unit.
+// NBG publishes them for any past date, no API key required; the date is appended to endpoint.
+func fetchNBGRatesOn(ctx context.Context, endpoint, date string) (map[string]float64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+date, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := tbcHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("NBG request for %s failed with status %s", date, resp.Status)
+	}
+	var data nbgRatesResponse
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("error decoding NBG rates: %v", err)
+	}
+	rates := make(map[string]float64)
+	for _, day := range data {
+		for _, r := range day.Currencies {
+			if r.Rate <= 0 {
+				continue
+			}
+			if r.Quantity <= 0 {
+				r.Quantity = 1
+			}
+			rates[strings.ToUpper(r.Code)] = r.Rate / r.Quantity
+		}
+	}
+	if len(rates) == 0 {
+		return nil, fmt.Errorf("NBG has no rates for %s", date)
+	}
+	return rates, nil
+}
+
+// parseRateDate parses a YYYY-MM-DD date for historical rate lookups, rejecting future dates
+func parseRateDate(s string) (string, error) {
+	date, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return "", fmt.Errorf("invalid date %q, expected YYYY-MM-DD", s)
+	}
+	if date.After(time.Now()) {
+		return "", fmt.Errorf("no rates for the future date %s", s)
+	}
+	return date.Format(time.DateOnly), nil
+}
+
+// historicalRates returns official rates effective on the date, in GEL per unit, including the given currencies.
+// Stored history is used first; if it lacks any of the currencies, e.g., when only some rates of today
+// were stored, rates are fetched from NBG and stored for later lookups.
+// Doesn't touch the rate cache, so it is safe to call from any goroutine.
+func historicalRates(db *sql.DB, nbgURL, date string, codes ...string) (map[string]float64, error) {
+	stored, err := getRatesOnDate(db, date, officialRateSources)
+	if err != nil {
+		return nil, err
+	}
+	complete := len(stored) > 0
+	for _, code := range codes {
+		if _, ok := stored[code]; !ok && code != CurGEL {
+			complete = false
+		}
+	}
+	if complete {
+		return stored, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rates, err := fetchNBGRatesOn(ctx, nbgURL, date)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveRatesOnDate(db, date, rateSourceNBG, rates); err != nil {
+		return nil, err
+	}
+	for code, rate := range stored {
+		if _, ok := rates[code]; !ok {
+			rates[code] = rate
+		}
+	}
+	return rates, nil
+}
+
+// convertByHistoricalRates converts the amount by official rates effective on the date, rounding half to even
+func convertByHistoricalRates(db *sql.DB, nbgURL, date, from, to string, amount Amount) (Amount, error) {
+	rates, err := historicalRates(db, nbgURL, date, from, to)
+	if err != nil {
+		return 0, err
+	}
+	rates[CurGEL] = 1
+	rateFrom, okFrom := rates[from]
+	rateTo, okTo := rates[to]
+	if !okFrom || !okTo {
+		missing := from
+		if okFrom {
+			missing = to
+		}
+		return 0, fmt.Errorf("NBG has no rate for %s on %s", missing, date)
+	}
+	return convertAmount(amount, from, to, rateFrom, rateTo, RoundHalfEven)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHistoricalRatesFetchMissingCurrency(t *testing.T) {
+	const date = "2025-03-01"
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	t.Cleanup(func() { db.Close() })
+	var fetches atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		day := map[string]any{"date": date, "currencies": []nbgCurrencyRate{
+			{Code: CurUSD, Quantity: 1, Rate: 2.75},
+			{Code: "EUR", Quantity: 1, Rate: 3},
+			{Code: "AMD", Quantity: 100, Rate: 0.7},
+		}}
+		json.NewEncoder(w).Encode([]any{day})
+	}))
+	t.Cleanup(srv.Close)
+	nbgURL := srv.URL + "/?date="
+
+	// some rates of the day were stored, e.g., the current USD rate from TBC
+	if err := saveRatesOnDate(db, date, ProviderTBCNBG, map[string]float64{CurUSD: 2.7}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := convertByHistoricalRates(db, nbgURL, date, CurUSD, CurGEL, 10000); err != nil || got != 27000 {
+		t.Errorf("100 USD on %s = %v, %v; want 270.00 GEL by the stored rate", date, got, err)
+	}
+	if n := fetches.Load(); n != 0 {
+		t.Errorf("stored rates are fetched again, %d requests", n)
+	}
+
+	if got, err := convertByHistoricalRates(db, nbgURL, date, "EUR", "AMD", 100); err != nil || got != 42857 {
+		t.Errorf("1 EUR on %s = %v, %v; want 428.57 AMD", date, got, err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("rates missing from the stored ones are fetched in %d requests, want 1", n)
+	}
+	// the fetched rates are stored for later lookups
+	if _, err := convertByHistoricalRates(db, nbgURL, date, "AMD", "EUR", 100000); err != nil {
+		t.Fatal(err)
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("fetched rates are not stored, %d requests", n)
+	}
+}
+
+func TestLoadLatestRates(t *testing.T) {
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	t.Cleanup(func() { db.Close() })
+	rows := []struct {
+		code, source, date string
+		value              float64
+	}{
+		{CurUSD, ProviderTBCNBG, "2025-03-02", 2.72},
+		{CurUSD, ProviderTBCNBG, "2025-03-01", 2.71}, // stored later, but effective earlier
+		{CurUSD, ProviderTBCNBG, "2025-03-01", 2.70},
+		{CurUSD, rateSourceNBG, "2025-03-03", 2.80}, // fetched for /rates on a date
+		{CurUSD, ProviderTBCNBG, "2024-01-01", 2.60},
+		{"EUR", ProviderTBCNBG, "2025-03-01", 3.00},
+	}
+	for _, r := range rows {
+		if _, err := db.Exec("INSERT INTO rates_history (currency, value, source, rate_date) VALUES (?, ?, ?, ?)",
+			r.code, r.value, r.source, r.date); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rates, _, err := loadLatestRates(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rates[CurUSD].value != 2.72 || rates["EUR"].value != 3.00 || len(rates) != 2 {
+		t.Errorf("latest rates = %+v", rates)
+	}
+}
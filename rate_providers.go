@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider names used in the rate_providers setting and shown in /rates
+const (
+	ProviderManual        = "manual"
+	ProviderTBCNBG        = "tbc-nbg"
+	ProviderTBCCommercial = "tbc-commercial"
+	ProviderStatic        = "static"
+)
+
+// defaultRateProviders is the provider order unless configured otherwise
+var defaultRateProviders = []string{ProviderManual, ProviderTBCNBG, ProviderTBCCommercial, ProviderStatic}
+
+// RateProvider is a source of exchange rates, expressed in GEL per unit of currency
+type RateProvider interface {
+	// Name identifies the provider in settings and in /rates
+	Name() string
+	// FetchRates returns all rates known to the provider, keyed by currency code
+	FetchRates(ctx context.Context) (map[string]float64, error)
+	// FetchRate returns the rate of a single currency
+	FetchRate(ctx context.Context, code string) (float64, error)
+}
+
+// rateConverter is implemented by providers able to convert amounts on their side
+type rateConverter interface {
+	Convert(ctx context.Context, from, to string, amount float64) (float64, error)
+}
+
+// commercialRateSource is implemented by providers knowing bank buy/sell rates
+type commercialRateSource interface {
+	FetchCommercialRates(ctx context.Context) (map[string]tbcCommercialRateCached, error)
+}
+
+// errNoRate is returned by providers which don't know the requested currency
+var errNoRate = errors.New("no rate for the currency")
+
+// newRateProviders creates providers in the order configured in settings.
+// Providers which can't work with the given configuration are skipped with a log message.
+// Rates of the manual provider are kept in db, which may be nil to keep them in memory only.
+func newRateProviders(settings *Settings, secrets *Secrets, db *sql.DB) ([]RateProvider, error) {
+	names := settings.RateProviders
+	staticRatesPath := getStaticRatesPath(settings)
+	if len(names) == 0 {
+		names = defaultRateProviders
+	}
+	providers := make([]RateProvider, 0, len(names))
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case ProviderManual:
+			manual, err := newManualRateProvider(db)
+			if err != nil {
+				return nil, err
+			}
+			providers = append(providers, manual)
+		case ProviderTBCNBG, ProviderTBCCommercial:
+			if strings.TrimSpace(secrets.TBCApiKey) == "" {
+				slog.Warn("Missing TBC API key, rate provider disabled. Please create a developer account and obtain an API key: https://developers.tbcbank.ge/docs/create-developer-account", "provider", name)
+				continue
+			}
+			if name == ProviderTBCNBG {
+				providers = append(providers, &tbcNbgProvider{apiKey: secrets.TBCApiKey, baseURL: settings.tbcRatesBaseURL()})
+			} else {
+				providers = append(providers, &tbcCommercialProvider{apiKey: secrets.TBCApiKey, baseURL: settings.tbcRatesBaseURL()})
+			}
+		case ProviderStatic:
+			if _, err := os.Stat(staticRatesPath); err != nil {
+				slog.Warn("Static rates file is not available, rate provider disabled", "file", staticRatesPath, "provider", name, "err", err)
+				continue
+			}
+			providers = append(providers, &staticFileRateProvider{path: staticRatesPath})
+		default:
+			return nil, fmt.Errorf("unknown rate provider %q", name)
+		}
+	}
+	return providers, nil
+}
+
+// tbcGetJSON performs an authorized GET request to the TBC API and decodes the JSON response
+func tbcGetJSON(ctx context.Context, apiKey string, url string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", apiKey)
+	resp, err := tbcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("TBC request %s failed with status %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// TBC Bank API structures
+type tbcCommercialRate struct {
+	Currency string  `json:"currency"`
+	Buy      float64 `json:"buy"`
+	Sell     float64 `json:"sell"`
+}
+
+type tbcCommercialRatesResponse struct {
+	Base                string              `json:"base"`
+	CommercialRatesList []tbcCommercialRate `json:"commercialRatesList"`
+}
+
+type tbcNbgRate struct {
+	Currency string  `json:"currency"`
+	Value    float64 `json:"value"`
+}
+
+// tbcNbgProvider serves official NBG rates through the TBC API
+type tbcNbgProvider struct {
+	apiKey  string
+	baseURL string // see Settings.tbcRatesBaseURL
+}
+
+func (p *tbcNbgProvider) Name() string { return ProviderTBCNBG }
+
+func (p *tbcNbgProvider) FetchRates(ctx context.Context) (map[string]float64, error) {
+	var out []tbcNbgRate
+	if err := tbcGetJSON(ctx, p.apiKey, p.baseURL+"/nbg/", &out); err != nil {
+		return nil, err
+	}
+	rates := make(map[string]float64, len(out))
+	for _, r := range out {
+		rates[strings.ToUpper(strings.TrimSpace(r.Currency))] = r.Value
+	}
+	return rates, nil
+}
+
+func (p *tbcNbgProvider) FetchRate(ctx context.Context, code string) (float64, error) {
+	var out []tbcNbgRate
+	u := p.baseURL + "/nbg?currency=" + url.QueryEscape(code)
+	if err := tbcGetJSON(ctx, p.apiKey, u, &out); err != nil {
+		return 0, err
+	}
+	for _, r := range out {
+		if strings.EqualFold(r.Currency, code) {
+			return r.Value, nil
+		}
+	}
+	return 0, errNoRate
+}
+
+// Convert uses the convert endpoint
+func (p *tbcNbgProvider) Convert(ctx context.Context, from, to string, amount float64) (float64, error) {
+	u := fmt.Sprintf("%s/nbg/convert?From=%s&To=%s&Amount=%s",
+		p.baseURL, url.QueryEscape(from), url.QueryEscape(to), trimFloat(amount))
+	var out struct {
+		From   string  `json:"from"`
+		To     string  `json:"to"`
+		Amount float64 `json:"amount"`
+		Value  float64 `json:"value"`
+	}
+	if err := tbcGetJSON(ctx, p.apiKey, u, &out); err != nil {
+		return 0, err
+	}
+	return out.Value, nil
+}
+
+// tbcCommercialProvider serves TBC buy/sell rates; the rate is the middle between them
+type tbcCommercialProvider struct {
+	apiKey  string
+	baseURL string // see Settings.tbcRatesBaseURL
+}
+
+func (p *tbcCommercialProvider) Name() string { return ProviderTBCCommercial }
+
+// fetchCommercial fetches commercial rates, all of them if currency is empty
+func (p *tbcCommercialProvider) fetchCommercial(ctx context.Context, currency string) ([]tbcCommercialRate, error) {
+	u := p.baseURL + "/commercial"
+	if currency != "" {
+		u += "?currency=" + url.QueryEscape(currency)
+	}
+	var out tbcCommercialRatesResponse
+	if err := tbcGetJSON(ctx, p.apiKey, u, &out); err != nil {
+		return nil, err
+	}
+	if out.Base != "" && !strings.EqualFold(out.Base, CurGEL) {
+		return nil, fmt.Errorf("unexpected TBC commercial rates base %s", out.Base)
+	}
+	return out.CommercialRatesList, nil
+}
+
+func (p *tbcCommercialProvider) FetchRates(ctx context.Context) (map[string]float64, error) {
+	list, err := p.fetchCommercial(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	rates := make(map[string]float64, len(list))
+	for _, r := range list {
+		rates[strings.ToUpper(strings.TrimSpace(r.Currency))] = (r.Buy + r.Sell) / 2
+	}
+	return rates, nil
+}
+
+func (p *tbcCommercialProvider) FetchRate(ctx context.Context, code string) (float64, error) {
+	list, err := p.fetchCommercial(ctx, code)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range list {
+		if strings.EqualFold(r.Currency, code) {
+			return (r.Buy + r.Sell) / 2, nil
+		}
+	}
+	return 0, errNoRate
+}
+
+// FetchCommercialRates returns bank buy/sell rates keyed by currency code
+func (p *tbcCommercialProvider) FetchCommercialRates(ctx context.Context) (map[string]tbcCommercialRateCached, error) {
+	list, err := p.fetchCommercial(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rates := make(map[string]tbcCommercialRateCached, len(list))
+	for _, r := range list {
+		if r.Buy <= 0 || r.Sell <= 0 {
+			continue
+		}
+		rates[strings.ToUpper(strings.TrimSpace(r.Currency))] = tbcCommercialRateCached{Buy: r.Buy, Sell: r.Sell, LastUpdated: now}
+	}
+	return rates, nil
+}
+
+// staticFileRateProvider reads rates from a JSON file like {"USD": 2.71, "EUR": 3.1}.
+// The file is re-read on every fetch, so it can be edited while the bot is running.
+type staticFileRateProvider struct {
+	path string
+}
+
+func (p *staticFileRateProvider) Name() string { return ProviderStatic }
+
+func (p *staticFileRateProvider) FetchRates(ctx context.Context) (map[string]float64, error) {
+	rawdata, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]float64
+	if err := json.Unmarshal(rawdata, &raw); err != nil {
+		return nil, fmt.Errorf("error parsing static rates file %s: %v", p.path, err)
+	}
+	rates := make(map[string]float64, len(raw))
+	for code, v := range raw {
+		if v > 0 {
+			rates[strings.ToUpper(code)] = v
+		}
+	}
+	return rates, nil
+}
+
+func (p *staticFileRateProvider) FetchRate(ctx context.Context, code string) (float64, error) {
+	rates, err := p.FetchRates(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if v, ok := rates[code]; ok {
+		return v, nil
+	}
+	return 0, errNoRate
+}
+
+// manualRateProvider holds rates set by bot admins with /rates set.
+// The rates are stored in the database, if any, so they survive restarts.
+type manualRateProvider struct {
+	mu    sync.Mutex
+	db    *sql.DB
+	rates map[string]float64
+}
+
+// newManualRateProvider creates the provider with the rates stored in db; db may be nil
+func newManualRateProvider(db *sql.DB) (*manualRateProvider, error) {
+	p := &manualRateProvider{db: db, rates: make(map[string]float64)}
+	if db == nil {
+		return p, nil
+	}
+	rates, err := getManualRates(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(rates) > 0 {
+		slog.Info("Loaded manual rates", "count", len(rates))
+		p.rates = rates
+	}
+	return p, nil
+}
+
+func (p *manualRateProvider) Name() string { return ProviderManual }
+
+func (p *manualRateProvider) FetchRates(ctx context.Context) (map[string]float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	rates := make(map[string]float64, len(p.rates))
+	for k, v := range p.rates {
+		rates[k] = v
+	}
+	return rates, nil
+}
+
+func (p *manualRateProvider) FetchRate(ctx context.Context, code string) (float64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if v, ok := p.rates[code]; ok {
+		return v, nil
+	}
+	return 0, errNoRate
+}
+
+// set overrides the rate of the currency; zero removes the override
+func (p *manualRateProvider) set(code string, value float64) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.db != nil {
+		if err := saveManualRate(p.db, code, value); err != nil {
+			return err
+		}
+	}
+	if value <= 0 {
+		delete(p.rates, code)
+	} else {
+		p.rates[code] = value
+	}
+	return nil
+}
+
+// fetchAllRates queries every provider in order; each one only fills currencies
+// not provided by the previous ones. Fails if no provider returned any rate,
+// so an empty provider, e.g., manual without overrides, doesn't hide failures of the others.
+// Calls go through the health circuit breakers, health may be nil.
+func fetchAllRates(ctx context.Context, providers []RateProvider, health *rateHealth) (map[string]tbcRateCached, error) {
+	merged := make(map[string]tbcRateCached)
+	var errs []error
+	now := time.Now()
+	for _, p := range providers {
+		var rates map[string]float64
+		err := health.call(p.Name(), endpointList, func() (err error) {
+			rates, err = p.FetchRates(ctx)
+			return err
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+			continue
+		}
+		for code, v := range rates {
+			code = strings.ToUpper(strings.TrimSpace(code))
+			if code == "" || v <= 0 {
+				continue
+			}
+			if _, exists := merged[code]; !exists {
+				merged[code] = tbcRateCached{value: v, LastUpdated: now, Source: p.Name()}
+			}
+		}
+	}
+	if len(merged) == 0 {
+		if len(errs) == 0 {
+			return nil, errors.New("no rate provider returned any rates")
+		}
+		return nil, fmt.Errorf("all rate providers failed: %w", errors.Join(errs...))
+	}
+	for _, err := range errs {
+		slog.Warn("Rate provider error", "err", err)
+	}
+	return merged, nil
+}
+
+// fetchSingleRate returns the rate of the currency from the first provider which has it
+func fetchSingleRate(ctx context.Context, providers []RateProvider, health *rateHealth, code string) (tbcRateCached, error) {
+	var errs []error
+	for _, p := range providers {
+		var v float64
+		err := health.call(p.Name(), endpointSingle, func() (err error) {
+			v, err = p.FetchRate(ctx, code)
+			return err
+		})
+		if err == nil && v > 0 {
+			return tbcRateCached{value: v, LastUpdated: time.Now(), Source: p.Name()}, nil
+		}
+		if err != nil && !errors.Is(err, errNoRate) {
+			errs = append(errs, fmt.Errorf("%s: %w", p.Name(), err))
+		}
+	}
+	return tbcRateCached{}, fmt.Errorf("no provider has a rate for %s: %w", code, errors.Join(errs...))
+}
+
+// fetchCommercialRates returns buy/sell rates from the first provider in the chain which has them
+func fetchCommercialRates(ctx context.Context, providers []RateProvider, health *rateHealth) (map[string]tbcCommercialRateCached, error) {
+	for _, p := range providers {
+		if src, ok := p.(commercialRateSource); ok {
+			var rates map[string]tbcCommercialRateCached
+			err := health.call(p.Name(), endpointCommercial, func() (err error) {
+				rates, err = src.FetchCommercialRates(ctx)
+				return err
+			})
+			return rates, err
+		}
+	}
+	return nil, errors.New("no provider of commercial rates")
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchAllRatesManualDoesNotHideFailures(t *testing.T) {
+	manual, err := newManualRateProvider(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := []RateProvider{manual, &fakeRateProvider{down: true}}
+	_, err = fetchAllRates(context.Background(), providers, nil)
+	if err == nil || !strings.Contains(err.Error(), "all rate providers failed") {
+		t.Errorf("fetch with no overrides and the provider down: err = %v", err)
+	}
+
+	if err := manual.set(CurUSD, 2.8); err != nil {
+		t.Fatal(err)
+	}
+	rates, err := fetchAllRates(context.Background(), providers, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rates[CurUSD]; r.value != 2.8 || r.Source != ProviderManual {
+		t.Errorf("USD = %+v, want the manual override", r)
+	}
+
+	rates, err = fetchAllRates(context.Background(), []RateProvider{manual, &fakeRateProvider{}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rates[CurRUB]; r.Source != "fake" {
+		t.Errorf("RUB = %+v, want it from the next provider", r)
+	}
+}
+
+func TestManualRatesSurviveRestart(t *testing.T) {
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	t.Cleanup(func() { db.Close() })
+	manual, err := newManualRateProvider(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, set := range []struct {
+		code  string
+		value float64
+	}{{CurUSD, 2.8}, {"EUR", 3.1}, {CurUSD, 2.9}, {"EUR", 0}} {
+		if err := manual.set(set.code, set.value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restarted, err := newManualRateProvider(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rates, err := restarted.FetchRates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rates) != 1 || rates[CurUSD] != 2.9 {
+		t.Errorf("rates after a restart = %v, want the USD override of 2.9 only", rates)
+	}
+}
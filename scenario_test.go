@@ -0,0 +1,513 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+const (
+	testChatID         int64 = -100123
+	testServiceChannel int64 = -100999
+	testAdminID              = 1
+)
+
+// scenario runs the bot against fakeTelegram, fake rates and a temporary database
+type scenario struct {
+	t          *testing.T
+	tg         *fakeTelegram
+	db         *sql.DB
+	rates      *tbcRateCache
+	nextUpdate int
+	nextMsg    int
+}
+
+func newScenario(t *testing.T) *scenario {
+	t.Helper()
+	return startScenario(t, initDB(filepath.Join(t.TempDir(), dbFileName)))
+}
+
+// startScenario starts the bot on the database, e.g., one left by an earlier run
+func startScenario(t *testing.T, db *sql.DB, providers ...RateProvider) *scenario {
+	t.Helper()
+	if len(providers) == 0 {
+		providers = []RateProvider{&fakeRateProvider{}}
+	}
+	rates := initCurrencyRates(providers, db, nil, nil)
+	if err := rates.refresh(5*time.Second, false); err != nil {
+		t.Fatalf("refreshing rates: %v", err)
+	}
+	tg := newFakeTelegram()
+	ctx := &BotContext{
+		bot: tg,
+		db:  db,
+		settings: &Settings{
+			TelegramServiceChannelID: testServiceChannel,
+			AdminUserIDs:             []int{testAdminID},
+		},
+		rates: rates,
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ctx.handleUpdates(runCtx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+		rates.stop()
+		db.Close()
+	})
+	return &scenario{t: t, tg: tg, db: db, rates: rates, nextUpdate: 1, nextMsg: 1}
+}
+
+// messageUpdate creates an update with the text message from the user in the chat
+func (s *scenario) messageUpdate(chatID int64, userID int, text string) tgbotapi.Update {
+	chatType := "supergroup"
+	if chatID > 0 {
+		chatType = "private"
+	}
+	update := tgbotapi.Update{
+		UpdateID: s.nextUpdate,
+		Message: &tgbotapi.Message{
+			MessageID: s.nextMsg,
+			From:      &tgbotapi.User{ID: userID, UserName: fmt.Sprintf("user%d", userID)},
+			Chat:      &tgbotapi.Chat{ID: chatID, Type: chatType},
+			Date:      int(time.Now().Unix()),
+			Text:      text,
+		},
+	}
+	s.nextUpdate++
+	s.nextMsg++
+	return update
+}
+
+// commandUpdate creates an update with the command message from the user in the test chat
+func (s *scenario) commandUpdate(userID int, text string) tgbotapi.Update {
+	return s.commandUpdateIn(testChatID, userID, text)
+}
+
+// commandUpdateIn creates an update with the command message from the user in the chat
+func (s *scenario) commandUpdateIn(chatID int64, userID int, text string) tgbotapi.Update {
+	update := s.messageUpdate(chatID, userID, text)
+	command := strings.Fields(text)[0]
+	update.Message.Entities = &[]tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len(command)}}
+	return update
+}
+
+// deliver injects the update and waits until it is processed, returning messages sent to its chat meanwhile
+func (s *scenario) deliver(update tgbotapi.Update) []fakeMessage {
+	s.t.Helper()
+	chatID := update.Message.Chat.ID
+	before := len(s.tg.sent(chatID))
+	s.tg.inject(update)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var done bool
+		err := s.db.QueryRow("SELECT done FROM processed_updates WHERE update_id = ?", update.UpdateID).Scan(&done)
+		if err == nil && done {
+			break
+		}
+		if time.Now().After(deadline) {
+			s.t.Fatalf("update %d was not processed in time", update.UpdateID)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return s.tg.sent(chatID)[before:]
+}
+
+// command sends the command from the user and returns the replies
+func (s *scenario) command(userID int, text string) []fakeMessage {
+	s.t.Helper()
+	return s.deliver(s.commandUpdate(userID, text))
+}
+
+// expectReply checks that there is exactly one reply containing every part
+func expectReply(t *testing.T, replies []fakeMessage, parts ...string) fakeMessage {
+	t.Helper()
+	if len(replies) != 1 {
+		t.Fatalf("expected one reply, got %d: %+v", len(replies), replies)
+	}
+	for _, part := range parts {
+		if !strings.Contains(replies[0].Text, part) {
+			t.Errorf("reply %q doesn't contain %q", replies[0].Text, part)
+		}
+	}
+	return replies[0]
+}
+
+func countOffers(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM offers").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestScenarioSell(t *testing.T) {
+	s := newScenario(t)
+	update := s.commandUpdate(2, "/sell 100 USD 270 GEL")
+	reply := expectReply(t, s.deliver(update), "100.00", "270.00")
+	if reply.ReplyTo != update.Message.MessageID {
+		t.Errorf("reply is not a reply to the command: %+v", reply)
+	}
+	if n := countOffers(t, s.db); n != 1 {
+		t.Fatalf("expected 1 offer, got %d", n)
+	}
+}
+
+func TestScenarioSellComputesCounterAmount(t *testing.T) {
+	s := newScenario(t)
+	// 100 USD at 2.7 GEL is 8181.82 RUB at 0.033 GEL, RUB is the default counter currency of USD
+	expectReply(t, s.command(2, "/sell 100 USD"), "100.00", "8181.82")
+}
+
+func TestScenarioSellInvalid(t *testing.T) {
+	s := newScenario(t)
+	expectReply(t, s.command(2, "/sell"), "Usage examples")
+	if n := countOffers(t, s.db); n != 0 {
+		t.Fatalf("expected no offers, got %d", n)
+	}
+}
+
+func TestScenarioBuyMatchesSell(t *testing.T) {
+	s := newScenario(t)
+	s.command(2, "/sell 100 USD 270 GEL")
+	replies := s.command(3, "/buy 100 USD 270 GEL")
+	if len(replies) != 2 {
+		t.Fatalf("expected the offer and its match, got %+v", replies)
+	}
+	if !strings.Contains(replies[1].Text, "user2") {
+		t.Errorf("match %q is not the offer of user2", replies[1].Text)
+	}
+	if n := countOffers(t, s.db); n != 2 {
+		t.Fatalf("expected 2 offers, got %d", n)
+	}
+}
+
+func TestScenarioParseIsNotAnOffer(t *testing.T) {
+	s := newScenario(t)
+	expectReply(t, s.command(2, "/parse sell 100 USD 270 GEL"), "Has: 100.00", "Wants: 270.00")
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM command_replies").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 || countOffers(t, s.db) != 0 {
+		t.Errorf("/parse recorded %d replies and %d offers", n, countOffers(t, s.db))
+	}
+}
+
+func TestScenarioList(t *testing.T) {
+	s := newScenario(t)
+	expectReply(t, s.command(2, "/list"), "No offers found")
+	s.command(2, "/sell 100 USD 270 GEL")
+	s.command(3, "/sell 50 GEL 18 USD")
+	expectReply(t, s.command(4, "/list"), "user2", "user3")
+}
+
+func TestScenarioStats(t *testing.T) {
+	s := newScenario(t)
+	s.command(2, "/sell 100 USD 270 GEL")
+	s.command(2, "/sell 50 GEL 18 USD")
+	expectReply(t, s.command(2, "/stats"), "Total offers: 2")
+	expectReply(t, s.command(3, "/stats"), "Total offers: 0")
+}
+
+func TestScenarioCurrenciesEnableDisable(t *testing.T) {
+	s := newScenario(t)
+	s.tg.mu.Lock()
+	s.tg.admins[testChatID] = []int{3} // a Telegram administrator of the chat
+	s.tg.mu.Unlock()
+
+	expectReply(t, s.command(2, "/currencies disable USD"), "Only chat admins")
+	expectReply(t, s.command(2, "/currencies enable EUR"), "Only chat admins")
+	expectReply(t, s.command(2, "/currencies"), "Currencies enabled in this chat: RUB, USD, GEL")
+	expectReply(t, s.command(2, "/sell 100 USD 270 GEL"), "100.00")
+	expectReply(t, s.command(2, "/sell 100 EUR 300 GEL"), "EUR is not enabled in this chat")
+
+	expectReply(t, s.command(3, "/currencies disable USD"), "Currencies enabled in this chat: RUB, GEL")
+	expectReply(t, s.command(2, "/sell 100 USD 270 GEL"), "USD is not enabled in this chat")
+	expectReply(t, s.command(testAdminID, "/currencies enable EUR USD"), "Currencies enabled in this chat: RUB, GEL, EUR, USD")
+	expectReply(t, s.command(2, "/sell 100 EUR 300 GEL"), "100.00")
+	expectReply(t, s.command(2, "/sell 50 USD 135 GEL"), "50.00")
+	if n := countOffers(t, s.db); n != 3 {
+		t.Errorf("offers = %d, want 3 in enabled currencies", n)
+	}
+}
+
+func TestScenarioRates(t *testing.T) {
+	s := newScenario(t)
+	expectReply(t, s.command(2, "/rates"), "base=GEL", "USD: value=2.7000 source=fake", "RUB: value=0.0330")
+}
+
+func TestScenarioRatesSetRequiresAdmin(t *testing.T) {
+	s := newScenario(t)
+	expectReply(t, s.command(2, "/rates set USD 3"), "Only bot admins")
+	// the manual provider is not configured in the scenario
+	expectReply(t, s.command(testAdminID, "/rates set USD 3"), "not enabled")
+}
+
+func TestScenarioRatesArguments(t *testing.T) {
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	manual, err := newManualRateProvider(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startScenario(t, db, manual, &fakeRateProvider{})
+	// set and unset without a currency are usage errors, not dates
+	expectReply(t, s.command(testAdminID, "/rates set"), "usage: /rates set <currency>")
+	expectReply(t, s.command(testAdminID, "/rates unset"), "usage: /rates set <currency>")
+	expectReply(t, s.command(2, "/rates set"), "Only bot admins")
+	expectReply(t, s.command(2, "/rates today"), "Usage: /rates [YYYY-MM-DD|refresh]")
+	expectReply(t, s.command(2, "/rates 2024-13-01"), "invalid date")
+	expectReply(t, s.command(testAdminID, "/rates set USD 3"), "USD: value=3.0000 source=manual")
+	expectReply(t, s.command(testAdminID, "/rates unset USD"), "USD: value=2.7000 source=fake")
+}
+
+func TestScenarioUpdateProcessedOnce(t *testing.T) {
+	s := newScenario(t)
+	update := s.commandUpdate(2, "/sell 100 USD 270 GEL")
+	expectReply(t, s.deliver(update), "100.00")
+	// Telegram delivers the update again, e.g., after a crash before the update ID was saved.
+	// Updates of a chat are handled in order, so once the next one is done, the repeated one is handled too.
+	s.tg.inject(update)
+	expectReply(t, s.command(2, "/stats"), "Total offers: 1")
+	if n := countOffers(t, s.db); n != 1 {
+		t.Fatalf("expected 1 offer, got %d", n)
+	}
+	if sent := s.tg.sent(testChatID); len(sent) != 2 {
+		t.Fatalf("expected the offer reply and the stats, got %+v", sent)
+	}
+}
+
+func TestScenarioUpdateResumedAfterCrash(t *testing.T) {
+	s := newScenario(t)
+	update := s.commandUpdate(2, "/sell 100 USD 270 GEL")
+	// the bot crashed after the offer was saved and the reply was sent, but before the update was finished
+	if _, err := s.db.Exec("INSERT INTO processed_updates (update_id, done) VALUES (?, 0)", update.UpdateID); err != nil {
+		t.Fatal(err)
+	}
+	for _, effect := range []string{effectOffer, "send:1"} {
+		if err := saveUpdateEffect(s.db, update.UpdateID, effect, testChatID, 1000); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if replies := s.deliver(update); len(replies) != 0 {
+		t.Fatalf("resumed update sent %+v", replies)
+	}
+	if n := countOffers(t, s.db); n != 0 {
+		t.Fatalf("resumed update saved the offer again, got %d offers", n)
+	}
+}
+
+func TestScenarioAlertResumedAfterCrash(t *testing.T) {
+	s := newScenario(t)
+	update := s.commandUpdateIn(2, 2, "/alert USD GEL > 2.75")
+	// the bot crashed after the alert was saved, but before the reply was sent
+	if _, err := s.db.Exec("INSERT INTO processed_updates (update_id, done) VALUES (?, 0)", update.UpdateID); err != nil {
+		t.Fatal(err)
+	}
+	id, err := saveRateAlert(s.db, rateAlert{UserID: 2, ChatID: 2, Currency: CurUSD, Counter: CurGEL, Op: ">", Threshold: 2.75})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveUpdateObject(s.db, update.UpdateID, effectAlert, id); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, s.deliver(update), fmt.Sprintf("Alert #%d set", id))
+	if alerts, err := getRateAlerts(s.db, 2); err != nil || len(alerts) != 1 {
+		t.Fatalf("alerts after resuming = %+v, %v; want the one saved before the crash", alerts, err)
+	}
+}
+
+func TestScenarioAPIKeyResumedAfterCrash(t *testing.T) {
+	s := newScenario(t)
+	// resume simulates a crash after the key of the update was created, and after its reply was sent if shown
+	resume := func(shown bool) (tgbotapi.Update, int64) {
+		t.Helper()
+		update := s.commandUpdateIn(testAdminID, testAdminID, fmt.Sprintf("/apikey add %d site", testChatID))
+		if _, err := s.db.Exec("INSERT INTO processed_updates (update_id, done) VALUES (?, 0)", update.UpdateID); err != nil {
+			t.Fatal(err)
+		}
+		_, hash, err := newAPIKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := createAPIKey(s.db, hash, apiKey{Name: "site", ChatID: testChatID, RateLimit: defaultAPIRateLimit}, testAdminID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := saveUpdateObject(s.db, update.UpdateID, effectAPIKey, id); err != nil {
+			t.Fatal(err)
+		}
+		if shown {
+			if err := saveUpdateEffect(s.db, update.UpdateID, "send:1", testAdminID, 1000); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return update, id
+	}
+	revoked := func(id int64) bool {
+		t.Helper()
+		var revokedAt sql.NullString
+		if err := s.db.QueryRow("SELECT revoked_at FROM api_keys WHERE id = ?", id).Scan(&revokedAt); err != nil {
+			t.Fatal(err)
+		}
+		return revokedAt.Valid
+	}
+
+	// the key was never shown, so it's revoked rather than left valid
+	update, id := resume(false)
+	expectReply(t, s.deliver(update), fmt.Sprintf("API key #%d", id), "revoked")
+	if !revoked(id) {
+		t.Errorf("API key #%d that wasn't shown is valid", id)
+	}
+
+	update, id = resume(true)
+	if replies := s.deliver(update); len(replies) != 0 {
+		t.Fatalf("resumed update sent %+v", replies)
+	}
+	if revoked(id) {
+		t.Errorf("API key #%d that was shown is revoked", id)
+	}
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM api_keys").Scan(&n); err != nil || n != 2 {
+		t.Errorf("%d API keys after resuming, want 2 created before the crashes", n)
+	}
+}
+
+func TestScenarioListScopedByChat(t *testing.T) {
+	const otherChatID int64 = -100456
+	s := newScenario(t)
+	s.command(2, "/sell 100 USD 270 GEL")
+	expectReply(t, s.deliver(s.commandUpdateIn(otherChatID, 3, "/list")), "No offers found")
+	if replies := s.deliver(s.commandUpdateIn(otherChatID, 3, "/buy 100 USD 270 GEL")); len(replies) != 1 {
+		t.Fatalf("offer of another chat was matched: %+v", replies)
+	}
+
+	// sharing takes both chats to opt in
+	s.command(testAdminID, "/chat share on")
+	expectReply(t, s.deliver(s.commandUpdateIn(otherChatID, 3, "/list")), "user3")
+	s.deliver(s.commandUpdateIn(otherChatID, testAdminID, "/chat share on"))
+	expectReply(t, s.deliver(s.commandUpdateIn(otherChatID, 3, "/list")), "user2", "user3")
+}
+
+func TestScenarioChatSettings(t *testing.T) {
+	s := newScenario(t)
+	expectReply(t, s.command(2, "/chat ttl 7d"), "Only chat admins")
+	expectReply(t, s.command(testAdminID, "/chat admins add 2"), "User 2 is an admin")
+	expectReply(t, s.command(2, "/chat ttl 7d"), "Offers expire after: 7d", "Admins: Telegram chat administrators, 2")
+	expectReply(t, s.command(2, "/chat counter GEL"), "Counter currency: GEL")
+	expectReply(t, s.command(3, "/sell 100 USD"), "100.00", "270.00")
+}
+
+func TestScenarioOfferTTL(t *testing.T) {
+	s := newScenario(t)
+	s.command(2, "/sell 100 USD 270 GEL")
+	s.command(testAdminID, "/chat ttl 1h")
+	expectReply(t, s.command(3, "/list"), "user2")
+	if _, err := s.db.Exec("UPDATE offers SET posted_at = datetime('now', '-2 hours')"); err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, s.command(3, "/list"), "No offers found")
+}
+
+func TestScenarioFreeTextOffer(t *testing.T) {
+	s := newScenario(t)
+	if replies := s.deliver(s.messageUpdate(testChatID, 2, "sell 100 USD 270 GEL")); len(replies) != 0 {
+		t.Fatalf("free text is handled while off: %+v", replies)
+	}
+	s.command(testAdminID, "/chat freetext on")
+	expectReply(t, s.deliver(s.messageUpdate(testChatID, 2, "sell 100 USD 270 GEL")), "100.00", "270.00")
+	if replies := s.deliver(s.messageUpdate(testChatID, 3, "buy a coffee, anyone?")); len(replies) != 0 {
+		t.Fatalf("conversation is handled as an offer: %+v", replies)
+	}
+	if n := countOffers(t, s.db); n != 1 {
+		t.Fatalf("expected 1 offer, got %d", n)
+	}
+}
+
+func TestScenarioMetrics(t *testing.T) {
+	s := newScenario(t)
+	s.command(2, "/sell 100 USD 270 GEL")
+	rec := httptest.NewRecorder()
+	metricsHandler(s.db, s.rates).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`exchangebot_updates_total{type="message"} `,
+		`exchangebot_command_duration_seconds_bucket{command="sell",le="+Inf"} `,
+		`exchangebot_rate_fetches_total{provider="fake",endpoint="list",result="success"} `,
+		`exchangebot_rate_age_seconds{currency="USD",source="fake"} `,
+		`exchangebot_open_offers{have="USD",want="GEL"} 1`,
+		`exchangebot_db_query_duration_seconds_count{query="saveOffer"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestScenarioAPI(t *testing.T) {
+	s := newScenario(t)
+	s.command(2, "/sell 100 USD 270 GEL")
+	s.command(2, "/sell 500 EUR 1450 GEL")
+	s.deliver(s.commandUpdateIn(-100456, 3, "/sell 200 USD 540 GEL"))
+	expectReply(t, s.command(testAdminID, fmt.Sprintf("/apikey add %d partner 3", testChatID)), "private chat")
+	reply := expectReply(t, s.deliver(s.commandUpdateIn(testAdminID, testAdminID, fmt.Sprintf("/apikey add %d partner 3", testChatID))), "API key #1")
+	key := reply.Text[strings.LastIndex(reply.Text, "\n")+1:]
+
+	api := newAPIServer(s.db, s.rates, []string{"https://partner.example.com"}).handler()
+	get := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Origin", "https://partner.example.com")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/api/v1/rates", "xb_wrong"); rec.Code != 401 {
+		t.Errorf("invalid key status = %d", rec.Code)
+	}
+	rec := get("/api/v1/offers?have=USD&want=GEL&min_amount=50", key)
+	if rec.Code != 200 || rec.Header().Get("Access-Control-Allow-Origin") != "https://partner.example.com" {
+		t.Fatalf("offers status = %d, headers %v", rec.Code, rec.Header())
+	}
+	var offers struct {
+		Offers []apiOffer `json:"offers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &offers); err != nil {
+		t.Fatal(err)
+	}
+	// the offer of the other chat and the EUR offer are filtered out
+	if len(offers.Offers) != 1 || offers.Offers[0].Username != "user2" || offers.Offers[0].Have != (apiMoney{"USD", "100.00"}) {
+		t.Errorf("offers = %+v", offers.Offers)
+	}
+	if rec := get("/api/v1/users/2/reputation", key); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"user_id":2`) {
+		t.Errorf("reputation = %d %s", rec.Code, rec.Body)
+	}
+	if rec := get("/api/v1/rates", key); rec.Code != 200 || !strings.Contains(rec.Body.String(), `"USD":{"rate":`) {
+		t.Errorf("rates = %d %s", rec.Code, rec.Body)
+	}
+	rec = get("/api/v1/rates", key)
+	if rec.Code != 429 || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("request over the rate limit status = %d, headers %v", rec.Code, rec.Header())
+	}
+
+	expectReply(t, s.deliver(s.commandUpdateIn(testAdminID, testAdminID, "/apikey revoke 1")), "revoked")
+	if rec := get("/api/v1/rates", key); rec.Code != 401 {
+		t.Errorf("revoked key status = %d", rec.Code)
+	}
+}
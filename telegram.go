@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// telegramClient is the part of the Telegram Bot API the bot uses.
+// telegramBot implements it with the real API; tests use an in-memory fake.
+type telegramClient interface {
+	// Send sends a new message, e.g., a text or a photo
+	Send(c tgbotapi.Chattable) (tgbotapi.Message, error)
+	// EditText replaces the text of a sent message
+	EditText(chatID int64, messageID int, text string) error
+	// Delete deletes a message
+	Delete(chatID int64, messageID int) error
+	// AnswerCallback answers a callback query from an inline button, text is shown to the user
+	AnswerCallback(callbackID, text string) error
+	// ChatAdministrators lists administrators of a group chat
+	ChatAdministrators(chatID int64) ([]tgbotapi.ChatMember, error)
+	// ReceiveUpdates starts receiving updates starting with offset; stop ends receiving.
+	// The updates channel may stay open after stop.
+	ReceiveUpdates(offset int) (updates tgbotapi.UpdatesChannel, stop func(), err error)
+}
+
+// telegramBot is the telegramClient of the real Telegram Bot API; failed calls are counted in metrics
+type telegramBot struct {
+	api      *tgbotapi.BotAPI
+	settings *Settings
+	secrets  *Secrets
+	db       *sql.DB // stores updates received via the webhook
+}
+
+func newTelegramBot(api *tgbotapi.BotAPI, settings *Settings, secrets *Secrets, db *sql.DB) *telegramBot {
+	return &telegramBot{api: api, settings: settings, secrets: secrets, db: db}
+}
+
+// countError counts the failed call of the method and returns its error
+func countError(method string, err error) error {
+	if err != nil {
+		metricTelegramErrors.inc(method)
+	}
+	return err
+}
+
+func (b *telegramBot) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	msg, err := b.api.Send(c)
+	return msg, countError("send", err)
+}
+
+func (b *telegramBot) EditText(chatID int64, messageID int, text string) error {
+	_, err := b.api.Send(tgbotapi.NewEditMessageText(chatID, messageID, text))
+	return countError("edit_text", err)
+}
+
+func (b *telegramBot) Delete(chatID int64, messageID int) error {
+	// Send can't be used, the result of deleteMessage is not a message
+	_, err := b.api.DeleteMessage(tgbotapi.NewDeleteMessage(chatID, messageID))
+	return countError("delete", err)
+}
+
+func (b *telegramBot) AnswerCallback(callbackID, text string) error {
+	_, err := b.api.AnswerCallbackQuery(tgbotapi.NewCallback(callbackID, text))
+	return countError("answer_callback", err)
+}
+
+func (b *telegramBot) ChatAdministrators(chatID int64) ([]tgbotapi.ChatMember, error) {
+	admins, err := b.api.GetChatAdministrators(tgbotapi.ChatConfig{ChatID: chatID})
+	return admins, countError("chat_administrators", err)
+}
+
+// ReceiveUpdates receives updates in the configured mode.
+// Polling doesn't close the updates channel when stopped, the webhook listener does.
+func (b *telegramBot) ReceiveUpdates(offset int) (updates tgbotapi.UpdatesChannel, stop func(), err error) {
+	if b.settings.UpdateMode == UpdateModeWebhook {
+		secret := b.secrets.TelegramWebhookSecret
+		if secret == "" {
+			secret = newWebhookSecret()
+		}
+		return listenForWebhook(b.api, &b.settings.Webhook, secret, func(update tgbotapi.Update) error {
+			return saveReceivedUpdate(b.db, update)
+		})
+	}
+	// getUpdates doesn't work while a webhook is set, e.g., left by the webhook mode
+	if _, err := b.api.RemoveWebhook(); err != nil {
+		return nil, nil, fmt.Errorf("error removing webhook: %w", err)
+	}
+	u := tgbotapi.NewUpdate(offset)
+	u.Timeout = 60
+	updates, err = b.api.GetUpdatesChan(u)
+	if err != nil {
+		return nil, nil, err
+	}
+	return updates, b.api.StopReceivingUpdates, nil
+}
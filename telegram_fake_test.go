@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// fakeMessage is a message sent through fakeTelegram
+type fakeMessage struct {
+	ChatID    int64
+	MessageID int
+	ReplyTo   int
+	Text      string // caption for photos
+	Photo     bool
+	Deleted   bool
+}
+
+// fakeTelegram is an in-memory telegramClient recording sent messages; tests inject updates into it
+type fakeTelegram struct {
+	mu       sync.Mutex
+	messages []*fakeMessage
+	answers  []string // texts of answered callbacks
+	admins   map[int64][]int
+	nextID   int
+	updates  chan tgbotapi.Update
+	stopOnce sync.Once
+}
+
+func newFakeTelegram() *fakeTelegram {
+	return &fakeTelegram{
+		admins:  make(map[int64][]int),
+		nextID:  1000,
+		updates: make(chan tgbotapi.Update, 100),
+	}
+}
+
+func (f *fakeTelegram) Send(c tgbotapi.Chattable) (tgbotapi.Message, error) {
+	var m fakeMessage
+	switch msg := c.(type) {
+	case tgbotapi.MessageConfig:
+		m = fakeMessage{ChatID: msg.ChatID, ReplyTo: msg.ReplyToMessageID, Text: msg.Text}
+	case tgbotapi.PhotoConfig:
+		m = fakeMessage{ChatID: msg.ChatID, ReplyTo: msg.ReplyToMessageID, Text: msg.Caption, Photo: true}
+	default:
+		return tgbotapi.Message{}, fmt.Errorf("fake telegram can't send %T", c)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	m.MessageID = f.nextID
+	f.messages = append(f.messages, &m)
+	return tgbotapi.Message{MessageID: m.MessageID, Chat: &tgbotapi.Chat{ID: m.ChatID}, Text: m.Text}, nil
+}
+
+func (f *fakeTelegram) find(chatID int64, messageID int) (*fakeMessage, error) {
+	for _, m := range f.messages {
+		if m.ChatID == chatID && m.MessageID == messageID && !m.Deleted {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("message %d not found in chat %d", messageID, chatID)
+}
+
+func (f *fakeTelegram) EditText(chatID int64, messageID int, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, err := f.find(chatID, messageID)
+	if err == nil {
+		m.Text = text
+	}
+	return err
+}
+
+func (f *fakeTelegram) Delete(chatID int64, messageID int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, err := f.find(chatID, messageID)
+	if err == nil {
+		m.Deleted = true
+	}
+	return err
+}
+
+func (f *fakeTelegram) AnswerCallback(callbackID, text string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.answers = append(f.answers, text)
+	return nil
+}
+
+func (f *fakeTelegram) ChatAdministrators(chatID int64) ([]tgbotapi.ChatMember, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var members []tgbotapi.ChatMember
+	for _, id := range f.admins[chatID] {
+		members = append(members, tgbotapi.ChatMember{User: &tgbotapi.User{ID: id}, Status: "administrator"})
+	}
+	return members, nil
+}
+
+func (f *fakeTelegram) ReceiveUpdates(offset int) (tgbotapi.UpdatesChannel, func(), error) {
+	return f.updates, func() { f.stopOnce.Do(func() { close(f.updates) }) }, nil
+}
+
+// inject delivers the update to the bot as if it came from Telegram
+func (f *fakeTelegram) inject(update tgbotapi.Update) {
+	f.updates <- update
+}
+
+// sent returns copies of the messages sent to the chat, oldest first
+func (f *fakeTelegram) sent(chatID int64) []fakeMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var out []fakeMessage
+	for _, m := range f.messages {
+		if m.ChatID == chatID {
+			out = append(out, *m)
+		}
+	}
+	return out
+}
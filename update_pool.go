@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Number of updates processed concurrently unless configured otherwise
+const defaultUpdateWorkers = 8
+
+// updatePool processes updates concurrently, keeping the order of updates with the same key.
+// Updates are committed, i.e., the last update ID is saved, only once all earlier ones are processed,
+// so a restart never skips an update still in progress.
+type updatePool struct {
+	handle func(tgbotapi.Update)
+	commit func(updateID int) // called in update order with the last ID processed along with all earlier ones; may skip IDs
+	slots  chan struct{}      // limits the updates being processed at once
+	wg     sync.WaitGroup
+
+	commitMu     sync.Mutex // keeps commits in order; committing may be slow, so it's not done under mu
+	committedSeq int        // pickedSeq of the last commit, guarded by commitMu
+
+	mu        sync.Mutex
+	queues    map[string][]tgbotapi.Update // updates waiting for an earlier one with the same key
+	pending   []int                        // IDs of dispatched updates not committed yet, in order
+	done      map[int]bool                 // processed updates among pending
+	picked    int                          // the latest ID to commit
+	pickedSeq int                          // incremented when picked changes
+}
+
+func newUpdatePool(workers int, handle func(tgbotapi.Update), commit func(updateID int)) *updatePool {
+	if workers <= 0 {
+		workers = defaultUpdateWorkers
+	}
+	return &updatePool{
+		handle: handle,
+		commit: commit,
+		slots:  make(chan struct{}, workers),
+		queues: make(map[string][]tgbotapi.Update),
+		done:   make(map[int]bool),
+	}
+}
+
+// updateKey returns the key of updates which must be processed in order:
+// the chat for messages, the user for callbacks outside chats
+func updateKey(update tgbotapi.Update) string {
+	if chat := updateChat(update); chat != nil {
+		return fmt.Sprintf("chat:%d", chat.ID)
+	}
+	if update.CallbackQuery != nil && update.CallbackQuery.From != nil {
+		return fmt.Sprintf("user:%d", update.CallbackQuery.From.ID)
+	}
+	return ""
+}
+
+// updateChat returns the chat the update came from, nil if it has none
+func updateChat(update tgbotapi.Update) *tgbotapi.Chat {
+	switch {
+	case update.Message != nil:
+		return update.Message.Chat
+	case update.EditedMessage != nil:
+		return update.EditedMessage.Chat
+	case update.ChannelPost != nil:
+		return update.ChannelPost.Chat
+	case update.EditedChannelPost != nil:
+		return update.EditedChannelPost.Chat
+	case update.CallbackQuery != nil && update.CallbackQuery.Message != nil:
+		return update.CallbackQuery.Message.Chat
+	}
+	return nil
+}
+
+// dispatch queues the update; it is processed after earlier updates with the same key.
+// Must be called in the order updates are received.
+func (p *updatePool) dispatch(update tgbotapi.Update) {
+	key := updateKey(update)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending = append(p.pending, update.UpdateID)
+	p.wg.Add(1)
+	if key == "" {
+		// nothing to order against
+		go p.process(update)
+		return
+	}
+	if queue, busy := p.queues[key]; busy {
+		p.queues[key] = append(queue, update)
+		return
+	}
+	p.queues[key] = nil
+	go p.drain(key, update)
+}
+
+// drain processes the update and then the ones queued with its key until the queue is empty
+func (p *updatePool) drain(key string, update tgbotapi.Update) {
+	for {
+		p.process(update)
+		p.mu.Lock()
+		queue := p.queues[key]
+		if len(queue) == 0 {
+			delete(p.queues, key)
+			p.mu.Unlock()
+			return
+		}
+		update, p.queues[key] = queue[0], queue[1:]
+		p.mu.Unlock()
+	}
+}
+
+// process handles the update in a worker slot and commits it with all earlier processed ones
+func (p *updatePool) process(update tgbotapi.Update) {
+	defer p.wg.Done()
+	p.slots <- struct{}{}
+	p.handle(update)
+	<-p.slots
+
+	p.mu.Lock()
+	p.done[update.UpdateID] = true
+	last, advanced := 0, false
+	for len(p.pending) > 0 && p.done[p.pending[0]] {
+		last, advanced = p.pending[0], true
+		delete(p.done, last)
+		p.pending = p.pending[1:]
+	}
+	if advanced {
+		p.picked = last
+		p.pickedSeq++
+	}
+	p.mu.Unlock()
+	if advanced {
+		p.commitPicked()
+	}
+}
+
+// commitPicked commits the latest picked ID unless it's already committed,
+// e.g., by a concurrent call which picked it up while this one waited
+func (p *updatePool) commitPicked() {
+	p.commitMu.Lock()
+	defer p.commitMu.Unlock()
+	p.mu.Lock()
+	id, seq := p.picked, p.pickedSeq
+	p.mu.Unlock()
+	if seq == p.committedSeq {
+		return
+	}
+	p.commit(id)
+	p.committedSeq = seq
+}
+
+// inProgress returns IDs of dispatched updates which are not processed yet, in order
+func (p *updatePool) inProgress() []int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := make([]int, 0, len(p.pending))
+	for _, id := range p.pending {
+		if !p.done[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// wait blocks until all dispatched updates are processed or the timeout expires;
+// false if some are still in progress
+func (p *updatePool) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
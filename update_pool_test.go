@@ -0,0 +1,157 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// poolHarness runs an updatePool whose handler blocks until the update is released
+type poolHarness struct {
+	t        *testing.T
+	pool     *updatePool
+	started  chan int
+	mu       sync.Mutex
+	release  map[int]chan struct{}
+	commits  []int
+	commitCh chan int
+}
+
+func newPoolHarness(t *testing.T, commit func(int)) *poolHarness {
+	h := &poolHarness{t: t, started: make(chan int, 10), release: make(map[int]chan struct{}), commitCh: make(chan int, 10)}
+	h.pool = newUpdatePool(4, func(u tgbotapi.Update) {
+		h.started <- u.UpdateID
+		<-h.gate(u.UpdateID)
+	}, func(id int) {
+		if commit != nil {
+			commit(id)
+		}
+		h.mu.Lock()
+		h.commits = append(h.commits, id)
+		h.mu.Unlock()
+		h.commitCh <- id
+	})
+	return h
+}
+
+// gate returns the channel releasing the update
+func (h *poolHarness) gate(id int) chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.release[id] == nil {
+		h.release[id] = make(chan struct{})
+	}
+	return h.release[id]
+}
+
+// dispatch dispatches a message update of the chat
+func (h *poolHarness) dispatch(id int, chatID int64) {
+	h.pool.dispatch(tgbotapi.Update{UpdateID: id, Message: &tgbotapi.Message{Chat: &tgbotapi.Chat{ID: chatID}}})
+}
+
+// expectStarted checks that exactly the updates start, in any order
+func (h *poolHarness) expectStarted(ids ...int) {
+	h.t.Helper()
+	var got []int
+	for range ids {
+		select {
+		case id := <-h.started:
+			got = append(got, id)
+		case <-time.After(time.Second):
+			h.t.Fatalf("started %v, want %v", got, ids)
+		}
+	}
+	select {
+	case id := <-h.started:
+		h.t.Fatalf("update %d started, want only %v", id, ids)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if slices.Sort(got); !slices.Equal(got, slices.Sorted(slices.Values(ids))) {
+		h.t.Fatalf("started %v, want %v", got, ids)
+	}
+}
+
+// expectCommit waits for the commit of the ID
+func (h *poolHarness) expectCommit(id int) {
+	h.t.Helper()
+	select {
+	case got := <-h.commitCh:
+		if got != id {
+			h.t.Fatalf("committed %d, want %d", got, id)
+		}
+	case <-time.After(time.Second):
+		h.t.Fatalf("%d isn't committed", id)
+	}
+}
+
+// expectNoCommit checks that nothing is committed meanwhile
+func (h *poolHarness) expectNoCommit() {
+	h.t.Helper()
+	select {
+	case got := <-h.commitCh:
+		h.t.Fatalf("committed %d, want no commits", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestUpdatePoolOrderAndCommits(t *testing.T) {
+	h := newPoolHarness(t, nil)
+	h.dispatch(1, 100)
+	h.dispatch(2, 100)
+	h.dispatch(3, 200)
+	// the update of another chat runs concurrently, the second one of the chat waits for the first
+	h.expectStarted(1, 3)
+
+	close(h.gate(3))
+	h.expectNoCommit() // 1 and 2 are in progress
+	if got := h.pool.inProgress(); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("in progress %v, want [1 2]", got)
+	}
+
+	close(h.gate(1))
+	h.expectStarted(2)
+	h.expectCommit(1)
+	close(h.gate(2))
+	h.expectCommit(3) // 3 was done before 2
+	if !h.pool.wait(time.Second) {
+		t.Fatal("updates still in progress")
+	}
+	if !slices.Equal(h.commits, []int{1, 3}) {
+		t.Errorf("commits %v, want [1 3]", h.commits)
+	}
+}
+
+func TestUpdatePoolSlowCommitDoesntBlockDispatch(t *testing.T) {
+	committing, unblock := make(chan int, 2), make(chan struct{})
+	h := newPoolHarness(t, func(id int) {
+		committing <- id
+		<-unblock
+	})
+	h.dispatch(1, 100)
+	h.expectStarted(1)
+	close(h.gate(1))
+	<-committing
+
+	dispatched := make(chan struct{})
+	go func() {
+		h.dispatch(2, 200)
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch is blocked by a commit in progress")
+	}
+	h.expectStarted(2)
+	close(h.gate(2))
+
+	close(unblock)
+	h.expectCommit(1)
+	h.expectCommit(2)
+	if !h.pool.wait(time.Second) {
+		t.Fatal("updates still in progress")
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+// Update modes selectable in settings
+const (
+	UpdateModePolling = "polling"
+	UpdateModeWebhook = "webhook"
+)
+
+// Header carrying the secret token Telegram was given when the webhook was registered
+const webhookSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// Updates larger than this are rejected; Telegram updates are a few kilobytes at most
+const maxWebhookBodySize = 1 << 20
+
+// Update types the bot handles, the rest is not delivered to the webhook
+const webhookAllowedUpdates = `["message","edited_message","channel_post","edited_channel_post","callback_query"]`
+
+// WebhookSettings configures receiving updates via the webhook
+type WebhookSettings struct {
+	// Public HTTPS URL Telegram posts updates to, e.g., https://example.com/tg/exchangebot
+	URL string `json:"url"`
+	// Address the listener binds to, default 127.0.0.1:8080
+	ListenAddr string `json:"listen_addr"`
+	// Path served by the listener, default is the path of URL; differs if the reverse proxy rewrites it
+	Path string `json:"path"`
+	// Certificate and key files to serve HTTPS directly; plain HTTP if empty, e.g., behind a reverse proxy
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Upload CertFile to Telegram when registering, for self-signed certificates
+	SelfSigned bool `json:"self_signed"`
+	// Maximum simultaneous connections from Telegram, 1-100, default 40
+	MaxConnections int `json:"max_connections"`
+}
+
+// validate checks the webhook settings, filling in defaults
+func (ws *WebhookSettings) validate() error {
+	u, err := url.Parse(ws.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("webhook url must be an https URL, got %q", ws.URL)
+	}
+	if (ws.CertFile == "") != (ws.KeyFile == "") {
+		return errors.New("webhook cert_file and key_file must be set together")
+	}
+	if ws.SelfSigned && ws.CertFile == "" {
+		return errors.New("webhook self_signed requires cert_file")
+	}
+	if ws.MaxConnections < 0 || ws.MaxConnections > 100 {
+		return fmt.Errorf("webhook max_connections must be 1-100, got %d", ws.MaxConnections)
+	}
+	if ws.ListenAddr == "" {
+		ws.ListenAddr = "127.0.0.1:8080"
+	}
+	if ws.Path == "" {
+		ws.Path = u.Path
+	}
+	if ws.Path == "" {
+		ws.Path = "/"
+	}
+	return nil
+}
+
+// newWebhookSecret generates a secret token for the webhook when none is configured
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Panicf("Error generating webhook secret: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// setWebhook registers the webhook with the secret token Telegram sends back in every request
+func setWebhook(bot *tgbotapi.BotAPI, ws *WebhookSettings, secret string) error {
+	params := map[string]string{
+		"url":             ws.URL,
+		"secret_token":    secret,
+		"allowed_updates": webhookAllowedUpdates,
+	}
+	if ws.MaxConnections != 0 {
+		params["max_connections"] = strconv.Itoa(ws.MaxConnections)
+	}
+	var err error
+	if ws.SelfSigned {
+		_, err = bot.UploadFile("setWebhook", params, "certificate", ws.CertFile)
+	} else {
+		v := url.Values{}
+		for k, p := range params {
+			v.Set(k, p)
+		}
+		_, err = bot.MakeRequest("setWebhook", v)
+	}
+	if err != nil {
+		return fmt.Errorf("error setting webhook: %w", err)
+	}
+	return nil
+}
+
+// webhookHandler accepts updates posted by Telegram with the secret token and passes them to updates.
+// Updates are acknowledged only once save stores them, as Telegram doesn't send acknowledged ones again;
+// updates not processed because of a crash are processed on start from the stored ones.
+// Once stopping is closed, updates which can't be passed at once are declined.
+func webhookHandler(secret string, save func(tgbotapi.Update) error, updates chan<- tgbotapi.Update, stopping <-chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(webhookSecretHeader)), []byte(secret)) != 1 {
+			slog.Warn("Rejected webhook request with a wrong secret token", "remote", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var update tgbotapi.Update
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxWebhookBodySize)).Decode(&update); err != nil {
+			slog.Warn("Error decoding webhook update", "err", err)
+			http.Error(w, "invalid update", http.StatusBadRequest)
+			return
+		}
+		if err := save(update); err != nil {
+			slog.Error("Error storing webhook update", "update", update.UpdateID, "err", err)
+			http.Error(w, "can't store the update", http.StatusInternalServerError)
+			return
+		}
+		select {
+		case updates <- update:
+		case <-r.Context().Done():
+			// Telegram retries updates which were not acknowledged
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		case <-stopping:
+			http.Error(w, "stopping", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// listenForWebhook registers the webhook and serves it, returning the channel of received updates.
+// stop removes the webhook and shuts the listener down; updates are closed after that,
+// unless some requests were still being served when the shutdown timed out.
+func listenForWebhook(bot *tgbotapi.BotAPI, ws *WebhookSettings, secret string, save func(tgbotapi.Update) error) (updates tgbotapi.UpdatesChannel, stop func(), err error) {
+	ch := make(chan tgbotapi.Update, bot.Buffer)
+	stopping := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle(ws.Path, webhookHandler(secret, save, ch, stopping))
+	srv := &http.Server{
+		Addr:              ws.ListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	ln, err := net.Listen("tcp", ws.ListenAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error starting webhook listener: %w", err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		var err error
+		if ws.CertFile != "" {
+			err = srv.ServeTLS(ln, ws.CertFile, ws.KeyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Webhook listener failed", "err", err)
+		}
+	}()
+	if err := setWebhook(bot, ws, secret); err != nil {
+		_ = srv.Close()
+		<-served
+		return nil, nil, err
+	}
+	slog.Info("Receiving updates via webhook", "url", ws.URL, "listen", ws.ListenAddr+ws.Path)
+
+	stop = func() {
+		if _, err := bot.RemoveWebhook(); err != nil {
+			slog.Error("Error removing webhook", "err", err)
+		}
+		close(stopping)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			// handlers may still be sending, closing the channel would make them panic
+			slog.Error("Error stopping webhook listener", "err", err)
+			return
+		}
+		<-served
+		close(ch)
+	}
+	return ch, stop, nil
+}
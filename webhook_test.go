@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	const secret = "s3cret"
+	const update = `{"update_id": 42, "message": {"message_id": 1, "chat": {"id": -100123, "type": "supergroup"}, "text": "/list"}}`
+	errStorage := errors.New("database is locked")
+	tests := []struct {
+		name     string
+		method   string
+		token    string
+		body     string
+		saveErr  error
+		stopping bool
+		want     int
+	}{
+		{"valid update", http.MethodPost, secret, update, nil, false, http.StatusOK},
+		{"missing token", http.MethodPost, "", update, nil, false, http.StatusForbidden},
+		{"wrong token", http.MethodPost, "secret", update, nil, false, http.StatusForbidden},
+		{"token prefix", http.MethodPost, secret[:3], update, nil, false, http.StatusForbidden},
+		{"GET", http.MethodGet, secret, "", nil, false, http.StatusMethodNotAllowed},
+		{"bad body", http.MethodPost, secret, `{"update_id": `, nil, false, http.StatusBadRequest},
+		{"body too large", http.MethodPost, secret, `{"x": "` + strings.Repeat("a", maxWebhookBodySize) + `"}`, nil, false, http.StatusBadRequest},
+		{"storage failure", http.MethodPost, secret, update, errStorage, false, http.StatusInternalServerError},
+		{"stopping listener", http.MethodPost, secret, update, nil, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved []int
+			save := func(u tgbotapi.Update) error {
+				if tt.saveErr != nil {
+					return tt.saveErr
+				}
+				saved = append(saved, u.UpdateID)
+				return nil
+			}
+			// unbuffered, so an update is only passed while the loop receives
+			updates := make(chan tgbotapi.Update)
+			stopping := make(chan struct{})
+			if tt.stopping {
+				close(stopping)
+			}
+			received := make(chan tgbotapi.Update, 1)
+			if !tt.stopping {
+				go func() {
+					if u, ok := <-updates; ok {
+						received <- u
+					}
+				}()
+			}
+			t.Cleanup(func() { close(updates) })
+
+			req := httptest.NewRequest(tt.method, "/tg", strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set(webhookSecretHeader, tt.token)
+			}
+			rec := httptest.NewRecorder()
+			webhookHandler(secret, save, updates, stopping).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.want != http.StatusOK {
+				select {
+				case u := <-received:
+					t.Errorf("update %d is delivered", u.UpdateID)
+				default:
+				}
+				if tt.want != http.StatusServiceUnavailable && len(saved) != 0 {
+					t.Errorf("updates %v are stored", saved)
+				}
+				return
+			}
+			if len(saved) != 1 || saved[0] != 42 {
+				t.Errorf("stored updates %v before acknowledging, want [42]", saved)
+			}
+			if u := <-received; u.UpdateID != 42 || u.Message == nil || u.Message.Text != "/list" {
+				t.Errorf("delivered update %+v", u)
+			}
+		})
+	}
+}
+
+func TestScenarioWebhookUpdatesProcessedAfterCrash(t *testing.T) {
+	db := initDB(filepath.Join(t.TempDir(), dbFileName))
+	// the bot crashed after acknowledging the updates, before processing them
+	for id, text := range map[int]string{500: "/sell 100 USD 270 GEL", 501: "/list"} {
+		update := tgbotapi.Update{UpdateID: id, Message: &tgbotapi.Message{
+			MessageID: id,
+			From:      &tgbotapi.User{ID: 2, UserName: "user2"},
+			Chat:      &tgbotapi.Chat{ID: testChatID, Type: "supergroup"},
+			Text:      text,
+			Entities:  &[]tgbotapi.MessageEntity{{Type: "bot_command", Length: strings.Index(text+" ", " ")}},
+		}}
+		if err := saveReceivedUpdate(db, update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an update processed completely isn't processed again
+	done := tgbotapi.Update{UpdateID: 499, Message: &tgbotapi.Message{MessageID: 499, From: &tgbotapi.User{ID: 3},
+		Chat: &tgbotapi.Chat{ID: testChatID, Type: "supergroup"}, Text: "/sell 5 USD GEL",
+		Entities: &[]tgbotapi.MessageEntity{{Type: "bot_command", Length: 5}}}}
+	if err := saveReceivedUpdate(db, done); err != nil {
+		t.Fatal(err)
+	}
+	if err := finishUpdate(db, done.UpdateID); err != nil {
+		t.Fatal(err)
+	}
+
+	s := startScenario(t, db)
+	// updates of a chat are processed in order, so the stored ones are done once the next one is
+	s.command(2, "/stats")
+	sent := s.tg.sent(testChatID)
+	if len(sent) != 3 || sent[0].ReplyTo != 500 || !strings.Contains(sent[1].Text, "@user2") ||
+		!strings.Contains(sent[2].Text, "Total offers: 1") {
+		t.Errorf("replies to the stored updates: %+v", sent)
+	}
+	if pending, err := getUnfinishedUpdates(db); err != nil || len(pending) != 0 {
+		t.Errorf("unfinished updates after processing: %+v, %v", pending, err)
+	}
+}